@@ -3,12 +3,15 @@
 package noise
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
 	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ed25519"
@@ -99,7 +102,7 @@ func checkRequirements(isClient bool, config *Config) (err error) {
 			return errNoPubkeyVerifier
 		}
 	}
-	if ht == Noise_NNpsk2 && len(config.PreSharedKey) != 32 {
+	if patterns[ht].usesPsk() && len(config.PreSharedKey) != 32 {
 		return errors.New("noise: a 32-byte pre-shared key needs to be passed as noise.Config")
 	}
 	return nil
@@ -190,6 +193,33 @@ func Dial(network, addr string, config *Config) (*Conn, error) {
 	return DialWithDialer(new(net.Dialer), network, addr, config)
 }
 
+// DialContext connects to the given network address and initiates a Noise
+// handshake, like Dial. If the context is canceled or expires before the
+// connection and the handshake are complete, the error of the context is
+// returned.
+func DialContext(ctx context.Context, network, addr string, config *Config) (*Conn, error) {
+	// check Config
+	if config == nil {
+		return nil, errors.New("noise: no noise.Config set")
+	}
+	if err := checkRequirements(true, config); err != nil {
+		return nil, err
+	}
+
+	rawConn, err := new(net.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := Client(rawConn, config)
+	if err = conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
 //
 // Authentication helpers
 //
@@ -221,6 +251,24 @@ func CreateStaticPublicKeyProof(rootPrivateKey ed25519.PrivateKey, keyPair *KeyP
 	return signature
 }
 
+//
+// Fingerprints
+//
+
+// Fingerprint returns a short fingerprint of a static public key that can be
+// displayed to users and compared by them, for example in trust-on-first-use
+// interfaces. It is made of the first 160 bits of a SHA-256 hash of the key,
+// encoded in base32 and grouped by 4 characters ("ABCD EFGH ...").
+func Fingerprint(publicKey [32]byte) string {
+	digest := hash(append([]byte("NoiseGo fingerprint"), publicKey[:]...))
+	encoded := base32.StdEncoding.EncodeToString(digest[:20])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
 //
 // Storage of Noise Signing Root Keys
 //
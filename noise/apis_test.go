@@ -67,3 +67,22 @@ func TestCreationKeys(t *testing.T) {
 
 	// end
 }
+
+func TestFingerprint(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	fingerprint := Fingerprint(keyPair.PublicKey)
+	if len(fingerprint) != 8*4+7 {
+		t.Fatal("unexpected fingerprint format:", fingerprint)
+	}
+	if Fingerprint(keyPair.PublicKey) != fingerprint {
+		t.Fatal("the fingerprint of a key should not change")
+	}
+	if Fingerprint(GenerateKeypair(nil).PublicKey) == fingerprint {
+		t.Fatal("different keys should have different fingerprints")
+	}
+
+	// known answer
+	if Fingerprint([32]byte{}) != "XFBX I3OY KNMA G6KX 4DAV NQRW AKUO CA5H" {
+		t.Fatal("fingerprint does not match the expected value")
+	}
+}
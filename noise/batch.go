@@ -0,0 +1,50 @@
+package noise
+
+import "errors"
+
+//
+// Batch opener
+//
+
+// BatchOpener opens messages sent with the one-way N pattern to the same
+// recipient, for example by a mailbox server. The initialization of the
+// handshake, which only depends on the recipient static key, is done once
+// and every message is processed from a copy of the initialized state.
+//
+// Each message still requires its own DH with the ephemeral key of the
+// sender, which dominates the cost of opening a message. The cached work is
+// the hashing of the protocol name, of the prologue and of the recipient
+// static key: it saves a few allocations per message, but the time saved is
+// within measurement noise (compare BenchmarkOpenN and BenchmarkBatchOpener).
+//
+// A BatchOpener is safe for concurrent use.
+type BatchOpener struct {
+	base handshakeState
+}
+
+// NewBatchOpener returns a BatchOpener for messages sent to recipient with
+// the N pattern and an empty prologue.
+func NewBatchOpener(recipient *KeyPair) (*BatchOpener, error) {
+	h, err := newHandshakeState(Noise_N, "", CipherChaChaPoly, false, nil, recipient, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.finishPrologue(); err != nil {
+		return nil, err
+	}
+	return &BatchOpener{base: h}, nil
+}
+
+// Open decrypts a single N handshake message and returns its payload.
+func (b *BatchOpener) Open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) > NoiseMessageLength {
+		return nil, errors.New("noise: the message is too long")
+	}
+	h := b.base.Clone()
+	defer h.clear()
+	var payload []byte
+	if _, _, err := h.readMessage(ciphertext, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,36 @@
+package noise
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBatchOpener(t *testing.T) {
+	recipient := GenerateKeypair(nil)
+	opener, err := NewBatchOpener(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		payload := fmt.Sprintf("message %d", i)
+		opened, err := opener.Open(sealN(recipient, []byte(payload)))
+		if err != nil || string(opened) != payload {
+			t.Fatal("cannot open message", i, err)
+		}
+	}
+
+	// messages to another recipient or modified messages are rejected
+	if _, err = opener.Open(sealN(GenerateKeypair(nil), []byte("hello"))); err == nil {
+		t.Fatal("a message to another recipient should not be opened")
+	}
+	message := sealN(recipient, []byte("hello"))
+	message[len(message)-1] ^= 1
+	if _, err = opener.Open(message); err == nil {
+		t.Fatal("a modified message should not be opened")
+	}
+
+	if _, err = NewBatchOpener(nil); err == nil {
+		t.Fatal("a BatchOpener requires a recipient key pair")
+	}
+}
@@ -0,0 +1,190 @@
+package noise
+
+import (
+	"runtime"
+	"testing"
+)
+
+func BenchmarkHandshakeXX(b *testing.B) {
+	initiatorKey := GenerateKeypair(nil)
+	responderKey := GenerateKeypair(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		initiator := initialize(Noise_XX, true, nil, initiatorKey, nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+		benchmarkHandshake(b, &initiator, &responder)
+	}
+}
+
+func BenchmarkHandshakeXXPrewarmed(b *testing.B) {
+	initiatorKey := GenerateKeypair(nil)
+	responderKey := GenerateKeypair(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// generate the two ephemerals outside of the timed section
+		b.StopTimer()
+		PrewarmEphemerals(2)
+		for len(ephemeralPool) < 2 {
+			runtime.Gosched()
+		}
+		b.StartTimer()
+
+		initiator := initialize(Noise_XX, true, nil, initiatorKey, nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+		benchmarkHandshake(b, &initiator, &responder)
+	}
+}
+
+func BenchmarkTransportEncrypt(b *testing.B) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	c1, _ := benchmarkHandshake(b, &initiator, &responder)
+	plaintext := make([]byte, 1024)
+	b.SetBytes(int64(len(plaintext)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c1.encryptWithAd(nil, plaintext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGenerateKeypair(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		GenerateKeypair(nil)
+	}
+}
+
+// benchmarkHandshake goes through a full handshake, starting with initiator
+func benchmarkHandshake(b *testing.B, initiator, responder *handshakeState) (c1, c2 *cipherState) {
+	writer, reader := initiator, responder
+	for {
+		var message, payload []byte
+		c1, c2, err := writer.writeMessage(nil, &message)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err = reader.readMessage(message, &payload); err != nil {
+			b.Fatal(err)
+		}
+		if c1 != nil {
+			return c1, c2
+		}
+		writer, reader = reader, writer
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	responderKey := GenerateKeypair(nil)
+	payload := make([]byte, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+		var message1, payload1 []byte
+		initiator.writeMessage(nil, &message1)
+		responder.readMessage(message1, &payload1)
+		b.StartTimer()
+
+		// <- e, ee, s, es
+		var message2 []byte
+		if _, _, err := responder.writeMessage(payload, &message2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The message patterns are parsed once, when they are registered (see
+// ParseHandshakePattern), and readMessage iterates over their tokens: the
+// allocations reported here come from the cryptographic operations.
+func BenchmarkReadMessage(b *testing.B) {
+	responderKey := GenerateKeypair(nil)
+	payload := make([]byte, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+		var message1, payload1 []byte
+		initiator.writeMessage(nil, &message1)
+		responder.readMessage(message1, &payload1)
+		var message2 []byte
+		responder.writeMessage(payload, &message2)
+		received := make([]byte, 0, len(payload))
+		b.StartTimer()
+
+		// <- e, ee, s, es
+		if _, _, err := initiator.readMessage(message2, &received); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// sealN returns an N handshake message sent to recipient
+func sealN(recipient *KeyPair, payload []byte) []byte {
+	sender := initialize(Noise_N, true, nil, nil, nil, &KeyPair{PublicKey: recipient.PublicKey}, nil)
+	var message []byte
+	if _, _, err := sender.writeMessage(payload, &message); err != nil {
+		panic(err)
+	}
+	return message
+}
+
+func BenchmarkOpenN(b *testing.B) {
+	recipient := GenerateKeypair(nil)
+	message := sealN(recipient, make([]byte, 100))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := initialize(Noise_N, false, nil, recipient, nil, nil, nil)
+		var payload []byte
+		if _, _, err := h.readMessage(message, &payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchOpener(b *testing.B) {
+	recipient := GenerateKeypair(nil)
+	message := sealN(recipient, make([]byte, 100))
+	opener, err := NewBatchOpener(recipient)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := opener.Open(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteMessageInto can be compared with BenchmarkWriteMessage: the
+// message buffer is not allocated, the remaining allocations are made by
+// the cryptographic primitives.
+func BenchmarkWriteMessageInto(b *testing.B) {
+	responderKey := GenerateKeypair(nil)
+	payload := make([]byte, 100)
+	dst := make([]byte, MessageSize(Noise_XX, 1, len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+		var message1, payload1 []byte
+		initiator.writeMessage(nil, &message1)
+		responder.readMessage(message1, &payload1)
+		b.StartTimer()
+
+		// <- e, ee, s, es
+		if _, _, _, err := responder.writeMessageInto(dst, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
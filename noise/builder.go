@@ -0,0 +1,232 @@
+package noise
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//
+// Builder
+//
+
+// Builder configures a handshakeState step by step, as an alternative to
+// initialize whose positional key pair arguments are easy to mix up. The
+// configuration is validated against the handshake pattern by Build.
+//
+//	h, err := NewBuilder(Noise_IK).AsInitiator().WithStatic(keyPair).WithRemoteStatic(serverKey).Build()
+type Builder struct {
+	handshakeType noiseHandshakeType
+	// 0 if the role has not been set, 1 for an initiator, 2 for a responder
+	role int
+	// true if AsInitiator and AsResponder were both called
+	conflictingRoles bool
+
+	s            *KeyPair
+	rs           *KeyPair
+	e            *KeyPair
+	re           *CachedEphemeral
+	prologue     []byte
+	psk          []byte
+	protocolName string
+	cipher       CipherFunction
+	freshness    time.Duration
+	binding      []byte
+}
+
+// NewBuilder returns a Builder for a handshake using the handshake pattern
+// handshakeType.
+func NewBuilder(handshakeType noiseHandshakeType) *Builder {
+	return &Builder{handshakeType: handshakeType}
+}
+
+func (b *Builder) setRole(role int) *Builder {
+	if b.role != 0 && b.role != role {
+		b.conflictingRoles = true
+	}
+	b.role = role
+	return b
+}
+
+// AsInitiator configures the handshake for the initiator.
+func (b *Builder) AsInitiator() *Builder { return b.setRole(1) }
+
+// AsResponder configures the handshake for the responder.
+func (b *Builder) AsResponder() *Builder { return b.setRole(2) }
+
+// WithStatic sets the local static key pair.
+func (b *Builder) WithStatic(keyPair *KeyPair) *Builder {
+	b.s = keyPair
+	return b
+}
+
+// WithRemoteStatic sets the static public key of the other peer, for
+// patterns where it is known prior to the handshake.
+func (b *Builder) WithRemoteStatic(publicKey [32]byte) *Builder {
+	b.rs = &KeyPair{PublicKey: publicKey}
+	return b
+}
+
+// WithEphemeral sets the local ephemeral key pair, for patterns where it is
+// sent in a pre-message. For example a responder can publish the public part
+// of a one-time key pair in advance; it should erase the key pair once it has
+// been used in a handshake.
+func (b *Builder) WithEphemeral(keyPair *KeyPair) *Builder {
+	b.e = keyPair
+	return b
+}
+
+// WithCachedEphemeral sets the ephemeral public key of the other peer, for
+// patterns where it is known prior to the handshake. This allows initiators
+// to send encrypted data in their first message to a responder whose
+// ephemeral key was obtained beforehand (from a previous connection or as a
+// published one-time key), like the early data of TLS 1.3. See
+// CachedEphemeral for the reuse of such keys.
+func (b *Builder) WithCachedEphemeral(cached *CachedEphemeral) *Builder {
+	b.re = cached
+	return b
+}
+
+// WithPrologue sets the prologue. More of it can be added to the
+// handshakeState via AddPrologue until the first message is processed.
+func (b *Builder) WithPrologue(prologue []byte) *Builder {
+	b.prologue = prologue
+	return b
+}
+
+// WithPreSharedKey sets the 32-byte pre-shared key of a psk pattern.
+func (b *Builder) WithPreSharedKey(psk []byte) *Builder {
+	b.psk = psk
+	return b
+}
+
+// WithProtocolName replaces the protocol name of the specification, see
+// Config.ProtocolName.
+func (b *Builder) WithProtocolName(protocolName string) *Builder {
+	b.protocolName = protocolName
+	return b
+}
+
+// WithFreshness protects the responder against the replay of old handshakes:
+// the initiator sends a timestamp and a random nonce at the start of the
+// payload of its first message, and the responder rejects the message with
+// ErrStaleHandshake if the timestamp is more than maxSkew away from its own
+// clock. Both peers must use it, see freshness.go.
+func (b *Builder) WithFreshness(maxSkew time.Duration) *Builder {
+	b.freshness = maxSkew
+	return b
+}
+
+// WithExternalBinding binds the handshake to an outer channel, for example
+// a TLS connection the handshake is tunneled in: binding is a value unique
+// to that channel (like the output of a TLS exporter) that both peers obtain
+// independently. It is added to the prologue as a tagged segment (see
+// AddPrologueTagged) after the prologue of WithPrologue, and a handshake
+// relayed over a different outer channel fails.
+func (b *Builder) WithExternalBinding(binding []byte) *Builder {
+	b.binding = binding
+	return b
+}
+
+// WithCipher sets the cipher function, ChaChaPoly by default.
+func (b *Builder) WithCipher(cipher CipherFunction) *Builder {
+	b.cipher = cipher
+	return b
+}
+
+// Build validates the configuration and returns the handshakeState. It
+// returns an error if the role is not set, if a key required by the
+// handshake pattern is missing, or if a key is set that the pattern does not
+// use.
+func (b *Builder) Build() (*handshakeState, error) {
+	handshakePattern, ok := patterns[b.handshakeType]
+	if !ok {
+		return nil, ErrUnknownPattern
+	}
+	if b.conflictingRoles {
+		return nil, errors.New("noise: the handshake cannot be built for both an initiator and a responder")
+	}
+	if b.role == 0 {
+		return nil, errors.New("noise: the role of the peer must be set with AsInitiator or AsResponder")
+	}
+	initiator := b.role == 1
+
+	if b.s != nil && !handshakePattern.requiresLocalStatic(initiator) {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " does not use a local static key")
+	}
+	if b.rs != nil && !handshakePattern.requiresRemoteStatic(initiator) {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " does not use a remote static key known in advance")
+	}
+	if b.e != nil && !handshakePattern.requiresLocalEphemeral(initiator) {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " does not send an ephemeral key in a pre-message")
+	}
+	if b.re != nil && !handshakePattern.requiresRemoteEphemeral(initiator) {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " does not use a remote ephemeral key known in advance")
+	}
+	if handshakePattern.usesPsk() && len(b.psk) != 32 {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " requires a 32-byte pre-shared key")
+	}
+	if !handshakePattern.usesPsk() && b.psk != nil {
+		return nil, errors.New("noise: pattern " + handshakePattern.name + " does not use a pre-shared key")
+	}
+
+	var re *KeyPair
+	if b.re != nil {
+		re = &KeyPair{PublicKey: b.re.PublicKey}
+	}
+	h, err := newHandshakeState(b.handshakeType, b.protocolName, b.cipher, initiator, b.prologue, b.s, b.e, b.rs, re)
+	if err != nil {
+		return nil, err
+	}
+	if b.binding != nil {
+		if err = h.AddPrologueTagged("external binding", b.binding); err != nil {
+			return nil, err
+		}
+	}
+	// the key is only consumed by a handshake that can actually be started
+	if b.re != nil {
+		if err = b.re.use(); err != nil {
+			return nil, err
+		}
+	}
+	h.psk = b.psk
+	h.freshness = b.freshness
+	return &h, nil
+}
+
+//
+// Cached ephemeral keys
+//
+
+// ErrEphemeralReused is returned by Build when a single-use CachedEphemeral
+// has already been used by another handshake.
+var ErrEphemeralReused = errors.New("noise: the cached ephemeral key has already been used")
+
+// A CachedEphemeral is an ephemeral public key of the other peer obtained
+// before the handshake, see Builder.WithCachedEphemeral. Using the same
+// ephemeral key of a responder in several handshakes removes the forward
+// secrecy of the data sent before the responder replies, and lets an
+// attacker replay the first message of the initiator. If SingleUse is set, the
+// key can only be used to build one handshakeState: the next calls to Build
+// return ErrEphemeralReused. A CachedEphemeral is safe for concurrent use.
+type CachedEphemeral struct {
+	PublicKey [32]byte
+	SingleUse bool
+
+	mu   sync.Mutex
+	used bool
+}
+
+// use marks a single-use key as used, or fails if it already is
+func (c *CachedEphemeral) use() error {
+	if !c.SingleUse {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.used {
+		return ErrEphemeralReused
+	}
+	c.used = true
+	return nil
+}
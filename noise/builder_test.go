@@ -0,0 +1,120 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	clientKey := GenerateKeypair(nil)
+	serverKey := GenerateKeypair(nil)
+
+	initiator, err := NewBuilder(Noise_IK).AsInitiator().WithStatic(clientKey).WithRemoteStatic(serverKey.PublicKey).WithPrologue([]byte("prologue")).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewBuilder(Noise_IK).AsResponder().WithStatic(serverKey).WithPrologue([]byte("prologue")).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	completeHandshake(t, initiator, responder)
+	if responder.rs.PublicKey != clientKey.PublicKey {
+		t.Fatal("the responder did not receive the static key of the initiator")
+	}
+
+	invalid := []*Builder{
+		// no role
+		NewBuilder(Noise_XX).WithStatic(clientKey),
+		// both roles
+		NewBuilder(Noise_XX).AsInitiator().AsResponder().WithStatic(clientKey),
+		// missing keys
+		NewBuilder(Noise_XX).AsInitiator(),
+		NewBuilder(Noise_IK).AsInitiator().WithStatic(clientKey),
+		NewBuilder(Noise_NNpsk2).AsInitiator(),
+		// keys that the pattern does not use
+		NewBuilder(Noise_NK).AsInitiator().WithStatic(clientKey).WithRemoteStatic(serverKey.PublicKey),
+		NewBuilder(Noise_XX).AsInitiator().WithStatic(clientKey).WithRemoteStatic(serverKey.PublicKey),
+		NewBuilder(Noise_XX).AsInitiator().WithStatic(clientKey).WithPreSharedKey(make([]byte, 32)),
+		// unknown pattern
+		NewBuilder(Noise_NN).AsInitiator(),
+	}
+	for idx, builder := range invalid {
+		if _, err := builder.Build(); err == nil {
+			t.Errorf("builder %d should have been rejected", idx)
+		}
+	}
+}
+
+func TestBuilderCachedEphemeral(t *testing.T) {
+	// the responder published a one-time ephemeral key
+	zeroRTT, err := ParseHandshakePattern("E0RTT", []string{"<- e", "...", "-> e, ee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterPattern(zeroRTT) })
+	oneTimeKey := GenerateKeypair(nil)
+	cached := &CachedEphemeral{PublicKey: oneTimeKey.PublicKey, SingleUse: true}
+
+	initiator, err := NewBuilder(zeroRTT).AsInitiator().WithCachedEphemeral(cached).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewBuilder(zeroRTT).AsResponder().WithEphemeral(oneTimeKey).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first message already carries encrypted data
+	var message, payload []byte
+	if _, _, err = initiator.writeMessage([]byte("early data"), &message); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(message, []byte("early data")) {
+		t.Fatal("the early data should be encrypted")
+	}
+	if _, _, err = responder.readMessage(message, &payload); err != nil || string(payload) != "early data" {
+		t.Fatal("the early data should be decrypted by the responder", err)
+	}
+
+	// a single-use key cannot be used twice
+	if _, err = NewBuilder(zeroRTT).AsInitiator().WithCachedEphemeral(cached).Build(); err != ErrEphemeralReused {
+		t.Fatal("a single-use ephemeral key should be rejected the second time", err)
+	}
+	reusable := &CachedEphemeral{PublicKey: oneTimeKey.PublicKey}
+	for i := 0; i < 2; i++ {
+		if _, err = NewBuilder(zeroRTT).AsInitiator().WithCachedEphemeral(reusable).Build(); err != nil {
+			t.Fatal("a reusable ephemeral key should be accepted", err)
+		}
+	}
+
+	// patterns without ephemeral pre-messages reject them
+	if _, err = NewBuilder(Noise_XX).AsInitiator().WithStatic(GenerateKeypair(nil)).WithCachedEphemeral(reusable).Build(); err == nil {
+		t.Fatal("XX does not use a cached ephemeral key")
+	}
+}
+
+func TestBuilderExternalBinding(t *testing.T) {
+	serverKey := GenerateKeypair(nil)
+	handshake := func(clientBinding, serverBinding []byte) error {
+		initiator, err := NewBuilder(Noise_IK).AsInitiator().WithStatic(GenerateKeypair(nil)).WithRemoteStatic(serverKey.PublicKey).WithExternalBinding(clientBinding).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := NewBuilder(Noise_IK).AsResponder().WithStatic(serverKey).WithExternalBinding(serverBinding).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message, payload []byte
+		initiator.writeMessage(nil, &message)
+		_, _, err = responder.readMessage(message, &payload)
+		return err
+	}
+
+	// the exporter outputs of the outer TLS connections
+	if err := handshake([]byte("exporter output"), []byte("exporter output")); err != nil {
+		t.Fatal("the same binding should not change the handshake", err)
+	}
+	if err := handshake([]byte("exporter output"), []byte("another connection")); err == nil {
+		t.Fatal("a handshake relayed over another channel should fail")
+	}
+}
@@ -0,0 +1,50 @@
+package noise
+
+import "errors"
+
+//
+// Certificates
+//
+
+// A Certificate authenticates a static public key, for example with the
+// signature of a certificate authority. This package does not interpret it:
+// it is sent to the other peer during the handshake and is checked by the
+// Config.VerifyPeerCertificate callback of that peer, which allows trusting
+// static keys through a PKI instead of pinning them.
+//
+// A peer sends its certificate in the payload of the handshake message
+// carrying its static key, or of its first message if its static key is known
+// from a pre-message. The certificate is encoded with EncodeFields, followed
+// by the rest of the payload. Both peers must agree on the use of
+// certificates.
+type Certificate []byte
+
+// ErrNoCertificate is returned by Handshake when VerifyPeerCertificate is set
+// and the remote peer did not send a certificate.
+var ErrNoCertificate = errors.New("noise: the remote peer did not send a certificate")
+
+// SetCertificate sets the certificate sent to the other peer during the
+// handshake, see Certificate.
+func (c *Config) SetCertificate(cert Certificate) {
+	c.certificate = cert
+}
+
+// verifyPeerCertificate decodes the certificate of the remote peer from
+// payload, verifies it with Config.VerifyPeerCertificate and returns the rest
+// of the payload
+func (c *Conn) verifyPeerCertificate(payload []byte) ([]byte, error) {
+	fields, err := DecodeFields(payload)
+	if err != nil || len(fields) == 0 || len(fields) > 2 || len(fields[0]) == 0 {
+		return nil, ErrNoCertificate
+	}
+	if c.hs.rs.isEmpty() {
+		return nil, errors.New("noise: a certificate was received before the remote static key")
+	}
+	if err = c.config.VerifyPeerCertificate(Certificate(fields[0]), c.hs.rs.PublicKey[:]); err != nil {
+		return nil, errors.New("noise: the certificate of the remote peer could not be verified: " + err.Error())
+	}
+	if len(fields) == 1 {
+		return []byte{}, nil
+	}
+	return fields[1], nil
+}
@@ -0,0 +1,80 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// mockCertificate "signs" a static public key
+func mockCertificate(keyPair *KeyPair) Certificate {
+	return append(Certificate("signed:"), keyPair.PublicKey[:]...)
+}
+
+func mockVerifier(cert Certificate, staticKey []byte) error {
+	if !bytes.Equal(cert, append(Certificate("signed:"), staticKey...)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func TestCertificate(t *testing.T) {
+	for _, valid := range []bool{true, false} {
+		clientConfig := Config{
+			KeyPair:               GenerateKeypair(nil),
+			HandshakePattern:      Noise_XX,
+			PublicKeyVerifier:     verifier,
+			VerifyPeerCertificate: mockVerifier,
+		}
+		serverConfig := Config{
+			KeyPair:               GenerateKeypair(nil),
+			HandshakePattern:      Noise_XX,
+			PublicKeyVerifier:     verifier,
+			VerifyPeerCertificate: mockVerifier,
+		}
+		clientConfig.SetCertificate(mockCertificate(clientConfig.KeyPair))
+		if valid {
+			serverConfig.SetCertificate(mockCertificate(serverConfig.KeyPair))
+		} else {
+			serverConfig.SetCertificate(mockCertificate(GenerateKeypair(nil)))
+		}
+
+		clientPipe, serverPipe := net.Pipe()
+		client := Client(clientPipe, &clientConfig)
+		server := Server(serverPipe, &serverConfig)
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- server.Handshake() }()
+
+		err := client.Handshake()
+		if valid {
+			if err != nil {
+				t.Fatal("the certificate of the server should be accepted", err)
+			}
+			if err = <-serverErr; err != nil {
+				t.Fatal("the certificate of the client should be accepted", err)
+			}
+		} else if err == nil {
+			t.Fatal("the certificate of another key should be rejected")
+		}
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
+
+func TestCertificateMissing(t *testing.T) {
+	clientConfig := Config{
+		KeyPair:               GenerateKeypair(nil),
+		HandshakePattern:      Noise_XX,
+		PublicKeyVerifier:     verifier,
+		VerifyPeerCertificate: mockVerifier,
+	}
+	serverConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier}
+	clientPipe, serverPipe := net.Pipe()
+	defer clientPipe.Close()
+	defer serverPipe.Close()
+	go Server(serverPipe, &serverConfig).Handshake()
+	if err := Client(clientPipe, &clientConfig).Handshake(); err != ErrNoCertificate {
+		t.Fatal("a server without a certificate should be rejected", err)
+	}
+}
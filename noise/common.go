@@ -1,5 +1,10 @@
 package noise
 
+import (
+	"io"
+	"time"
+)
+
 // The following constants represent the details of this implementation of the Noise specification.
 const (
 	NoiseDraftVersion = "33"
@@ -33,8 +38,88 @@ type Config struct {
 	// static public key as part of the handshake, this callback is mandatory in
 	// order to validate it
 	PublicKeyVerifier func(publicKey, proof []byte) bool
+	// if set, the static public key the remote peer must authenticate with
+	// during the handshake. The handshake fails with ErrPinMismatch otherwise
+	ExpectedRemoteStatic [32]byte
+	// if set, called with the certificate sent by the remote peer (see
+	// Config.SetCertificate) and its static public key. The handshake fails
+	// if no certificate is received or if this callback returns an error
+	VerifyPeerCertificate func(cert Certificate, staticKey []byte) error
+	// set by SetCertificate
+	certificate Certificate
+	// if set, the result of PrecomputeStaticShared for KeyPair and the static
+	// key of the remote peer, used for the ss token instead of computing the
+	// DH. If it does not correspond to the keys of the two peers, they do not
+	// derive the same keys and the handshake fails
+	StaticShared [32]byte
 	// a pre-shared key for handshake patterns including a `psk` token
 	PreSharedKey []byte
+	// the cipher function used during and after the handshake, ChaChaPoly by
+	// default. Both peers must use the same one. The cipher functions of the
+	// specification all have 16-byte authentication tags.
+	Cipher CipherFunction
+	// the protocol name used to initialize the handshake, by default the one
+	// of the specification (for example "Noise_XX_25519_ChaChaPoly_SHA256").
+	// A custom name can be used for domain separation between applications;
+	// both peers must use the same name, and the protocol is then no longer
+	// interoperable with other Noise implementations. A "_macNN" suffix
+	// states the length of the authentication tags; only 16 is supported, see
+	// checkMacLenSuffix
+	ProtocolName string
+	// if true, ephemeral public keys are encoded with Elligator 2 so that
+	// they look like random bytes on the wire. Both peers must set it, and
+	// the protocol is then no longer interoperable with other Noise
+	// implementations (see elligator.go for the limits of this encoding)
+	ObfuscateEphemeral bool
+	// if set, labels mixed in the transport keys at the end of the handshake,
+	// the first one for the key used from the initiator to the responder and
+	// the second one for the other direction. This allows versioning the
+	// transport keys; both peers must use the same labels. By default the
+	// keys of the specification are used
+	SplitLabels [2][]byte
+	// if set on a server, cookies are enabled: the server answers the first
+	// handshake message of a client with a cookie computed from this secret
+	// and from the address of the client, and only continues the handshake
+	// once the client has sent the cookie back (see cookie.go). Clients
+	// handle cookies automatically
+	CookieSecret []byte
+	// if true, the handshake fails with ErrEarlyPayload when a non-empty
+	// payload is written in a handshake message that is not returned by
+	// SafePayloadMessages. As the proof of Conn is sent as a payload, this
+	// can only be used with patterns where it is sent in a safe message
+	EnforceSafePayloads bool
+	// optional hooks called by Conn for monitoring: OnHandshakeStart when a
+	// handshake starts, then either OnHandshakeComplete with its duration and
+	// the name of the handshake pattern (for example "XX"), or
+	// OnHandshakeError with the error and the index of the handshake message
+	// that was being written or read (starting at 0)
+	OnHandshakeStart    func()
+	OnHandshakeComplete func(duration time.Duration, pattern string)
+	OnHandshakeError    func(err error, messageIndex int)
+	// if set, the source of randomness used to generate the ephemeral keys of
+	// the handshake instead of crypto/rand, for example a hardware RNG. The
+	// handshake fails if it cannot produce enough bytes
+	Rand io.Reader
+	// if true, handshake payloads can be compressed, see compression.go.
+	// Both peers must set it. Conn only sends public data in its payloads,
+	// which it compresses
+	PayloadCompression bool
+	// if true, the public keys received during the handshake must be
+	// canonically encoded, otherwise the handshake fails with
+	// ErrNonCanonicalKey (see isCanonicalKey)
+	StrictEncoding bool
+	// if true, the data queued with Conn.QueueWrite before the handshake is
+	// sent in the first handshake message where payloads are safe. Both
+	// peers must set it, see pending.go
+	PiggybackWrites bool
+	// if true, the private ephemeral keys are derived from the output of the
+	// random number generator, the static private key and the handshake
+	// transcript (the prologue and the messages so far), instead of being
+	// the output of the generator alone. Ephemeral keys then remain
+	// unpredictable with a broken generator, as long as the static key is
+	// secret and the transcripts differ. A peer without a static key only
+	// benefits from the transcript, which an attacker knows
+	HedgedEphemerals bool
 	// by default a noise protocol is full-duplex, meaning that both the client
 	// and the server can write on the channel at the same time. Setting this value
 	// to true will require the peers to write and read in turns. If this requirement
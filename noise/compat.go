@@ -0,0 +1,138 @@
+package noise
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// flynn/noise compatibility
+//
+
+// HandshakeState wraps a handshakeState behind the API of the HandshakeState
+// type of github.com/flynn/noise, so that code written against that package
+// can be moved to this one with few changes. Unlike flynn/noise, the role of
+// the peer is given to NewHandshakeState instead of being part of Config.
+type HandshakeState struct {
+	h            *handshakeState
+	messageIndex int
+}
+
+// CipherState wraps a cipherState behind the API of the CipherState type of
+// github.com/flynn/noise.
+type CipherState struct {
+	c *cipherState
+}
+
+// errors returned instead of the panics of writeMessage and readMessage
+var (
+	errShouldWrite = fmt.Errorf("%w: unexpected call to ReadMessage should be WriteMessage", ErrWrongRole)
+	errShouldRead  = fmt.Errorf("%w: unexpected call to WriteMessage should be ReadMessage", ErrWrongRole)
+	errCompleted   = errors.New("noise: the handshake is already completed")
+)
+
+// NewHandshakeState returns a HandshakeState from a Config, see NewHandshake.
+func NewHandshakeState(config *Config, initiator bool) (*HandshakeState, error) {
+	h, err := NewHandshake(config, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return &HandshakeState{h: h}, nil
+}
+
+// WriteMessage appends the next handshake message, carrying payload, to out
+// and returns it. Once the handshake is completed, it also returns the
+// CipherStates used to encrypt from the initiator to the responder, and from
+// the responder to the initiator.
+func (s *HandshakeState) WriteMessage(out, payload []byte) ([]byte, *CipherState, *CipherState, error) {
+	if s.h.IsHandshakeComplete() {
+		return nil, nil, nil, errCompleted
+	}
+	if !s.h.shouldWrite {
+		return nil, nil, nil, errShouldRead
+	}
+	if len(payload) > NoiseMaxPlaintextSize {
+		return nil, nil, nil, errors.New("noise: the payload is too long")
+	}
+	c1, c2, err := s.h.writeMessage(payload, &out)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.messageIndex++
+	return out, wrapCipherState(c1), wrapCipherState(c2), nil
+}
+
+// ReadMessage processes the next handshake message and appends its payload
+// to out. Once the handshake is completed, it also returns the CipherStates,
+// as WriteMessage does.
+func (s *HandshakeState) ReadMessage(out, message []byte) ([]byte, *CipherState, *CipherState, error) {
+	if s.h.IsHandshakeComplete() {
+		return nil, nil, nil, errCompleted
+	}
+	if s.h.shouldWrite {
+		return nil, nil, nil, errShouldWrite
+	}
+	c1, c2, err := s.h.readMessage(message, &out)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.messageIndex++
+	return out, wrapCipherState(c1), wrapCipherState(c2), nil
+}
+
+// ChannelBinding returns the handshake hash, which uniquely identifies the
+// handshake once it is completed.
+func (s *HandshakeState) ChannelBinding() []byte {
+	return append([]byte(nil), s.h.symmetricState.h[:]...)
+}
+
+// PeerStatic returns the static public key of the other peer, or nil if it
+// is not known yet.
+func (s *HandshakeState) PeerStatic() []byte {
+	if s.h.rs.isEmpty() {
+		return nil
+	}
+	return append([]byte(nil), s.h.rs.PublicKey[:]...)
+}
+
+// MessageIndex returns the number of handshake messages processed so far.
+func (s *HandshakeState) MessageIndex() int {
+	return s.messageIndex
+}
+
+func wrapCipherState(c *cipherState) *CipherState {
+	if c == nil {
+		return nil
+	}
+	return &CipherState{c: c}
+}
+
+// Encrypt appends the encryption of plaintext, authenticating ad, to out and
+// returns it.
+func (c *CipherState) Encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	ciphertext, err := c.c.encryptWithAd(ad, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, ciphertext...), nil
+}
+
+// Decrypt appends the decryption of ciphertext, authenticated with ad, to out
+// and returns it.
+func (c *CipherState) Decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.c.decryptWithAd(ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, plaintext...), nil
+}
+
+// Rekey updates the key, see the Rekey function of the specification.
+func (c *CipherState) Rekey() {
+	c.c.Rekey()
+}
+
+// Nonce returns the nonce that will be used by the next operation.
+func (c *CipherState) Nonce() uint64 {
+	return c.c.n
+}
@@ -0,0 +1,80 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+func TestFlynnCompatibility(t *testing.T) {
+	// our engine behind the flynn/noise API, against flynn/noise
+	initiator, err := NewHandshakeState(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	responderKey, _ := cs.GenerateKeypair(rand.Reader)
+	responder, _ := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cs,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		StaticKeypair: responderKey,
+	})
+
+	// -> e
+	msg, _, _, err := initiator.WriteMessage(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = initiator.WriteMessage(nil, nil); err == nil {
+		t.Fatal("writing out of turn should return an error")
+	}
+	out, _, _, err := responder.ReadMessage(nil, msg)
+	if err != nil || string(out) != "hello" {
+		t.Fatal("first message failed", err)
+	}
+	// <- e, ee, s, es
+	msg, _, _, _ = responder.WriteMessage(nil, []byte("world"))
+	out, _, _, err = initiator.ReadMessage(nil, msg)
+	if err != nil || string(out) != "world" {
+		t.Fatal("second message failed", err)
+	}
+	if !bytes.Equal(initiator.PeerStatic(), responderKey.Public) {
+		t.Fatal("the static key of the responder was not received")
+	}
+	// -> s, se
+	msg, initiatorEncrypt, initiatorDecrypt, err := initiator.WriteMessage(nil, nil)
+	if err != nil || initiatorEncrypt == nil || initiatorDecrypt == nil {
+		t.Fatal("the handshake should be completed", err)
+	}
+	_, responderDecrypt, responderEncrypt, err := responder.ReadMessage(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initiator.MessageIndex() != 3 || !bytes.Equal(initiator.ChannelBinding(), responder.ChannelBinding()) {
+		t.Fatal("both peers should agree on the handshake")
+	}
+	if _, _, _, err = initiator.ReadMessage(nil, msg); err == nil {
+		t.Fatal("a completed handshake should not process more messages")
+	}
+
+	// transport
+	ciphertext, err := initiatorEncrypt.Encrypt(nil, nil, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := responderDecrypt.Decrypt(nil, nil, ciphertext)
+	if err != nil || string(plaintext) != "ping" {
+		t.Fatal("initiator to responder failed", err)
+	}
+	ciphertext = responderEncrypt.Encrypt(nil, nil, []byte("pong"))
+	plaintext, err = initiatorDecrypt.Decrypt([]byte("got "), nil, ciphertext)
+	if err != nil || string(plaintext) != "got pong" {
+		t.Fatal("responder to initiator failed", err)
+	}
+	if initiatorEncrypt.Nonce() != 1 {
+		t.Fatal("unexpected nonce", initiatorEncrypt.Nonce())
+	}
+}
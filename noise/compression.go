@@ -0,0 +1,73 @@
+package noise
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+//
+// Payload compression
+//
+
+// When payload compression is enabled (see Config.PayloadCompression), every
+// handshake payload starts with a byte indicating if the rest of the payload
+// is raw (payloadRaw) or deflated (payloadDeflated). The payload is
+// compressed before being encrypted, and decompressed after being decrypted.
+//
+// Compressing a payload before encrypting it leaks information about its
+// content through the length of the ciphertext. If the payload contains both
+// a secret and data an attacker can influence, the attacker can recover the
+// secret by observing the length of many messages (this is the CRIME attack
+// against TLS). For this reason only the payloads written with
+// writeCompressedMessage are compressed: it must only be used with payloads
+// that are entirely public (like certificates) or entirely secret.
+const (
+	payloadRaw      = 0
+	payloadDeflated = 1
+)
+
+var errInvalidCompressedPayload = errors.New("noise: invalid compressed payload")
+
+// encodePayload prefixes the payload with its encoding, and deflates it if
+// compress is true
+func encodePayload(payload []byte, compress bool) ([]byte, error) {
+	if !compress {
+		return append([]byte{payloadRaw}, payload...), nil
+	}
+	buffer := bytes.NewBuffer([]byte{payloadDeflated})
+	w, err := flate.NewWriter(buffer, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodePayload reverses encodePayload. A decompressed payload cannot be
+// longer than NoiseMaxPlaintextSize.
+func decodePayload(encoded []byte) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, errInvalidCompressedPayload
+	}
+	switch encoded[0] {
+	case payloadRaw:
+		return encoded[1:], nil
+	case payloadDeflated:
+		r := flate.NewReader(bytes.NewReader(encoded[1:]))
+		defer r.Close()
+		payload, err := io.ReadAll(io.LimitReader(r, NoiseMaxPlaintextSize+1))
+		if err != nil || len(payload) > NoiseMaxPlaintextSize {
+			return nil, errInvalidCompressedPayload
+		}
+		return payload, nil
+	default:
+		return nil, errInvalidCompressedPayload
+	}
+}
@@ -0,0 +1,84 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("a compressible certificate "), 100)
+	var sizes [2]int
+	for idx, compress := range []bool{false, true} {
+		initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), PayloadCompression: true}, true)
+		responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), PayloadCompression: true}, false)
+		var message, received []byte
+		var err error
+		if compress {
+			_, _, err = initiator.writeCompressedMessage(payload, &message)
+		} else {
+			_, _, err = initiator.writeMessage(payload, &message)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = responder.readMessage(message, &received); err != nil || !bytes.Equal(received, payload) {
+			t.Fatal("the payload did not round trip", compress, err)
+		}
+		sizes[idx] = len(message)
+	}
+	if sizes[1] >= sizes[0]/4 {
+		t.Fatal("the compressed message should be smaller", sizes)
+	}
+
+	// compression must be enabled
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	var message []byte
+	if _, _, err := initiator.writeCompressedMessage(payload, &message); err == nil {
+		t.Fatal("writeCompressedMessage should fail when compression is not enabled")
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	for _, encoded := range [][]byte{nil, {2}, {payloadDeflated, 0xff, 0xff}} {
+		if _, err := decodePayload(encoded); err == nil {
+			t.Fatal("an invalid payload should be rejected", encoded)
+		}
+	}
+	// a payload decompressing to more than a Noise message is rejected
+	bomb, _ := encodePayload(make([]byte, NoiseMaxPlaintextSize+1), true)
+	if _, err := decodePayload(bomb); err == nil {
+		t.Fatal("a payload too long once decompressed should be rejected")
+	}
+}
+
+func TestPayloadCompressionSizes(t *testing.T) {
+	initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), PayloadCompression: true}, true)
+	responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), PayloadCompression: true}, false)
+	payload := []byte("hello")
+
+	// the prefix of the payload is counted
+	size := initiator.NextMessageSize(len(payload))
+	if size != MessageSize(Noise_XX, 0, len(payload))+1 {
+		t.Fatal("unexpected size of the message", size)
+	}
+	if _, _, _, err := initiator.writeMessageInto(make([]byte, size-1), payload); err != ErrBufferTooSmall {
+		t.Fatal("a buffer too small should return ErrBufferTooSmall", err)
+	}
+	dst := make([]byte, size)
+	n, _, _, err := initiator.writeMessageInto(dst, payload)
+	if err != nil || n != size {
+		t.Fatal("cannot write the message into a buffer of the exact size", n, err)
+	}
+
+	// the length of a payload that might be deflated is not known
+	if _, err = responder.PayloadLen(dst); err != errPayloadCompressed {
+		t.Fatal("PayloadLen should fail with payload compression", err)
+	}
+	var received []byte
+	if _, _, err = responder.readMessageStrict(dst, len(payload), &received); err != errPayloadCompressed {
+		t.Fatal("readMessageStrict should fail with payload compression", err)
+	}
+	if _, _, err = responder.readMessage(dst, &received); err != nil || !bytes.Equal(received, payload) {
+		t.Fatal("the message should still be readable", err)
+	}
+}
@@ -1,6 +1,8 @@
 package noise
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"io"
 	"net"
@@ -31,8 +33,33 @@ type Conn struct {
 	// half duplex
 	isHalfDuplex   bool
 	halfDuplexLock sync.Mutex
+
+	// close notify
+	closeNotifySent     bool
+	closeNotifyReceived bool
+
+	// set by Close
+	closed bool
+
+	// renegotiation, see renegotiate.go
+	renegotiation *handshakeState
+	pendingIn     *cipherState
+
+	// data queued by QueueWrite, see pending.go
+	pendingWrites  []byte
+	pendingFlushed bool
+	pendingLock    sync.Mutex
 }
 
+// ErrUnexpectedClose is returned by Read when the underlying connection is
+// closed before the peer has sent a close notify (see CloseNotify). This can
+// indicate a truncation attack.
+var ErrUnexpectedClose = errors.New("noise: connection closed without a close notify")
+
+// ErrPinMismatch is returned by Handshake when the remote peer did not
+// authenticate with the static public key set in Config.ExpectedRemoteStatic.
+var ErrPinMismatch = errors.New("noise: the remote static key does not match the expected one")
+
 // Access to net.Conn methods.
 // Cannot just embed net.Conn because that would
 // export the struct field too.
@@ -89,9 +116,20 @@ func (c *Conn) Write(b []byte) (int, error) {
 		defer c.outLock.Unlock()
 	}
 
+	if c.closed {
+		return 0, ErrSessionClosed
+	}
+	if c.closeNotifySent {
+		return 0, errors.New("noise: cannot write after CloseNotify")
+	}
+	return c.writeRecords(b)
+}
+
+// writeRecords encrypts data in as many transport messages as needed and
+// sends them. The caller must hold the lock of the write socket.
+func (c *Conn) writeRecords(data []byte) (int, error) {
 	// process the data in a loop
 	var n int
-	data := b
 	for len(data) > 0 {
 
 		// fragment the data
@@ -106,12 +144,8 @@ func (c *Conn) Write(b []byte) (int, error) {
 			return n, err
 		}
 
-		// header (length)
-		length := []byte{byte(len(ciphertext) >> 8), byte(len(ciphertext) % 256)}
-
 		// Send data
-		_, err = c.conn.Write(append(length, ciphertext...))
-		if err != nil {
+		if err = WriteFrame(c.conn, ciphertext); err != nil {
 			return n, err
 		}
 		/*
@@ -157,63 +191,144 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		defer c.inLock.Unlock()
 	}
 
-	// read whatever there is to read in the buffer
-	readSoFar := 0
-	if len(c.inputBuffer) > 0 {
-		copy(b, c.inputBuffer)
-		if len(c.inputBuffer) >= len(b) {
-			c.inputBuffer = c.inputBuffer[len(b):]
-			return len(b), nil
-		}
-		readSoFar += len(c.inputBuffer)
-		c.inputBuffer = c.inputBuffer[:0]
+	if c.closed {
+		return 0, ErrSessionClosed
 	}
 
-	// read header from socket
-	bufHeader, err := readFromUntil(c.conn, 2)
-	if err != nil {
-		return 0, err
-	}
-	length := (int(bufHeader[0]) << 8) | int(bufHeader[1])
-	if length > NoiseMessageLength {
-		return 2, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
+	// read whatever there is to read in the buffer, without waiting for
+	// more data (it might have been buffered during a renegotiation)
+	if len(c.inputBuffer) > 0 {
+		n = copy(b, c.inputBuffer)
+		c.inputBuffer = c.inputBuffer[n:]
+		return n, nil
 	}
 
-	// read noise message from socket
-	noiseMessage, err := readFromUntil(c.conn, length)
-	if err != nil {
-		return 2, err
+	// the peer has cleanly closed the connection
+	if c.closeNotifyReceived {
+		return 0, io.EOF
 	}
 
-	// decrypt
-	plaintext, err := c.in.decryptWithAd([]byte{}, noiseMessage)
-	if err != nil {
-		return 2 + length, err
-	}
+	// read noise messages from socket until one carries application data
+	var plaintext []byte
+	for {
+		noiseMessage, err := ReadFrame(c.conn)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrUnexpectedClose
+			}
+			return 0, err
+		}
+		if len(noiseMessage) > NoiseMessageLength {
+			return 0, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
+		}
 
-	// append to the input buffer
-	c.inputBuffer = append(c.inputBuffer, plaintext...)
+		// decrypt
+		var renegotiation bool
+		plaintext, renegotiation, err = c.decryptRecord(noiseMessage)
+		if err != nil {
+			return 0, err
+		}
+		if !renegotiation {
+			break
+		}
+		// the reply to the handshake of the peer is written here
+		if !c.isHalfDuplex {
+			c.outLock.Lock()
+		}
+		err = c.handleRenegotiationRecord(plaintext)
+		if !c.isHalfDuplex {
+			c.outLock.Unlock()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
 
-	// read whatever we can read
-	rest := len(b) - readSoFar
-	copy(b[readSoFar:], c.inputBuffer)
-	if len(c.inputBuffer) >= rest {
-		c.inputBuffer = c.inputBuffer[rest:]
-		return len(b), nil
+	// Write never sends empty records, an empty record is a close notify
+	if len(plaintext) == 0 {
+		c.closeNotifyReceived = true
+		return 0, io.EOF
 	}
 
-	// we haven't filled the buffer
-	readSoFar += len(c.inputBuffer)
-	c.inputBuffer = c.inputBuffer[:0]
-	return readSoFar, nil
+	// read whatever we can read, and keep the rest in the input buffer
+	n = copy(b, plaintext)
+	c.inputBuffer = append(c.inputBuffer, plaintext[n:]...)
+	return n, nil
 
 	// TODO: should we continue to try and read other messages?
 
 }
 
-// Close closes the connection.
+// Close closes the connection. The transport keys and the decrypted data
+// that has not been read yet are erased, and Read and Write then return
+// ErrSessionClosed.
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	// closing the connection first unblocks a pending Read or Write
+	err := c.conn.Close()
+
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		// in the same order as Read and Renegotiate
+		c.inLock.Lock()
+		defer c.inLock.Unlock()
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	c.closed = true
+	buffer := c.inputBuffer[:cap(c.inputBuffer)]
+	for i := range buffer {
+		buffer[i] = 0
+	}
+	c.inputBuffer = nil
+	c.in.clear()
+	c.out.clear()
+	c.pendingIn.clear()
+	if c.renegotiation != nil {
+		c.renegotiation.clear()
+	}
+	return err
+}
+
+// CloseNotify sends an authenticated empty record to signal the end of the
+// stream, like TLS' close_notify alert. After receiving it, the peer's Read
+// returns io.EOF, while a connection closed without it makes Read return
+// ErrUnexpectedClose. No more data can be written after a call to CloseNotify,
+// but the connection can still be read from and must still be closed.
+func (c *Conn) CloseNotify() error {
+	if hp := c.config.HandshakePattern; !c.isClient && (hp == Noise_N || hp == Noise_K || hp == Noise_X) {
+		return errors.New("noise: a server cannot write on one-way patterns")
+	}
+
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+
+	if c.closeNotifySent {
+		return nil
+	}
+
+	ciphertext, err := c.out.encryptWithAd([]byte{}, []byte{})
+	if err != nil {
+		return err
+	}
+	if err = WriteFrame(c.conn, ciphertext); err != nil {
+		return err
+	}
+
+	c.closeNotifySent = true
+	return nil
 }
 
 //
@@ -225,6 +340,42 @@ func (c *Conn) Close() error {
 // Most uses of this package need not call Handshake explicitly:
 // the first Read or Write will call it automatically.
 func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the client or server handshake protocol if it has
+// not yet been run, like Handshake. If the context is canceled or expires
+// before the handshake is complete, the handshake is interrupted, the
+// underlying connection is closed and the error of the context is returned.
+func (c *Conn) HandshakeContext(ctx context.Context) (err error) {
+	if ctx.Done() == nil {
+		return c.handshake()
+	}
+
+	// interrupt the handshake by closing the connection (as in crypto/tls)
+	done := make(chan struct{})
+	interruptRes := make(chan error, 1)
+	defer func() {
+		close(done)
+		if ctxErr := <-interruptRes; ctxErr != nil {
+			err = ctxErr
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+			interruptRes <- ctx.Err()
+		case <-done:
+			interruptRes <- nil
+		}
+	}()
+
+	return c.handshake()
+}
+
+// handshake implements Handshake
+func (c *Conn) handshake() (err error) {
 
 	// Locking the handshakeMutex
 	c.handshakeMutex.Lock()
@@ -235,26 +386,40 @@ func (c *Conn) Handshake() error {
 		return nil
 	}
 
-	// Noise.initialize(handshakePattern string, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState)
-	var remoteKeyPair *KeyPair
-	if c.config.RemoteKey != nil {
-		if len(c.config.RemoteKey) != 32 {
-			return errors.New("noise: the provided remote key is not 32-byte")
+	// report the outcome to the observability hooks, if any
+	start := time.Now()
+	messageIndex := 0
+	if c.config.OnHandshakeStart != nil {
+		c.config.OnHandshakeStart()
+	}
+	defer func() {
+		if err != nil && c.config.OnHandshakeError != nil {
+			c.config.OnHandshakeError(err, messageIndex)
+		} else if err == nil && c.config.OnHandshakeComplete != nil {
+			c.config.OnHandshakeComplete(time.Since(start), patterns[c.config.HandshakePattern].name)
 		}
-		remoteKeyPair = &KeyPair{}
-		copy(remoteKeyPair.PublicKey[:], c.config.RemoteKey)
+	}()
+
+	// initialize the handshakeState from the configuration
+	newHs, err := NewHandshake(c.config, c.isClient)
+	if err != nil {
+		return err
 	}
-	c.hs = initialize(c.config.HandshakePattern, c.isClient, c.config.Prologue, c.config.KeyPair, nil, remoteKeyPair, nil)
+	c.hs = *newHs
 	hs := &c.hs
 
-	// pre-shared key
-	hs.psk = c.config.PreSharedKey
-
 	// start handshake
 	var c1, c2 *cipherState
-	var err error
 	var receivedPayload []byte
+	// kept to be sent again if the server replies with a retry (see cookie.go)
+	var firstMessage []byte
+	interactive := len(hs.messagePatterns) > 1
+	// the messages carrying the certificates (see certificate.go)
+	staticKeyMessage := patterns[hs.handshakeType].staticKeyMessage(c.isClient)
+	remoteStaticKeyMessage := patterns[hs.handshakeType].staticKeyMessage(!c.isClient)
 ContinueHandshake:
+	processed := len(patterns[hs.handshakeType].messagePatterns) - len(hs.messagePatterns)
+	messageIndex = processed
 	if hs.shouldWrite {
 		// we're writing the next message pattern
 		// if it's the message pattern and we're sending a static key, we also send a proof
@@ -264,58 +429,74 @@ ContinueHandshake:
 		if len(hs.messagePatterns) <= 2 {
 			proof = c.config.StaticPublicKeyProof
 		}
-		c1, c2, err = hs.writeMessage(proof, &bufToWrite)
+		if processed == staticKeyMessage && c.config.certificate != nil {
+			proof = EncodeFields(c.config.certificate, proof)
+		}
+		// application data is not compressed, see compression.go
+		var early []byte
+		if c.config.PiggybackWrites {
+			early = c.takePendingWrites(hs, proof)
+			proof = EncodeFields(proof, early)
+		}
+		if c.config.PayloadCompression && len(early) == 0 {
+			c1, c2, err = hs.writeCompressedMessage(proof, &bufToWrite)
+		} else {
+			c1, c2, err = hs.writeMessage(proof, &bufToWrite)
+		}
 		if err != nil {
 			return err
 		}
-		// header (length)
-		length := []byte{byte(len(bufToWrite) >> 8), byte(len(bufToWrite) % 256)}
-		// write
-		_, err = c.conn.Write(append(length, bufToWrite...))
-		if err != nil {
+		if processed == 0 {
+			firstMessage = bufToWrite
+		}
+		if err = WriteFrame(c.conn, bufToWrite); err != nil {
 			return err
 		}
 
 	} else {
 		// we're reading the next message pattern, as well as reacting to any received data
-		bufHeader, err := readFromUntil(c.conn, 2) // length header
-		if err != nil {
-			return err
+		var noiseMessage []byte
+		switch {
+		case !c.isClient && processed == 0 && interactive:
+			noiseMessage, err = c.serverReadFirstMessage()
+		case c.isClient && processed == 1:
+			noiseMessage, err = c.clientReadSecondMessage(firstMessage)
+		default:
+			noiseMessage, err = readHandshakeMessage(c.conn)
 		}
-		length := (int(bufHeader[0]) << 8) | int(bufHeader[1])
-		if length > NoiseMessageLength {
-			return errors.New("Noise: Noise message received exceeds NoiseMessageLength")
-		}
-		noiseMessage, err := readFromUntil(c.conn, length) // noise message
 		if err != nil {
 			return err
 		}
 
+		start := len(receivedPayload)
 		c1, c2, err = hs.readMessage(noiseMessage, &receivedPayload)
 		if err != nil {
 			return err
 		}
+		if c.config.PiggybackWrites {
+			var payload []byte
+			if payload, err = c.receivePiggybackedWrites(receivedPayload[start:]); err != nil {
+				return err
+			}
+			receivedPayload = append(receivedPayload[:start], payload...)
+		}
+		if processed == remoteStaticKeyMessage && c.config.VerifyPeerCertificate != nil {
+			if receivedPayload, err = c.verifyPeerCertificate(receivedPayload); err != nil {
+				return err
+			}
+		}
 		// TODO: do something with receivedPayload
 	}
 
 	// handshake not finished
-	if c1 == nil {
+	if !hs.IsHandshakeComplete() {
 		goto ContinueHandshake
 	}
 
-	// setup the Write and Read secure channels
-	if c1 == nil {
-		return errors.New("noise: the handshake did not return a secure channel to Write and Read from")
-	}
-
 	// Has the other peer been authenticated so far?
 	if !c.isRemoteAuthenticated && c.config.PublicKeyVerifier != nil {
 		// test if remote static key is empty
-		isRemoteStaticKeySet := byte(0)
-		for _, val := range hs.rs.PublicKey {
-			isRemoteStaticKeySet |= val
-		}
-		if isRemoteStaticKeySet != 0 {
+		if !hs.rs.isEmpty() {
 			// a remote static key has been received. Verify it
 			if !c.config.PublicKeyVerifier(hs.rs.PublicKey[:], receivedPayload) {
 				return errors.New("Noise: the received public key could not be authenticated")
@@ -323,6 +504,13 @@ ContinueHandshake:
 		}
 	}
 
+	// Is the remote static key the one expected?
+	if c.config.ExpectedRemoteStatic != [32]byte{} {
+		if subtle.ConstantTimeCompare(hs.rs.PublicKey[:], c.config.ExpectedRemoteStatic[:]) != 1 {
+			return ErrPinMismatch
+		}
+	}
+
 	// Processing the final handshake message returns two CipherState objects
 	// the first for encrypting transport messages from initiator to responder
 	// and the second for messages in the other direction.
@@ -343,7 +531,7 @@ ContinueHandshake:
 	c.hs.clear()
 	// no errors :)
 	c.handshakeComplete = true
-	return nil
+	return c.flushPendingWrites()
 }
 
 // IsRemoteAuthenticated can be used to check if the remote peer has been properly authenticated. It serves no real purpose for the moment as the handshake will not go through if a peer is not properly authenticated in patterns where the peer needs to be authenticated.
@@ -360,26 +548,6 @@ func (c *Conn) StaticKey() ([]byte, error) {
 	return c.hs.rs.PublicKey[:], nil
 }
 
-//
-// input/output functions
-//
-
-func readFromUntil(r io.Reader, n int) ([]byte, error) {
-	result := make([]byte, n)
-	offset := 0
-	for {
-		m, err := r.Read(result[offset:])
-		if err != nil {
-			return result, err
-		}
-		offset += m
-		if offset == n {
-			break
-		}
-	}
-	return result, nil
-}
-
 /*
 TODO: Do we need such a function? (this comes from go.TLS)
 // ConnectionState returns basic Noise details about the connection.
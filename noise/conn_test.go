@@ -2,7 +2,14 @@ package noise
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TODO: add more tests from tls/conn_test.go
@@ -23,114 +30,341 @@ func TestSeveralWriteRoutines(t *testing.T) {
 		StaticPublicKeyProof: []byte{},
 		PublicKeyVerifier:    verifier,
 	}
+	testConcurrentWrites(t, &clientConfig, &serverConfig)
+}
+
+func TestHalfDuplex(t *testing.T) {
+	// init
+	clientConfig := Config{
+		KeyPair:              GenerateKeypair(nil),
+		HandshakePattern:     Noise_XX,
+		StaticPublicKeyProof: []byte{},
+		PublicKeyVerifier:    verifier,
+		HalfDuplex:           true,
+	}
+	serverConfig := Config{
+		KeyPair:              GenerateKeypair(nil),
+		HandshakePattern:     Noise_XX,
+		StaticPublicKeyProof: []byte{},
+		PublicKeyVerifier:    verifier,
+		HalfDuplex:           true,
+	}
+	testConcurrentWrites(t, &clientConfig, &serverConfig)
+}
 
+// testConcurrentWrites has a client write 100 messages from as many
+// goroutines, and waits for the server to read all of them. The sockets and
+// the server goroutine do not outlive the test.
+func testConcurrentWrites(t *testing.T, clientConfig, serverConfig *Config) {
 	// get a Noise.listener
-	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig) // port 0 will find out a free port
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig) // port 0 will find out a free port
 	if err != nil {
 		t.Fatal("cannot setup a listener on localhost:", err)
 	}
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	done := make(chan struct{})
+	defer func() {
+		listener.Close()
+		<-done
+	}()
 	go func() {
+		defer close(done)
 		serverSocket, err2 := listener.Accept()
 		if err2 != nil {
-			t.Fatal("a server cannot accept()")
+			t.Error("a server cannot accept()")
+			return
 		}
+		defer serverSocket.Close()
 
 		var buf [100]byte
 
-		for {
+		for received := 0; received < 100; received++ {
 			n, err2 := serverSocket.Read(buf[:])
 			if err2 != nil {
-				t.Fatal("server can't read on socket")
+				t.Error("server can't read on socket", err2)
+				return
 			}
 			if !bytes.Equal(buf[:n-1], []byte("hello ")) {
-				t.Fatal("received message not as expected")
+				t.Error("received message not as expected")
+				return
 			}
-
-			//fmt.Println("server received:", string(buf[:n]))
 		}
-
 	}()
 
 	// Run the client
-	clientSocket, err := Dial("tcp", addr, &clientConfig)
+	clientSocket, err := Dial("tcp", addr, clientConfig)
 	if err != nil {
 		t.Fatal("client can't connect to server")
 	}
+	defer clientSocket.Close()
 
+	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
+		wg.Add(1)
 		go func(i int) {
-			message := "hello " + string(i)
-			_, err = clientSocket.Write([]byte(message))
-			if err != nil {
-				t.Fatal("client can't write on socket")
+			defer wg.Done()
+			message := "hello " + string(rune(i))
+			if _, err := clientSocket.Write([]byte(message)); err != nil {
+				t.Error("client can't write on socket", err)
 			}
 		}(i)
 	}
+	wg.Wait()
+
+	// the client socket is only closed once the server has read everything
+	<-done
 }
 
-func TestHalfDuplex(t *testing.T) {
-	// init
+func TestCloseNotify(t *testing.T) {
+	for _, clean := range []bool{true, false} {
+		clientConfig := Config{
+			KeyPair:           GenerateKeypair(nil),
+			HandshakePattern:  Noise_XX,
+			PublicKeyVerifier: verifier,
+		}
+		serverConfig := Config{
+			KeyPair:           GenerateKeypair(nil),
+			HandshakePattern:  Noise_XX,
+			PublicKeyVerifier: verifier,
+		}
+		clientPipe, serverPipe := net.Pipe()
+		client := Client(clientPipe, &clientConfig)
+		server := Server(serverPipe, &serverConfig)
+
+		errc := make(chan error, 1)
+		go func() {
+			if _, err := client.Write([]byte("hello")); err != nil {
+				errc <- err
+				return
+			}
+			if clean {
+				if err := client.CloseNotify(); err != nil {
+					errc <- err
+					return
+				}
+				if _, err := client.Write([]byte("hello")); err == nil {
+					errc <- errors.New("writing after CloseNotify should fail")
+					return
+				}
+			}
+			errc <- client.Close()
+		}()
+
+		var buf [100]byte
+		n, err := server.Read(buf[:])
+		if err != nil || !bytes.Equal(buf[:n], []byte("hello")) {
+			t.Fatal("server did not receive the expected message", err)
+		}
+		_, err = server.Read(buf[:])
+		if clean && err != io.EOF {
+			t.Fatal("a close notify should be reported as io.EOF", err)
+		}
+		if !clean && err != ErrUnexpectedClose {
+			t.Fatal("a truncated connection should be reported as ErrUnexpectedClose", err)
+		}
+		if err = <-errc; err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+	}
+}
+
+func TestHandshakeContext(t *testing.T) {
 	clientConfig := Config{
-		KeyPair:              GenerateKeypair(nil),
-		HandshakePattern:     Noise_XX,
-		StaticPublicKeyProof: []byte{},
-		PublicKeyVerifier:    verifier,
-		HalfDuplex:           true,
+		KeyPair:           GenerateKeypair(nil),
+		HandshakePattern:  Noise_XX,
+		PublicKeyVerifier: verifier,
 	}
-	serverConfig := Config{
-		KeyPair:              GenerateKeypair(nil),
-		HandshakePattern:     Noise_XX,
-		StaticPublicKeyProof: []byte{},
-		PublicKeyVerifier:    verifier,
-		HalfDuplex:           true,
+
+	// the other side never answers
+	clientPipe, serverPipe := net.Pipe()
+	defer serverPipe.Close()
+	client := Client(clientPipe, &clientConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if err := client.HandshakeContext(ctx); err != context.Canceled {
+		t.Fatal("a canceled handshake should return the error of the context", err)
 	}
 
-	// get a Noise.listener
-	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig)
+	// same thing with DialContext
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal("cannot setup a listener on localhost:", err)
 	}
-	addr := listener.Addr().String()
-
-	// run the server and Accept one connection
+	defer listener.Close()
 	go func() {
-		serverSocket, err2 := listener.Accept()
-		if err2 != nil {
-			t.Fatal("a server cannot accept()")
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
 		}
+	}()
+	clientConfig.StaticPublicKeyProof = []byte{}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = DialContext(ctx, "tcp", listener.Addr().String(), &clientConfig); err != context.DeadlineExceeded {
+		t.Fatal("an expired handshake should return the error of the context", err)
+	}
+}
 
-		var buf [100]byte
-
-		for {
-			n, err2 := serverSocket.Read(buf[:])
-			if err2 != nil {
-				t.Fatal("server can't read on socket")
-			}
-			if !bytes.Equal(buf[:n-1], []byte("hello ")) {
-				t.Fatal("received message not as expected")
-			}
+func TestExpectedRemoteStatic(t *testing.T) {
+	serverKey := GenerateKeypair(nil)
+	for _, pin := range [][32]byte{serverKey.PublicKey, GenerateKeypair(nil).PublicKey} {
+		clientConfig := Config{
+			KeyPair:              GenerateKeypair(nil),
+			HandshakePattern:     Noise_XX,
+			PublicKeyVerifier:    verifier,
+			ExpectedRemoteStatic: pin,
+		}
+		serverConfig := Config{
+			KeyPair:           serverKey,
+			HandshakePattern:  Noise_XX,
+			PublicKeyVerifier: verifier,
+		}
+		clientPipe, serverPipe := net.Pipe()
+		client := Client(clientPipe, &clientConfig)
+		server := Server(serverPipe, &serverConfig)
+		go server.Handshake()
 
-			//fmt.Println("server received:", string(buf[:n]))
+		err := client.Handshake()
+		if pin == serverKey.PublicKey && err != nil {
+			t.Fatal("the pinned key should be accepted", err)
+		}
+		if pin != serverKey.PublicKey && err != ErrPinMismatch {
+			t.Fatal("a different key should be rejected", err)
 		}
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
 
-	}()
+func TestConnClose(t *testing.T) {
+	clientConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier}
+	serverConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier}
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(clientPipe, &clientConfig)
+	server := Server(serverPipe, &serverConfig)
+	go client.Write([]byte("secret data"))
 
-	// Run the client
-	clientSocket, err := Dial("tcp", addr, &clientConfig)
-	if err != nil {
-		t.Fatal("client can't connect to server")
+	// only read part of the message, the rest is kept decrypted by the server
+	var buf [3]byte
+	if _, err := server.Read(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	buffered := server.inputBuffer[:cap(server.inputBuffer)]
+	if !bytes.Contains(buffered, []byte("ret data")) {
+		t.Fatal("the rest of the message should be buffered")
 	}
 
-	for i := 0; i < 100; i++ {
-		go func(i int) {
-			message := "hello " + string(i)
-			_, err = clientSocket.Write([]byte(message))
-			if err != nil {
-				t.Fatal("client can't write on socket")
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffered, make([]byte, len(buffered))) {
+		t.Fatal("the decrypted data should be erased")
+	}
+	if server.in.k != [32]byte{} || server.out.k != [32]byte{} {
+		t.Fatal("the transport keys should be erased")
+	}
+	if _, err := server.Read(buf[:]); err != ErrSessionClosed {
+		t.Fatal("reading after Close should return ErrSessionClosed", err)
+	}
+	if _, err := server.Write([]byte("hello")); err != ErrSessionClosed {
+		t.Fatal("writing after Close should return ErrSessionClosed", err)
+	}
+	client.Close()
+}
+
+func TestHandshakeHooks(t *testing.T) {
+	for _, prologue := range []string{"same", "different"} {
+		var started, completed int
+		var duration time.Duration
+		var pattern string
+		var handshakeErr error
+		messageIndex := -1
+		clientConfig := Config{
+			KeyPair:             GenerateKeypair(nil),
+			HandshakePattern:    Noise_XX,
+			PublicKeyVerifier:   verifier,
+			Prologue:            []byte(prologue),
+			OnHandshakeStart:    func() { started++ },
+			OnHandshakeComplete: func(d time.Duration, p string) { completed, duration, pattern = completed+1, d, p },
+			OnHandshakeError:    func(err error, idx int) { handshakeErr, messageIndex = err, idx },
+		}
+		serverConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier, Prologue: []byte("same")}
+		clientPipe, serverPipe := net.Pipe()
+		client := Client(clientPipe, &clientConfig)
+		go Server(serverPipe, &serverConfig).Handshake()
+
+		err := client.Handshake()
+		if err == nil {
+			client.Handshake() // already completed: no new events
+		}
+		if started != 1 {
+			t.Fatal("OnHandshakeStart should be called once", started)
+		}
+		if prologue == "same" {
+			if err != nil || completed != 1 || pattern != "XX" || duration <= 0 || handshakeErr != nil {
+				t.Fatal("unexpected events for a successful handshake", err, completed, pattern, duration, handshakeErr)
 			}
-		}(i)
+		} else if err == nil || handshakeErr != err || messageIndex != 1 || completed != 0 {
+			// the client detects the different prologue when decrypting the second message
+			t.Fatal("unexpected events for a failed handshake", err, handshakeErr, messageIndex, completed)
+		}
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
+
+func TestPendingWrites(t *testing.T) {
+	clientConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier, PiggybackWrites: true}
+	serverConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier, PiggybackWrites: true}
+	clientPipe, serverPipe := net.Pipe()
+	defer clientPipe.Close()
+	defer serverPipe.Close()
+	client, server := Client(clientPipe, &clientConfig), Server(serverPipe, &serverConfig)
+
+	client.QueueWrite([]byte("early "))
+	client.QueueWrite([]byte("data"))
+	// the second message of XX is not safe: this is sent after the handshake
+	server.QueueWrite([]byte("reply"))
+	if client.PendingWrites() != len("early data") {
+		t.Fatal("the data should be queued", client.PendingWrites())
+	}
+
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if client.PendingWrites() != 0 {
+		t.Fatal("the queued data should have been sent")
+	}
+	buffer := make([]byte, 100)
+	n, err := client.Read(buffer)
+	if err != nil || string(buffer[:n]) != "reply" {
+		t.Fatal("the data queued by the server was not received", err)
+	}
+	if err = <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+
+	// the data of the client was received in the last handshake message
+	if string(server.inputBuffer) != "early data" {
+		t.Fatal("the queued data did not ride on the handshake", string(server.inputBuffer))
+	}
+	if n, err = server.Read(buffer); err != nil || string(buffer[:n]) != "early data" {
+		t.Fatal("the queued data cannot be read", err)
+	}
+
+	// once the handshake is completed, QueueWrite writes directly
+	go client.QueueWrite([]byte("late"))
+	if n, err = server.Read(buffer); err != nil || string(buffer[:n]) != "late" {
+		t.Fatal("the data was not written", err)
 	}
 }
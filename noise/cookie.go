@@ -0,0 +1,145 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+//
+// Cookies
+//
+// A server that sets Config.CookieSecret does not process the first
+// handshake message of a client right away. It replies with a retry instead:
+// an empty frame followed by a frame containing a cookie. A cookie is a MAC,
+// computed with the secret of the server, over the address of the client and
+// the current time window. The client then sends an empty frame, the cookie
+// and its first handshake message again, proving that it can receive
+// messages at its address before the server does any expensive operation.
+// The server keeps no state between the two: the cookie is only recomputed
+// and compared.
+//
+// As an empty frame is never a valid handshake message, a client knows if
+// it received a retry or the next handshake message.
+//
+
+const (
+	cookieLen = 16
+	// cookies are valid during the window they were created in, and during
+	// the following one
+	cookieWindow = 2 * time.Minute
+)
+
+// ErrInvalidCookie is returned by the handshake of a server when a client
+// sends back a cookie that the server did not create.
+var ErrInvalidCookie = errors.New("noise: invalid cookie")
+
+// now is the clock used for cookies and for the freshness of handshakes
+var now = time.Now
+
+// cookie computes the cookie of a client address for a time window
+func cookie(secret []byte, addr net.Addr, window int64) []byte {
+	var windowBytes [8]byte
+	binary.BigEndian.PutUint64(windowBytes[:], uint64(window))
+	input := append([]byte("NoiseGo cookie"), windowBytes[:]...)
+	if addr != nil {
+		input = append(input, addr.String()...)
+	}
+	return hmacHash(secret, input)[:cookieLen]
+}
+
+// validCookie returns true if received is the cookie of the address for the
+// current or the previous time window
+func validCookie(secret []byte, addr net.Addr, received []byte) bool {
+	window := now().UnixNano() / int64(cookieWindow)
+	valid := false
+	for _, w := range []int64{window, window - 1} {
+		if hmac.Equal(received, cookie(secret, addr, w)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// readHandshakeMessage reads a framed handshake message
+func readHandshakeMessage(r io.Reader) ([]byte, error) {
+	message, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > NoiseMessageLength {
+		return nil, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
+	}
+	return message, nil
+}
+
+// writeHandshakeMessages writes framed handshake messages at once
+func writeHandshakeMessages(w io.Writer, messages ...[]byte) error {
+	var buf bytes.Buffer
+	for _, message := range messages {
+		if err := WriteFrame(&buf, message); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// serverReadFirstMessage reads the first handshake message of a client, and
+// goes through the retry if cookies are enabled.
+func (c *Conn) serverReadFirstMessage() ([]byte, error) {
+	message, err := readHandshakeMessage(c.conn)
+	if err != nil || c.config.CookieSecret == nil {
+		return message, err
+	}
+	if len(message) != 0 {
+		// send a retry with a cookie
+		window := now().UnixNano() / int64(cookieWindow)
+		if err = writeHandshakeMessages(c.conn, nil, cookie(c.config.CookieSecret, c.conn.RemoteAddr(), window)); err != nil {
+			return nil, err
+		}
+		if message, err = readHandshakeMessage(c.conn); err != nil {
+			return nil, err
+		}
+		if len(message) != 0 {
+			return nil, errors.New("noise: the client did not answer the retry")
+		}
+	}
+	received, err := readHandshakeMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if !validCookie(c.config.CookieSecret, c.conn.RemoteAddr(), received) {
+		return nil, ErrInvalidCookie
+	}
+	return readHandshakeMessage(c.conn)
+}
+
+// clientReadSecondMessage reads the second handshake message, and answers a
+// retry of the server by sending back the cookie and the first handshake
+// message.
+func (c *Conn) clientReadSecondMessage(firstMessage []byte) ([]byte, error) {
+	message, err := readHandshakeMessage(c.conn)
+	if err != nil || len(message) != 0 {
+		return message, err
+	}
+	received, err := readHandshakeMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(received) != cookieLen {
+		return nil, errors.New("noise: the server sent an invalid retry")
+	}
+	if err = writeHandshakeMessages(c.conn, nil, received, firstMessage); err != nil {
+		return nil, err
+	}
+	message, err = readHandshakeMessage(c.conn)
+	if err == nil && len(message) == 0 {
+		return nil, errors.New("noise: the server sent a second retry")
+	}
+	return message, err
+}
@@ -0,0 +1,72 @@
+package noise
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookies(t *testing.T) {
+	serverConfig := Config{
+		KeyPair:           GenerateKeypair(nil),
+		HandshakePattern:  Noise_XX,
+		PublicKeyVerifier: verifier,
+		CookieSecret:      []byte("server secret"),
+	}
+	clientConfig := Config{
+		KeyPair:           GenerateKeypair(nil),
+		HandshakePattern:  Noise_XX,
+		PublicKeyVerifier: verifier,
+	}
+
+	// the client answers the retry automatically
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(clientPipe, &clientConfig)
+	server := Server(serverPipe, &serverConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal("the client did not go through the retry", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("hello"))
+	var buf [10]byte
+	if n, err := server.Read(buf[:]); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the connection does not work after the retry", err)
+	}
+	client.Close()
+	server.Close()
+
+	// a client sending back a wrong cookie is rejected
+	for _, wrongCookie := range [][]byte{make([]byte, cookieLen), nil} {
+		clientPipe, serverPipe = net.Pipe()
+		server = Server(serverPipe, &serverConfig)
+		go func() { errc <- server.Handshake() }()
+
+		h := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		var firstMessage []byte
+		h.writeMessage(nil, &firstMessage)
+		if err := writeHandshakeMessages(clientPipe, firstMessage); err != nil {
+			t.Fatal(err)
+		}
+		retry, _ := readHandshakeMessage(clientPipe)
+		cookie, _ := readHandshakeMessage(clientPipe)
+		if len(retry) != 0 || len(cookie) != cookieLen {
+			t.Fatal("the server did not send a retry")
+		}
+		if wrongCookie == nil {
+			// a valid cookie that has expired
+			defer func(clock func() time.Time) { now = clock }(now)
+			now = func() time.Time { return time.Now().Add(2 * cookieWindow) }
+			wrongCookie = cookie
+		}
+		go writeHandshakeMessages(clientPipe, nil, wrongCookie, firstMessage)
+		if err := <-errc; err != ErrInvalidCookie {
+			t.Fatal("a wrong cookie should be rejected", err)
+		}
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
@@ -2,15 +2,21 @@ package noise
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"math"
+	"sync"
 
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/curve25519"
 )
 
 //
@@ -35,21 +41,174 @@ type KeyPair struct {
 	PublicKey  [32]byte
 }
 
+// randReader is the source of randomness used to generate key pairs
+var randReader io.Reader = rand.Reader
+
 // GenerateKeypair creates a X25519 static keyPair out of a private key. If privateKey is nil the function generates a random key pair.
+// It panics if the random number generator fails, see GenerateKeypairErr for a version returning an error instead.
 func GenerateKeypair(privateKey *[32]byte) *KeyPair {
+	keyPair, err := GenerateKeypairErr(privateKey)
+	if err != nil {
+		panic(err)
+	}
+	return keyPair
+}
+
+// scalarBaseMultKAT is the public key of the private key of Alice in the
+// test vectors of RFC 7748, section 6.1
+var scalarBaseMultKAT = struct{ privateKey, publicKey string }{
+	privateKey: "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+	publicKey:  "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+}
+
+var checkScalarBaseMultOnce sync.Once
+
+// checkScalarBaseMult verifies, once before the first key pair is generated,
+// that X25519 computes the public key of a known private key. It does not
+// depend on any input: a failure means that the implementation of X25519 is
+// broken (a miscompilation, or a modified dependency), and that all the
+// public keys, and the shared secrets, it would produce are wrong. There is
+// no way to recover from that, so it panics.
+func checkScalarBaseMult() {
+	privateKey, _ := hex.DecodeString(scalarBaseMultKAT.privateKey)
+	ecdhKey, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil || !matchesKAT(ecdhKey.PublicKey().Bytes(), scalarBaseMultKAT.publicKey) {
+		panic("noise: X25519 does not compute the known public key of RFC 7748, the implementation of the curve is broken")
+	}
+}
 
+// GenerateKeypairErr is similar to GenerateKeypair except that it returns an
+// error if the random number generator fails to produce a private key.
+func GenerateKeypairErr(privateKey *[32]byte) (*KeyPair, error) {
+	checkScalarBaseMultOnce.Do(checkScalarBaseMult)
+
+	if privateKey == nil {
+		return generateKeypairFrom(randReader)
+	}
 	var keyPair KeyPair
-	if privateKey != nil {
-		copy(keyPair.PrivateKey[:], privateKey[:])
-	} else {
-		if _, err := rand.Read(keyPair.PrivateKey[:]); err != nil {
-			panic(err)
+	copy(keyPair.PrivateKey[:], privateKey[:])
+
+	ecdhKey, err := ecdh.X25519().NewPrivateKey(keyPair.PrivateKey[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(keyPair.PublicKey[:], ecdhKey.PublicKey().Bytes())
+
+	return &keyPair, nil
+}
+
+// generateKeypairFrom generates a key pair whose private key is read from r.
+// It fails if r cannot produce the 32 bytes of the private key.
+func generateKeypairFrom(r io.Reader) (*KeyPair, error) {
+	var privateKey [32]byte
+	if _, err := io.ReadFull(r, privateKey[:]); err != nil {
+		return nil, errors.New("noise: cannot generate a private key: " + err.Error())
+	}
+	return GenerateKeypairErr(&privateKey)
+}
+
+// the maximum number of key pairs that can be generated in advance
+const maxPrewarmedEphemerals = 1024
+
+// ephemeralPool contains the ephemeral key pairs generated by PrewarmEphemerals
+var ephemeralPool = make(chan *KeyPair, maxPrewarmedEphemerals)
+
+// PrewarmEphemerals generates n ephemeral key pairs in the background. The
+// following handshakes will use them instead of generating a key pair inline,
+// which removes a scalar multiplication from the handshake latency. At most
+// 1024 ephemeral key pairs can be waiting to be used at any time.
+func PrewarmEphemerals(n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			keyPair, err := GenerateKeypairErr(nil)
+			if err != nil {
+				return
+			}
+			select {
+			case ephemeralPool <- keyPair:
+			default:
+				// the pool is full
+				return
+			}
 		}
+	}()
+}
+
+// newEphemeral returns a key pair generated in advance if there is one,
+// otherwise it generates a new one. If r is not nil, the key pair is always
+// generated from r.
+func newEphemeral(r io.Reader) (*KeyPair, error) {
+	if r != nil {
+		return generateKeypairFrom(r)
+	}
+	select {
+	case keyPair := <-ephemeralPool:
+		return keyPair, nil
+	default:
+		return GenerateKeypairErr(nil)
 	}
+}
 
-	curve25519.ScalarBaseMult(&keyPair.PublicKey, &keyPair.PrivateKey)
+// hedgedEphemeralLabel separates the outputs of a hedgedReader from the other
+// uses of HMAC
+var hedgedEphemeralLabel = []byte("NoiseGo hedged ephemeral")
+
+// A hedgedReader derives its output from the output of r (crypto/rand if r
+// is nil), the static private key of the peer and the handshake transcript,
+// see Config.HedgedEphemerals. Each block of 32 bytes is
+// HMAC-HASH(static private key, label || counter || transcript || random).
+type hedgedReader struct {
+	r          io.Reader
+	key        []byte
+	transcript []byte
+	counter    uint64
+}
 
-	return &keyPair
+func (h *hedgedReader) Read(p []byte) (int, error) {
+	r := h.r
+	if r == nil {
+		r = randReader
+	}
+	random := make([]byte, len(p))
+	if _, err := io.ReadFull(r, random); err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(p); {
+		data := append(append([]byte(nil), hedgedEphemeralLabel...), binary.BigEndian.AppendUint64(nil, h.counter)...)
+		data = append(append(data, h.transcript...), random...)
+		h.counter++
+		n += copy(p[n:], hmacHash(h.key, data))
+	}
+	return len(p), nil
+}
+
+// PrecomputeStaticShared computes the DH between a local static key pair and
+// the static public key of a remote peer. It is the same for every handshake
+// between the two peers, and can be set in Config.StaticShared to save the
+// DH of the ss token in patterns like KK. It returns ErrWeakSharedSecret if
+// the remote key is a low-order point.
+func PrecomputeStaticShared(local *KeyPair, remoteStatic [32]byte) ([32]byte, error) {
+	return dh(*local, remoteStatic)
+}
+
+// Equal returns true if the two key pairs are the same. The keys are compared
+// in constant time.
+func (kp KeyPair) Equal(other KeyPair) bool {
+	return subtle.ConstantTimeCompare(kp.PrivateKey[:], other.PrivateKey[:])&subtle.ConstantTimeCompare(kp.PublicKey[:], other.PublicKey[:]) == 1
+}
+
+// Valid returns true if the private key is not zero and the public key is the
+// one derived from it. It detects key pairs that were corrupted or modified,
+// for example after being deserialized.
+func (kp KeyPair) Valid() bool {
+	if kp.PrivateKey == [32]byte{} {
+		return false
+	}
+	privateKey, err := ecdh.X25519().NewPrivateKey(kp.PrivateKey[:])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(privateKey.PublicKey().Bytes(), kp.PublicKey[:]) == 1
 }
 
 // ExportPublicKey returns the public part in hex format of a static key pair.
@@ -57,47 +216,145 @@ func (kp KeyPair) ExportPublicKey() string {
 	return hex.EncodeToString(kp.PublicKey[:])
 }
 
-func dh(keyPair KeyPair, publicKey [32]byte) (shared [32]byte) {
+// ErrNonCanonicalKey is returned by readMessage, with Config.StrictEncoding,
+// when a public key received is not canonically encoded.
+var ErrNonCanonicalKey = errors.New("noise: the public key received is not canonically encoded")
+
+// isCanonicalKey returns false if publicKey has its most significant bit set,
+// or encodes a field element greater than or equal to 2^255-19. X25519
+// ignores the high bit and reduces such values, so that several encodings
+// lead to the same shared secret.
+func isCanonicalKey(publicKey [32]byte) bool {
+	if publicKey[31]&0x80 != 0 {
+		return false
+	}
+	// the only values in [p, 2^255-1] are 0x7fff...ffed to 0x7fff...ffff
+	if publicKey[31] != 0x7f || publicKey[0] < 0xed {
+		return true
+	}
+	for _, b := range publicKey[1:31] {
+		if b != 0xff {
+			return true
+		}
+	}
+	return false
+}
 
-	curve25519.ScalarMult(&shared, &keyPair.PrivateKey, &publicKey)
+// ErrWeakSharedSecret is returned when a DH outputs an all-zero shared
+// secret, which happens when the public key is a low-order point. Such a
+// secret is known to anyone and would not protect the handshake.
+var ErrWeakSharedSecret = errors.New("noise: the DH produced an all-zero shared secret")
+
+// x25519 computes X25519 with crypto/ecdh, which already refuses to return
+// an all-zero output. It is a variable so that tests can replace it with an
+// implementation that does not.
+var x25519 = func(privateKey, publicKey []byte) ([]byte, error) {
+	local, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	output, err := local.ECDH(remote)
+	if err != nil {
+		// the only error of X25519 is an all-zero output
+		return nil, ErrWeakSharedSecret
+	}
+	return output, nil
+}
+
+// dh computes X25519. It returns ErrWeakSharedSecret if the public key is a
+// low-order point, which makes the shared secret all-zero. The output is
+// checked in constant time, whatever the implementation of X25519.
+func dh(keyPair KeyPair, publicKey [32]byte) (shared [32]byte, err error) {
+	output, err := x25519(keyPair.PrivateKey[:], publicKey[:])
+	if err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare(output, shared[:]) == 1 {
+		return shared, ErrWeakSharedSecret
+	}
+	copy(shared[:], output)
 
 	return
 }
 
 // 4.2. Cipher functions
+
+// CipherFunction is one of the cipher functions of the specification.
+type CipherFunction uint8
+
+// The cipher functions implemented, ChaChaPoly is the default one.
+const (
+	CipherChaChaPoly CipherFunction = iota
+	CipherAESGCM
+)
+
+// String returns the name of the cipher function used in protocol names.
+func (c CipherFunction) String() string {
+	switch c {
+	case CipherChaChaPoly:
+		return "ChaChaPoly"
+	case CipherAESGCM:
+		return "AESGCM"
+	}
+	return "unknown"
+}
+
+// newAEAD returns the AEAD of the cipher function, and the nonce made of the
+// counter n (encoded in little-endian for ChaChaPoly, in big-endian for AESGCM)
+func newAEAD(c CipherFunction, k [32]byte, n uint64) (aead cipher.AEAD, nonce []byte, err error) {
+	nonce = make([]byte, 12)
+	switch c {
+	case CipherChaChaPoly:
+		aead, err = chacha20poly1305.New(k[:])
+		binary.LittleEndian.PutUint64(nonce[4:], n)
+	case CipherAESGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(k[:]); err != nil {
+			return
+		}
+		aead, err = cipher.NewGCM(block)
+		binary.BigEndian.PutUint64(nonce[4:], n)
+	default:
+		err = errors.New("noise: unknown cipher function")
+	}
+	return
+}
+
 // TODO: should this really panic? decrypts return an error, this does not
-func encrypt(k [32]byte, n uint64, ad, plaintext []byte) (ciphertext []byte) {
+func encrypt(c CipherFunction, k [32]byte, n uint64, ad, plaintext []byte) (ciphertext []byte) {
 
-	cipher, err := chacha20poly1305.New(k[:])
+	aead, nonce, err := newAEAD(c, k, n)
 	if err != nil {
 		panic(err)
 	}
 
-	var nonce [8]byte
-	binary.LittleEndian.PutUint64(nonce[:], n)
 	// TODO: storage can be re-used by doing Seal(plaintext[:0], ...)
 	// if we do that, we could think of creating a single buffer of NoiseMessageLength for all operations
-	ciphertext = cipher.Seal(nil, append([]byte{0, 0, 0, 0}, nonce[:]...), plaintext, ad)
+	ciphertext = aead.Seal(nil, nonce, plaintext, ad)
 
 	return
 }
 
-func decrypt(k [32]byte, n uint64, ad, ciphertext []byte) (plaintext []byte, err error) {
+func decrypt(c CipherFunction, k [32]byte, n uint64, ad, ciphertext []byte) (plaintext []byte, err error) {
 
-	cipher, err := chacha20poly1305.New(k[:])
+	aead, nonce, err := newAEAD(c, k, n)
 	if err != nil {
 		return
 	}
 
-	var nonce [8]byte
-	binary.LittleEndian.PutUint64(nonce[:], n)
-	plaintext, err = cipher.Open(nil, append([]byte{0, 0, 0, 0}, nonce[:]...), ciphertext, ad)
+	if plaintext, err = aead.Open(nil, nonce, ciphertext, ad); err != nil {
+		return nil, ErrBadMAC
+	}
 	return
 }
 
-func rekey(k [32]byte) (newkey [32]byte) {
+func rekey(c CipherFunction, k [32]byte) (newkey [32]byte) {
 
-	copy(newkey[:], encrypt(k, math.MaxUint64, []byte{}, bytes.Repeat([]byte{0}, 32))[:32])
+	copy(newkey[:], encrypt(c, k, math.MaxUint64, []byte{}, bytes.Repeat([]byte{0}, 32))[:32])
 
 	return
 }
@@ -137,3 +394,34 @@ func hkdf(chainingKey, inputKeyMaterial []byte, numOutputs int) (output []byte)
 	output = append(output, hmacHash(tempKey, append(output[32:], 0x03))...)
 	return
 }
+
+// maxHkdfLength is the maximum output length of HKDF-Expand with SHA-256
+const maxHkdfLength = 255 * 32
+
+// hkdfExpand implements HKDF-Expand from RFC 5869, length must not be larger
+// than maxHkdfLength
+func hkdfExpand(prk, info []byte, length int) []byte {
+	out := make([]byte, 0, length+32)
+	var block []byte
+	for i := byte(1); len(out) < length; i++ {
+		input := make([]byte, 0, len(block)+len(info)+1)
+		input = append(input, block...)
+		input = append(input, info...)
+		input = append(input, i)
+		block = hmacHash(prk, input)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// KDF derives outLen bytes from a secret key and a context string info,
+// using HKDF with SHA-256 and a salt specific to this package. It can be
+// used by applications to derive keys with the same primitives as the rest
+// of the package. It panics if outLen is negative or larger than 8160 bytes.
+func KDF(key, info []byte, outLen int) []byte {
+	if outLen < 0 || outLen > maxHkdfLength {
+		panic("noise: invalid output length for KDF")
+	}
+	prk := hmacHash([]byte("NoiseGo KDF"), key)
+	return hkdfExpand(prk, info, outLen)
+}
@@ -0,0 +1,242 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	xhkdf "golang.org/x/crypto/hkdf"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("broken RNG") }
+
+func TestGenerateKeypairRNGFailure(t *testing.T) {
+	defer func(r io.Reader) { randReader = r }(randReader)
+	randReader = failingReader{}
+
+	if _, err := GenerateKeypairErr(nil); err == nil {
+		t.Fatal("a failing RNG should return an error")
+	}
+
+	// the ephemeral generation of a handshake should fail as well
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(&[32]byte{1}), nil, nil, nil)
+	var message []byte
+	if _, _, err := initiator.writeMessage(nil, &message); err == nil {
+		t.Fatal("writing an ephemeral with a failing RNG should return an error")
+	}
+}
+
+func TestConfigRand(t *testing.T) {
+	seed := sha256.Sum256([]byte("deterministic ephemeral"))
+	expected := GenerateKeypair(&seed)
+
+	config := &Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), Rand: bytes.NewReader(seed[:])}
+	initiator, err := NewHandshake(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message []byte
+	if _, _, err = initiator.writeMessage(nil, &message); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.e != *expected || !bytes.Equal(message[:dhLen], expected.PublicKey[:]) {
+		t.Fatal("the ephemeral key should be derived from Config.Rand")
+	}
+
+	// a source that cannot produce a full private key is an error
+	config.Rand = bytes.NewReader(seed[:16])
+	initiator, _ = NewHandshake(config, true)
+	if _, _, err = initiator.writeMessage(nil, &message); err == nil {
+		t.Fatal("a short read of Config.Rand should be rejected")
+	}
+}
+
+func TestHedgedEphemerals(t *testing.T) {
+	static := GenerateKeypair(nil)
+	broken := bytes.Repeat([]byte{0x42}, 32)
+	ephemeral := func(hedged bool, keyPair *KeyPair, prologue string) [32]byte {
+		config := &Config{HandshakePattern: Noise_XX, KeyPair: keyPair, Prologue: []byte(prologue), Rand: bytes.NewReader(broken), HedgedEphemerals: hedged}
+		initiator, err := NewHandshake(config, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message []byte
+		if _, _, err = initiator.writeMessage(nil, &message); err != nil {
+			t.Fatal(err)
+		}
+		return initiator.e.PrivateKey
+	}
+
+	if ephemeral(false, static, "first") != ephemeral(false, static, "second") {
+		t.Fatal("without hedging, a constant RNG should produce the same ephemeral keys")
+	}
+	if ephemeral(true, static, "first") == ephemeral(true, static, "second") {
+		t.Fatal("hedged ephemeral keys should depend on the transcript")
+	}
+	if ephemeral(true, static, "first") != ephemeral(true, static, "first") {
+		t.Fatal("hedged ephemeral keys should be derived deterministically")
+	}
+	if ephemeral(true, static, "first") == ephemeral(true, GenerateKeypair(nil), "first") {
+		t.Fatal("hedged ephemeral keys should depend on the static key")
+	}
+	if ephemeral(true, static, "first") == ephemeral(false, static, "first") {
+		t.Fatal("hedged ephemeral keys should not be the output of the RNG")
+	}
+}
+
+func TestKeyPairEqualValid(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	same := GenerateKeypair(&keyPair.PrivateKey)
+	if !keyPair.Equal(*same) || !keyPair.Valid() {
+		t.Fatal("a key pair should be equal to itself, and valid")
+	}
+	if keyPair.Equal(*GenerateKeypair(nil)) {
+		t.Fatal("different key pairs should not be equal")
+	}
+
+	corrupted := *keyPair
+	corrupted.PublicKey[0] ^= 1
+	if corrupted.Valid() || keyPair.Equal(corrupted) {
+		t.Fatal("a key pair with a corrupted public key should be invalid")
+	}
+	corrupted = *keyPair
+	corrupted.PrivateKey[5] ^= 1
+	if corrupted.Valid() || keyPair.Equal(corrupted) {
+		t.Fatal("a key pair with a corrupted private key should be invalid")
+	}
+	if (KeyPair{}).Valid() || (KeyPair{PublicKey: keyPair.PublicKey}).Valid() {
+		t.Fatal("a key pair without private key should be invalid")
+	}
+}
+
+func TestStrictEncoding(t *testing.T) {
+	var p [32]byte
+	for i := range p {
+		p[i] = 0xff
+	}
+	p[0], p[31] = 0xed, 0x7f
+	valid := GenerateKeypair(nil).PublicKey
+	if isCanonicalKey(p) || !isCanonicalKey(valid) {
+		t.Fatal("isCanonicalKey should reject 2^255-19 and accept a public key")
+	}
+	p[0] = 0xec
+	if !isCanonicalKey(p) {
+		t.Fatal("2^255-20 is canonical")
+	}
+
+	for _, strict := range []bool{false, true} {
+		initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil)}, true)
+		responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), StrictEncoding: strict}, false)
+		var message, payload []byte
+		if _, _, err := initiator.writeMessage(nil, &message); err != nil {
+			t.Fatal(err)
+		}
+		// the same point with the high bit set
+		message[31] |= 0x80
+		_, _, err := responder.readMessage(message, &payload)
+		if strict && err != ErrNonCanonicalKey {
+			t.Fatal("a non-canonical key should be rejected in strict mode", err)
+		}
+		if !strict && err != nil {
+			t.Fatal("a non-canonical key should be accepted by default", err)
+		}
+	}
+}
+
+func TestCheckScalarBaseMult(t *testing.T) {
+	// the check passes with the implementation of X25519 in use
+	checkScalarBaseMult()
+
+	// and panics if the public key computed is not the known one
+	defer func(original string) { scalarBaseMultKAT.publicKey = original }(scalarBaseMultKAT.publicKey)
+	scalarBaseMultKAT.publicKey = "00" + scalarBaseMultKAT.publicKey[2:]
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a wrong public key should make the check panic")
+		}
+	}()
+	checkScalarBaseMult()
+}
+
+func TestKDF(t *testing.T) {
+	// known answer, obtained with golang.org/x/crypto/hkdf
+	expected, _ := hex.DecodeString("ad11e3fb804f2a6713ddef3b4f764916ac182a3746f0f3ed72c1e8640f17da8f877ff580cc906b72bf06")
+	if out := KDF([]byte("key"), []byte("info"), 42); !bytes.Equal(out, expected) {
+		t.Fatalf("unexpected KDF output %x", out)
+	}
+
+	// compare with golang.org/x/crypto/hkdf for several lengths
+	for _, outLen := range []int{0, 1, 32, 33, 64, 1000} {
+		reference := make([]byte, outLen)
+		io.ReadFull(xhkdf.New(sha256.New, []byte("secret"), []byte("NoiseGo KDF"), []byte("context")), reference)
+		if !bytes.Equal(KDF([]byte("secret"), []byte("context"), outLen), reference) {
+			t.Fatal("KDF does not match HKDF for length", outLen)
+		}
+	}
+
+	// domain separation
+	if bytes.Equal(KDF([]byte("key"), []byte("info1"), 32), KDF([]byte("key"), []byte("info2"), 32)) {
+		t.Fatal("different contexts should give different outputs")
+	}
+}
+
+func TestDHCompatibility(t *testing.T) {
+	// the implementation of x/crypto/curve25519 that was used before
+	for i := byte(0); i < 10; i++ {
+		var private, remotePrivate [32]byte
+		for j := range private {
+			private[j] = i*32 + byte(j)
+			remotePrivate[j] = ^private[j]
+		}
+		keyPair := GenerateKeypair(&private)
+		expectedPublic, _ := curve25519.X25519(private[:], curve25519.Basepoint)
+		if !bytes.Equal(keyPair.PublicKey[:], expectedPublic) {
+			t.Fatal("public keys do not match the previous implementation")
+		}
+		remote := GenerateKeypair(&remotePrivate)
+		shared, err := dh(*keyPair, remote.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedShared, _ := curve25519.X25519(private[:], remote.PublicKey[:])
+		if !bytes.Equal(shared[:], expectedShared) {
+			t.Fatal("shared secrets do not match the previous implementation")
+		}
+	}
+
+	// low-order points give an all-zero shared secret and are rejected
+	lowOrder := [][32]byte{{}, {1}}
+	for _, publicKey := range lowOrder {
+		if _, err := dh(*GenerateKeypair(nil), publicKey); err != ErrWeakSharedSecret {
+			t.Fatal("a low-order point should be rejected", err)
+		}
+	}
+	initiator := initialize(Noise_NK, true, nil, nil, nil, &KeyPair{PublicKey: [32]byte{1}}, nil)
+	var message []byte
+	if _, _, err := initiator.writeMessage(nil, &message); !errors.Is(err, ErrWeakSharedSecret) {
+		t.Fatal("a handshake with a low-order point should fail", err)
+	}
+}
+
+func TestWeakSharedSecret(t *testing.T) {
+	// an implementation of X25519 that does not reject low-order points
+	defer func(f func(privateKey, publicKey []byte) ([]byte, error)) { x25519 = f }(x25519)
+	x25519 = func(privateKey, publicKey []byte) ([]byte, error) {
+		if publicKey[0] == 1 && bytes.Equal(publicKey[1:], make([]byte, 31)) {
+			return make([]byte, 32), nil
+		}
+		return curve25519.X25519(privateKey, publicKey)
+	}
+	if _, err := dh(*GenerateKeypair(nil), [32]byte{1}); err != ErrWeakSharedSecret {
+		t.Fatal("an all-zero shared secret should be rejected", err)
+	}
+	if _, err := dh(*GenerateKeypair(nil), GenerateKeypair(nil).PublicKey); err != nil {
+		t.Fatal("a valid public key should be accepted", err)
+	}
+}
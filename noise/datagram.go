@@ -0,0 +1,196 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+//
+// Datagram transport
+//
+
+// replayWindowSize is the number of sequence numbers, below the highest one
+// received so far, that a DatagramSession keeps track of.
+const replayWindowSize = 64
+
+// The following errors are returned by a DatagramSession when a record is refused.
+var (
+	ErrReplayedRecord = errors.New("noise: the record has already been received")
+	ErrStaleRecord    = errors.New("noise: the record is too old to be received")
+)
+
+// A DatagramSession encrypts and decrypts transport messages that can be
+// dropped or received out of order, for example over UDP. Instead of relying
+// on an implicit nonce, each record carries its sequence number in clear
+// (8 bytes, big-endian) followed by the ciphertext. The sequence number is
+// used as the nonce of the AEAD, and a sliding window (as in IPsec) rejects
+// records that have already been received or that are too old.
+type DatagramSession struct {
+	out, in *cipherState
+	sendSeq uint64
+	window  replayWindow
+
+	// rekeys scheduled via ScheduleRekey
+	outRekey, inRekey scheduledRekey
+}
+
+// scheduledRekey holds the key that replaces the key of a direction from a
+// given sequence number
+type scheduledRekey struct {
+	pending bool
+	from    uint64
+	next    [32]byte
+}
+
+// datagramKeyLabel derives the keys of a DatagramSession from the keys of a
+// Session, see NewDatagramSession
+var datagramKeyLabel = []byte("datagram")
+
+// NewDatagramSession converts a Session into a DatagramSession. The
+// DatagramSession uses its own keys, derived from the current keys of the
+// Session as HMAC-HASH(key, "datagram"): its sequence numbers start at 0
+// without reusing the nonces of the messages the Session might have
+// already encrypted, and these messages cannot be replayed as records. The
+// keys of the Session are erased: it is closed, as if by Close.
+func NewDatagramSession(s *Session) *DatagramSession {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.closed = true
+	return &DatagramSession{out: datagramState(s.out), in: datagramState(s.in)}
+}
+
+// datagramState returns the cipherState of a direction of a DatagramSession
+// and erases the one of the Session
+func datagramState(c *cipherState) *cipherState {
+	if c == nil {
+		return nil
+	}
+	d := &cipherState{cipher: c.cipher}
+	d.initializeKey(hmacHash(c.k[:], datagramKeyLabel))
+	c.clear()
+	return d
+}
+
+// Encrypt encrypts a record and returns it along with its sequence number.
+func (d *DatagramSession) Encrypt(plaintext []byte) (seq uint64, record []byte, err error) {
+	if d.out == nil {
+		return 0, nil, errNoWriteChannel
+	}
+	// 2^64-1 is reserved by Noise
+	if d.sendSeq == math.MaxUint64 {
+		return 0, nil, errors.New("noise: nonce has reached maximum size")
+	}
+	seq = d.sendSeq
+	d.sendSeq++
+
+	// the previous key is not needed anymore once the rekey takes effect
+	if d.outRekey.pending && seq >= d.outRekey.from {
+		d.out.k = d.outRekey.next
+		d.outRekey = scheduledRekey{}
+	}
+
+	record = make([]byte, 8, 8+len(plaintext)+NoiseTagLength)
+	binary.BigEndian.PutUint64(record, seq)
+	record = append(record, encrypt(d.out.cipher, d.out.k, seq, []byte{}, plaintext)...)
+
+	return seq, record, nil
+}
+
+// Decrypt decrypts a record and returns its plaintext along with its sequence
+// number. Records can be received in any order, as long as their sequence
+// number is within the replay window and they have not been received before.
+func (d *DatagramSession) Decrypt(record []byte) (plaintext []byte, seq uint64, err error) {
+	if d.in == nil {
+		return nil, 0, errNoReadChannel
+	}
+	if len(record) < 8+NoiseTagLength {
+		return nil, 0, errors.New("noise: the record received is too short")
+	}
+	seq = binary.BigEndian.Uint64(record[:8])
+	if seq == math.MaxUint64 {
+		return nil, 0, errors.New("noise: invalid sequence number")
+	}
+	if err = d.window.check(seq); err != nil {
+		return nil, seq, err
+	}
+
+	key := d.in.k
+	if d.inRekey.pending && seq >= d.inRekey.from {
+		key = d.inRekey.next
+	}
+	plaintext, err = decrypt(d.in.cipher, key, seq, []byte{}, record[8:])
+	if err != nil {
+		return nil, seq, err
+	}
+
+	// only authenticated records can move the window
+	d.window.update(seq)
+
+	// the previous key is kept until no record encrypted with it can be accepted
+	if d.inRekey.pending && d.window.next >= d.inRekey.from+replayWindowSize {
+		d.in.k = d.inRekey.next
+		d.inRekey = scheduledRekey{}
+	}
+
+	return plaintext, seq, nil
+}
+
+// ScheduleRekey schedules a rekey (as defined by the specification) of both
+// directions of the DatagramSession: records with a sequence number greater
+// than or equal to afterSeq are encrypted and decrypted with the new keys.
+// The other peer must schedule the rekey at the same sequence number, which
+// does not require a round trip. Records sent before the rekey can still be
+// received until they fall out of the replay window.
+func (d *DatagramSession) ScheduleRekey(afterSeq uint64) error {
+	if d.outRekey.pending || d.inRekey.pending {
+		return errors.New("noise: a rekey is already scheduled")
+	}
+	if afterSeq < d.sendSeq || afterSeq < d.window.next {
+		return errors.New("noise: a rekey cannot be scheduled for records already processed")
+	}
+	if d.out != nil {
+		d.outRekey = scheduledRekey{pending: true, from: afterSeq, next: rekey(d.out.cipher, d.out.k)}
+	}
+	if d.in != nil {
+		d.inRekey = scheduledRekey{pending: true, from: afterSeq, next: rekey(d.in.cipher, d.in.k)}
+	}
+	return nil
+}
+
+// replayWindow keeps track of the sequence numbers received
+type replayWindow struct {
+	// next is the highest sequence number received plus one (0 if none)
+	next uint64
+	// bit i is set if the sequence number next-1-i has been received
+	bitmap uint64
+}
+
+func (w *replayWindow) check(seq uint64) error {
+	if seq >= w.next {
+		return nil
+	}
+	diff := w.next - 1 - seq
+	if diff >= replayWindowSize {
+		return ErrStaleRecord
+	}
+	if w.bitmap&(1<<diff) != 0 {
+		return ErrReplayedRecord
+	}
+	return nil
+}
+
+func (w *replayWindow) update(seq uint64) {
+	if seq < w.next {
+		w.bitmap |= 1 << (w.next - 1 - seq)
+		return
+	}
+	if shift := seq + 1 - w.next; w.next == 0 || shift >= replayWindowSize {
+		w.bitmap = 1
+	} else {
+		w.bitmap = w.bitmap<<shift | 1
+	}
+	w.next = seq + 1
+}
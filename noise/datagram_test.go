@@ -0,0 +1,170 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagramSession(t *testing.T) {
+	initiatorSession, responderSession := newTestSessions(t)
+	initiator := NewDatagramSession(initiatorSession)
+	responder := NewDatagramSession(responderSession)
+
+	// encrypt a few records
+	var records [][]byte
+	for i := 0; i < 100; i++ {
+		seq, record, err := initiator.Encrypt([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != uint64(i) {
+			t.Fatal("unexpected sequence number", seq)
+		}
+		records = append(records, record)
+	}
+
+	// out of order but in-window
+	for _, i := range []int{3, 1, 2, 0, 10, 5} {
+		plaintext, seq, err := responder.Decrypt(records[i])
+		if err != nil {
+			t.Fatalf("record %d was not decrypted: %s", i, err)
+		}
+		if seq != uint64(i) || !bytes.Equal(plaintext, []byte{byte(i)}) {
+			t.Fatalf("record %d not correctly decrypted", i)
+		}
+	}
+
+	// replayed
+	if _, _, err := responder.Decrypt(records[2]); err != ErrReplayedRecord {
+		t.Fatal("a replayed record should be rejected", err)
+	}
+
+	// move the window forward, record 4 becomes too old
+	if _, _, err := responder.Decrypt(records[99]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := responder.Decrypt(records[4]); err != ErrStaleRecord {
+		t.Fatal("a record outside of the window should be rejected", err)
+	}
+	if _, _, err := responder.Decrypt(records[99-replayWindowSize+1]); err != nil {
+		t.Fatal("the oldest record of the window should be accepted", err)
+	}
+	if _, _, err := responder.Decrypt(records[99-replayWindowSize]); err != ErrStaleRecord {
+		t.Fatal("the record just outside of the window should be rejected", err)
+	}
+
+	// a tampered record doesn't move the window
+	_, record, _ := initiator.Encrypt([]byte("hello"))
+	record[len(record)-1] ^= 1
+	if _, _, err := responder.Decrypt(record); err == nil {
+		t.Fatal("a tampered record should be rejected")
+	}
+	record[len(record)-1] ^= 1
+	if plaintext, _, err := responder.Decrypt(record); err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("the original record should still be accepted", err)
+	}
+}
+
+func TestDatagramScheduleRekey(t *testing.T) {
+	initiatorSession, responderSession := newTestSessions(t)
+	initiator := NewDatagramSession(initiatorSession)
+	responder := NewDatagramSession(responderSession)
+
+	if err := initiator.ScheduleRekey(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.ScheduleRekey(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.ScheduleRekey(20); err == nil {
+		t.Fatal("only one rekey should be scheduled at a time")
+	}
+
+	// records straddling the rekey boundary
+	previousKey := initiator.out.k
+	var records [][]byte
+	for i := 0; i < 20; i++ {
+		_, record, err := initiator.Encrypt([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	// the records after the boundary are encrypted with the new key
+	if initiator.out.k != rekey(initiator.out.cipher, previousKey) {
+		t.Fatal("the rekey did not happen")
+	}
+	if _, err := decrypt(initiator.out.cipher, previousKey, 10, []byte{}, records[10][8:]); err == nil {
+		t.Fatal("a record after the boundary should not be encrypted with the previous key")
+	}
+
+	// receive records after the boundary first, then in-flight records from before
+	for _, i := range []int{12, 10, 15, 3, 9, 0, 19, 11} {
+		plaintext, _, err := responder.Decrypt(records[i])
+		if err != nil || !bytes.Equal(plaintext, []byte{byte(i)}) {
+			t.Fatalf("record %d was not decrypted: %v", i, err)
+		}
+	}
+
+	// once the window has passed, the previous key is discarded
+	for i := 20; i < 10+replayWindowSize; i++ {
+		_, record, _ := initiator.Encrypt([]byte{byte(i)})
+		if _, _, err := responder.Decrypt(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if responder.inRekey.pending {
+		t.Fatal("the previous key should have been discarded")
+	}
+	if err := responder.ScheduleRekey(5); err == nil {
+		t.Fatal("a rekey should not be scheduled in the past")
+	}
+
+	// the other direction is rekeyed too
+	for i := 0; i < 12; i++ {
+		_, record, _ := responder.Encrypt([]byte{byte(i)})
+		if plaintext, _, err := initiator.Decrypt(record); err != nil || plaintext[0] != byte(i) {
+			t.Fatal("record not decrypted in the other direction", err)
+		}
+	}
+}
+
+func TestDatagramSessionAfterSession(t *testing.T) {
+	initiatorSession, responderSession := newTestSessions(t)
+	sessionMessage, err := initiatorSession.Encrypt([]byte("sent by the session!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = responderSession.Decrypt(sessionMessage); err != nil {
+		t.Fatal(err)
+	}
+	initiator := NewDatagramSession(initiatorSession)
+	responder := NewDatagramSession(responderSession)
+	if _, err = initiatorSession.Encrypt([]byte("hello")); err != ErrSessionClosed {
+		t.Fatal("the converted session should be closed", err)
+	}
+
+	// the first record does not reuse the nonce of the message of the session
+	plaintext := []byte("sent by the datagram")
+	_, record, err := initiator.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xored := make([]byte, len(plaintext))
+	for i := range xored {
+		xored[i] = sessionMessage[i] ^ record[8+i] ^ plaintext[i]
+	}
+	if bytes.Equal(xored, []byte("sent by the session!")) {
+		t.Fatal("the record reuses the keystream of the session")
+	}
+
+	// a message of the session cannot be replayed as a record
+	replayed := append(make([]byte, 8), sessionMessage...)
+	if _, _, err = responder.Decrypt(replayed); err == nil {
+		t.Fatal("a message of the session should not be accepted as a record")
+	}
+	if received, _, err := responder.Decrypt(record); err != nil || !bytes.Equal(received, plaintext) {
+		t.Fatal("the record was not decrypted", err)
+	}
+}
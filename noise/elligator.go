@@ -0,0 +1,140 @@
+package noise
+
+import (
+	"errors"
+	"io"
+	"math/big"
+)
+
+//
+// Elligator 2
+//
+
+// Elligator 2 maps about half of the points of Curve25519 to strings of
+// bytes that are indistinguishable from random ones, see
+// https://elligator.cr.yp.to/elligator-20130828.pdf
+//
+// Caveat: X25519 public keys are multiples of the base point, and thus are
+// all in the prime-order subgroup of the curve. An observer decoding
+// representatives can notice that all of them map to such points, which is
+// not the case of random strings. Fully indistinguishable ephemeral keys
+// would require adding a random low-order point to the public key, which is
+// not done here.
+
+var (
+	curve25519P     = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	curve25519A     = big.NewInt(486662)
+	curve25519HalfP = new(big.Int).Rsh(curve25519P, 1)
+)
+
+var errNotRepresentable = errors.New("noise: the ephemeral key cannot be obfuscated")
+
+// littleEndianToInt decodes a 32-byte little-endian field element
+func littleEndianToInt(in [32]byte) *big.Int {
+	var be [32]byte
+	for i := range in {
+		be[31-i] = in[i]
+	}
+	return new(big.Int).SetBytes(be[:])
+}
+
+// intToLittleEndian encodes a field element in 32 bytes, little-endian
+func intToLittleEndian(x *big.Int) (out [32]byte) {
+	be := x.Bytes()
+	for i := range be {
+		out[i] = be[len(be)-1-i]
+	}
+	return
+}
+
+// elligatorRepresentative returns the representative of a public key, if it
+// has one. The two most significant bits of the representative are always
+// zero and are set to the ones of tweak, which should be random.
+func elligatorRepresentative(publicKey [32]byte, tweak byte) (representative [32]byte, ok bool) {
+	u := littleEndianToInt(publicKey)
+	if u.Sign() == 0 || u.Cmp(curve25519P) >= 0 {
+		return representative, false
+	}
+
+	// r = sqrt(-(u + A) / 2u)
+	num := new(big.Int).Add(u, curve25519A)
+	num.Neg(num)
+	den := new(big.Int).Lsh(u, 1)
+	den.ModInverse(den, curve25519P)
+	num.Mul(num, den)
+	num.Mod(num, curve25519P)
+	r := new(big.Int).ModSqrt(num, curve25519P)
+	if r == nil {
+		return representative, false
+	}
+
+	// use the non-negative square root
+	if r.Cmp(curve25519HalfP) > 0 {
+		r.Sub(curve25519P, r)
+	}
+
+	representative = intToLittleEndian(r)
+	representative[31] |= tweak & 0xc0
+	return representative, true
+}
+
+// elligatorPublicKey returns the public key corresponding to a representative
+func elligatorPublicKey(representative [32]byte) [32]byte {
+	representative[31] &= 0x3f
+	r := littleEndianToInt(representative)
+
+	// u = -A / (1 + 2r^2), as 2 is not a square 1 + 2r^2 is never zero
+	d := new(big.Int).Mul(r, r)
+	d.Lsh(d, 1)
+	d.Add(d, big.NewInt(1))
+	d.ModInverse(d, curve25519P)
+	u := new(big.Int).Neg(curve25519A)
+	u.Mul(u, d)
+	u.Mod(u, curve25519P)
+
+	// if u^3 + Au^2 + u is not a square, u is on the twist: use -A - u
+	v := new(big.Int).Add(u, curve25519A)
+	v.Mul(v, u)
+	v.Add(v, big.NewInt(1))
+	v.Mul(v, u)
+	v.Mod(v, curve25519P)
+	if big.Jacobi(v, curve25519P) == -1 {
+		u.Add(u, curve25519A)
+		u.Neg(u)
+		u.Mod(u, curve25519P)
+	}
+
+	return intToLittleEndian(u)
+}
+
+// obfuscatedEphemeral returns the representative of an ephemeral public key
+// to send on the wire, using randomness from r (or from crypto/rand if r is
+// nil)
+func obfuscatedEphemeral(r io.Reader, publicKey [32]byte) ([32]byte, error) {
+	if r == nil {
+		r = randReader
+	}
+	var tweak [1]byte
+	if _, err := io.ReadFull(r, tweak[:]); err != nil {
+		return [32]byte{}, errors.New("noise: cannot generate randomness: " + err.Error())
+	}
+	representative, ok := elligatorRepresentative(publicKey, tweak[0])
+	if !ok {
+		return representative, errNotRepresentable
+	}
+	return representative, nil
+}
+
+// newRepresentableEphemeral generates ephemeral key pairs until one of them
+// has a representative (one out of two does on average)
+func newRepresentableEphemeral(r io.Reader) (*KeyPair, error) {
+	for {
+		keyPair, err := newEphemeral(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := elligatorRepresentative(keyPair.PublicKey, 0); ok {
+			return keyPair, nil
+		}
+	}
+}
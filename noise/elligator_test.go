@@ -0,0 +1,59 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestElligator(t *testing.T) {
+	representable := 0
+	for i := 0; i < 200; i++ {
+		keyPair := GenerateKeypair(nil)
+		representative, ok := elligatorRepresentative(keyPair.PublicKey, byte(i))
+		if !ok {
+			continue
+		}
+		representable++
+		if representative[31]&0xc0 != byte(i)&0xc0 {
+			t.Fatal("the representative was not tweaked")
+		}
+		if elligatorPublicKey(representative) != keyPair.PublicKey {
+			t.Fatal("the representative does not decode to the original public key")
+		}
+	}
+	// about half of the points are representable
+	if representable < 50 || representable > 150 {
+		t.Fatal("unexpected number of representable points", representable)
+	}
+}
+
+func TestObfuscateEphemeral(t *testing.T) {
+	initiator, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ObfuscateEphemeral: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ObfuscateEphemeral: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message, payload []byte
+	if _, _, err = initiator.writeMessage(nil, &message); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(message[:dhLen], initiator.e.PublicKey[:]) {
+		t.Fatal("the ephemeral key was sent in clear")
+	}
+	if _, _, err = responder.readMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if responder.re.PublicKey != initiator.e.PublicKey {
+		t.Fatal("the ephemeral key was not decoded correctly")
+	}
+
+	initiatorSession, responderSession := completeHandshake(t, initiator, responder)
+	ciphertext, _ := initiatorSession.Encrypt([]byte("hello"))
+	if plaintext, err := responderSession.Decrypt(ciphertext); err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("the session does not work", err)
+	}
+}
@@ -0,0 +1,60 @@
+package noise
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//
+// Errors
+//
+
+// The errors of this package are sentinel values that can be matched with
+// errors.Is; some of them are wrapped with more details, for example in a
+// HandshakeError. Besides the ones defined below, the package exposes more
+// specific errors next to the code returning them (ErrUnknownPattern,
+// ErrPinMismatch, ErrHandshakeFailed, ErrKeyExhausted...).
+var (
+	// ErrBadMAC is returned when a message cannot be decrypted: it was
+	// modified, encrypted under a different key, or is not the message
+	// expected next.
+	ErrBadMAC = errors.New("noise: message authentication failed")
+	// ErrShortMessage is returned when a handshake message is too short for
+	// its message pattern.
+	ErrShortMessage = errors.New("noise: the message is too short")
+	// ErrEmptyMessage is returned when a handshake message is empty while
+	// its message pattern expects tokens. Unlike other errors, the
+	// handshakeState is not modified and can still read the actual message,
+	// so that servers can tell keep-alives apart from malformed handshakes.
+	ErrEmptyMessage = errors.New("noise: the handshake message is empty")
+	// ErrWrongRole is returned when a handshake message is written by the
+	// peer that should read the next one, or the other way around.
+	ErrWrongRole = errors.New("noise: this peer cannot process the next handshake message in this direction")
+)
+
+// A HandshakeError is returned when a handshake message cannot be read. It
+// wraps the cause of the failure, like ErrBadMAC or ErrShortMessage, and
+// indicates which message of the handshake pattern failed (starting at 0).
+type HandshakeError struct {
+	MessageIndex int
+	Err          error
+}
+
+func (e *HandshakeError) Error() string {
+	return "noise: handshake message " + strconv.Itoa(e.MessageIndex) + ": " + strings.TrimPrefix(e.Err.Error(), "noise: ")
+}
+
+// Unwrap returns the cause of the error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// messageError wraps err in a HandshakeError for the next message to be
+// processed
+func (h *handshakeState) messageError(err error) error {
+	return &HandshakeError{
+		MessageIndex: len(patterns[h.handshakeType].messagePatterns) - len(h.messagePatterns),
+		Err:          err,
+	}
+}
@@ -0,0 +1,57 @@
+package noise
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	var message, payload []byte
+	if _, _, err := responder.writeMessage(nil, &message); !errors.Is(err, ErrWrongRole) {
+		t.Fatal("the responder cannot write the first message", err)
+	}
+	initiator.writeMessage(nil, &message)
+	clone := responder.Clone()
+	if _, _, err := clone.readMessage(message[:dhLen-1], &payload); !errors.Is(err, ErrShortMessage) {
+		t.Fatal("a truncated message should return ErrShortMessage", err)
+	}
+	// an empty message can be followed by the actual message
+	if _, _, err := responder.readMessage([]byte{}, &payload); !errors.Is(err, ErrEmptyMessage) || errors.Is(err, ErrShortMessage) {
+		t.Fatal("an empty message should return ErrEmptyMessage", err)
+	}
+	if _, _, err := responder.readMessage(message, &payload); err != nil {
+		t.Fatal("the handshake should continue after an empty message", err)
+	}
+
+	// a tampered message
+	message = message[:0]
+	responder.writeMessage([]byte("payload"), &message)
+	message[len(message)-1] ^= 1
+	_, _, err := initiator.readMessage(message, &payload)
+	if !errors.Is(err, ErrBadMAC) {
+		t.Fatal("a tampered message should return ErrBadMAC", err)
+	}
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) || handshakeErr.MessageIndex != 1 {
+		t.Fatal("the error should indicate the message index", err)
+	}
+	if err.Error() != "noise: handshake message 1: message authentication failed" {
+		t.Fatal("unexpected error message", err)
+	}
+
+	// and a tampered transport message
+	initiatorSession, responderSession := newTestSessions(t)
+	ciphertext, _ := initiatorSession.Encrypt([]byte("hello"))
+	ciphertext[0] ^= 1
+	if _, err = responderSession.Decrypt(ciphertext); !errors.Is(err, ErrBadMAC) {
+		t.Fatal("a tampered transport message should return ErrBadMAC", err)
+	}
+
+	// errors returned by the compatibility layer wrap the sentinels as well
+	state, _ := NewHandshakeState(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil)}, false)
+	if _, _, _, err = state.WriteMessage(nil, nil); !errors.Is(err, ErrWrongRole) {
+		t.Fatal("the responder cannot write the first message", err)
+	}
+}
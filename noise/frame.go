@@ -0,0 +1,52 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//
+// Framing
+//
+
+// MaxFrameLength is the maximum length of a message sent with WriteFrame,
+// the largest length that fits in its 2-byte prefix.
+const MaxFrameLength = 65535
+
+// ErrFrameTooLong is returned by WriteFrame when a message is longer than
+// MaxFrameLength.
+var ErrFrameTooLong = errors.New("noise: the message is too long to be framed")
+
+// WriteFrame writes msg to w, prefixed with its length on 2 bytes in
+// big-endian. This is the framing used by Conn and DoHandshake for handshake
+// and transport messages. The length prefix and the message are written in
+// a single call to w.Write.
+func WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > MaxFrameLength {
+		return ErrFrameTooLong
+	}
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a message written with WriteFrame from r. It returns
+// io.EOF if r has no more data before a frame, and io.ErrUnexpectedEOF if r
+// ends in the middle of a frame.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,40 @@
+package noise
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	messages := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, MaxFrameLength)}
+	for _, msg := range messages {
+		if err := WriteFrame(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes()[:7], []byte{0, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Fatal("the length should be prefixed in big-endian")
+	}
+	for _, msg := range messages {
+		received, err := ReadFrame(&buf)
+		if err != nil || !bytes.Equal(received, msg) {
+			t.Fatal("the frame did not round trip", err)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatal("no more frames should return io.EOF", err)
+	}
+
+	if err := WriteFrame(&buf, make([]byte, MaxFrameLength+1)); err != ErrFrameTooLong || buf.Len() != 0 {
+		t.Fatal("an oversized message should return ErrFrameTooLong", err)
+	}
+
+	// truncated frames
+	for _, truncated := range [][]byte{{0}, {0, 5}, {0, 5, 'h', 'e'}} {
+		if _, err := ReadFrame(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+			t.Fatal("a truncated frame should return io.ErrUnexpectedEOF", truncated, err)
+		}
+	}
+}
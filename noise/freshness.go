@@ -0,0 +1,59 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+//
+// Freshness of handshakes
+//
+
+// With Builder.WithFreshness, the payload of the first handshake message
+// starts with the time at which it was written (in seconds since the Unix
+// epoch, 8 bytes big-endian) followed by 8 random bytes. As the payload is
+// hashed in the transcript, the timestamp cannot be modified. The responder
+// receives the rest of the payload.
+//
+// This prevents an attacker from replaying a captured first message long
+// after it was sent. Within the accepted skew, a replay is still possible:
+// a responder that must reject those as well can remember the nonces of the
+// messages accepted during that window.
+const freshnessLen = 16
+
+// ErrStaleHandshake is returned by the responder when the timestamp of the
+// first handshake message is outside of the accepted window.
+var ErrStaleHandshake = errors.New("noise: the handshake is too old or too far in the future")
+
+// addFreshness prefixes payload with the current time and with a nonce read
+// from r (or from crypto/rand if r is nil)
+func addFreshness(r io.Reader, payload []byte) ([]byte, error) {
+	if r == nil {
+		r = randReader
+	}
+	out := make([]byte, freshnessLen, freshnessLen+len(payload))
+	binary.BigEndian.PutUint64(out, uint64(now().Unix()))
+	if _, err := io.ReadFull(r, out[8:freshnessLen]); err != nil {
+		return nil, errors.New("noise: cannot generate randomness: " + err.Error())
+	}
+	return append(out, payload...), nil
+}
+
+// checkFreshness verifies the timestamp at the start of payload and returns
+// the rest of the payload
+func checkFreshness(payload []byte, maxSkew time.Duration) ([]byte, error) {
+	if len(payload) < freshnessLen {
+		return nil, ErrStaleHandshake
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	skew := now().Sub(sent)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return nil, ErrStaleHandshake
+	}
+	return payload[freshnessLen:], nil
+}
@@ -0,0 +1,62 @@
+package noise
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	defer func(clock func() time.Time) { now = clock }(now)
+	sentAt := time.Now()
+
+	for _, delay := range []time.Duration{0, 20 * time.Second, -20 * time.Second, 2 * time.Minute} {
+		initiator, _ := NewBuilder(Noise_XX).AsInitiator().WithStatic(GenerateKeypair(nil)).WithFreshness(time.Minute).Build()
+		responder, _ := NewBuilder(Noise_XX).AsResponder().WithStatic(GenerateKeypair(nil)).WithFreshness(time.Minute).Build()
+
+		now = func() time.Time { return sentAt }
+		var message, payload []byte
+		if _, _, err := initiator.writeMessage([]byte("hello"), &message); err != nil {
+			t.Fatal(err)
+		}
+		now = func() time.Time { return sentAt.Add(delay) }
+		_, _, err := responder.readMessage(message, &payload)
+		if delay < 2*time.Minute {
+			if err != nil || string(payload) != "hello" {
+				t.Fatal("a message within the window should be accepted", delay, err)
+			}
+		} else if err != ErrStaleHandshake {
+			t.Fatal("an expired message should return ErrStaleHandshake", err)
+		}
+	}
+}
+
+func TestFreshnessSizes(t *testing.T) {
+	initiator, _ := NewBuilder(Noise_XX).AsInitiator().WithStatic(GenerateKeypair(nil)).WithFreshness(time.Minute).Build()
+	responder, _ := NewBuilder(Noise_XX).AsResponder().WithStatic(GenerateKeypair(nil)).WithFreshness(time.Minute).Build()
+	payload := []byte("hello")
+
+	// the timestamp is counted in the first message only
+	size := initiator.NextMessageSize(len(payload))
+	if size != MessageSize(Noise_XX, 0, len(payload))+freshnessLen {
+		t.Fatal("unexpected size of the first message", size)
+	}
+	if _, _, _, err := initiator.writeMessageInto(make([]byte, size-1), payload); err != ErrBufferTooSmall {
+		t.Fatal("a buffer too small should return ErrBufferTooSmall", err)
+	}
+	dst := make([]byte, size)
+	n, _, _, err := initiator.writeMessageInto(dst, payload)
+	if err != nil || n != size {
+		t.Fatal("cannot write the message into a buffer of the exact size", n, err)
+	}
+
+	if payloadLen, err := responder.PayloadLen(dst); err != nil || payloadLen != len(payload) {
+		t.Fatal("unexpected length of the payload", payloadLen, err)
+	}
+	var received []byte
+	if _, _, err = responder.readMessageStrict(dst, len(payload), &received); err != nil || string(received) != "hello" {
+		t.Fatal("a message of the expected length should be accepted", err)
+	}
+	if responder.NextMessageSize(0) != MessageSize(Noise_XX, 1, 0) {
+		t.Fatal("the next messages should not carry a timestamp")
+	}
+}
@@ -0,0 +1,54 @@
+package noise
+
+import (
+	"testing"
+)
+
+// fuzzStates returns fresh handshakeStates waiting to read the first message
+// of Noise_XX and Noise_IK, and the second message of Noise_XX, along with
+// valid messages for them.
+func fuzzStates() (states []handshakeState, messages [][]byte) {
+	initiatorKey := GenerateKeypair(&[32]byte{1})
+	responderKey := GenerateKeypair(&[32]byte{2})
+	remoteKey := &KeyPair{PublicKey: responderKey.PublicKey}
+
+	var message []byte
+	initiator := initialize(Noise_XX, true, nil, initiatorKey, nil, nil, nil)
+	initiator.writeMessage([]byte("payload"), &message)
+	states = append(states, initialize(Noise_XX, false, nil, responderKey, nil, nil, nil))
+	messages = append(messages, message)
+
+	message = nil
+	initiator = initialize(Noise_IK, true, nil, initiatorKey, nil, remoteKey, nil)
+	initiator.writeMessage([]byte("payload"), &message)
+	states = append(states, initialize(Noise_IK, false, nil, responderKey, nil, nil, nil))
+	messages = append(messages, message)
+
+	message = nil
+	initiator = initialize(Noise_XX, true, nil, initiatorKey, nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, responderKey, nil, nil, nil)
+	var first, payload []byte
+	initiator.writeMessage(nil, &first)
+	responder.readMessage(first, &payload)
+	responder.writeMessage([]byte("payload"), &message)
+	states = append(states, initiator)
+	messages = append(messages, message)
+
+	return
+}
+
+func FuzzReadMessage(f *testing.F) {
+	states, messages := fuzzStates()
+	for _, message := range messages {
+		f.Add(message)
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, message []byte) {
+		for _, state := range states {
+			// readMessage must never panic, whatever the message
+			h := state.Clone()
+			var payload []byte
+			h.readMessage(message, &payload)
+		}
+	})
+}
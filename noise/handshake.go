@@ -0,0 +1,67 @@
+package noise
+
+import (
+	"errors"
+	"io"
+)
+
+//
+// Handshake over an io.ReadWriter
+//
+
+// DoHandshake runs all the remaining message patterns of a handshakeState
+// over rw. Each handshake message is framed with WriteFrame like in the
+// net.Conn adapter, and carries an empty payload.
+// Depending on the role h was initialized with, each message is written to
+// or read from rw. This allows running a Noise handshake over any transport
+// (a websocket, a pipe, stdin/stdout, ...).
+//
+// The two CipherState objects returned are the ones of the specification:
+// the first one for messages from the initiator to the responder, the second
+// one for messages in the other direction (it must not be used with one-way
+// patterns).
+func DoHandshake(rw io.ReadWriter, h *handshakeState) (c1, c2 *cipherState, err error) {
+	if h.IsHandshakeComplete() {
+		return nil, nil, errors.New("noise: the handshake has already been completed")
+	}
+
+	for !h.IsHandshakeComplete() {
+		if h.shouldWrite {
+			var message []byte
+			c1, c2, err = h.writeMessage(nil, &message)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = WriteFrame(rw, message); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			message, err := readHandshakeMessage(rw)
+			if err != nil {
+				return nil, nil, err
+			}
+			var payload []byte
+			c1, c2, err = h.readMessage(message, &payload)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return c1, c2, nil
+}
+
+// RunHandshake runs the handshake over transport like DoHandshake, and
+// returns a Session set up for the role of h. With one-way patterns, the
+// Session of the initiator can only encrypt and the one of the responder can
+// only decrypt.
+func RunHandshake(h *handshakeState, transport io.ReadWriter) (*Session, error) {
+	c1, c2, err := DoHandshake(transport, h)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns[h.handshakeType].messagePatterns) == 1 {
+		c2 = nil
+	}
+	return newSession(h.initiator, c1, c2), nil
+}
@@ -0,0 +1,121 @@
+package noise
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDoHandshake(t *testing.T) {
+	for _, handshakeType := range []noiseHandshakeType{Noise_XX, Noise_N} {
+		serverKey := GenerateKeypair(nil)
+		remoteKey := &KeyPair{PublicKey: serverKey.PublicKey}
+		var initiator, responder handshakeState
+		if handshakeType == Noise_N {
+			initiator = initialize(handshakeType, true, nil, nil, nil, remoteKey, nil)
+			responder = initialize(handshakeType, false, nil, serverKey, nil, nil, nil)
+		} else {
+			initiator = initialize(handshakeType, true, nil, GenerateKeypair(nil), nil, nil, nil)
+			responder = initialize(handshakeType, false, nil, serverKey, nil, nil, nil)
+		}
+
+		clientPipe, serverPipe := net.Pipe()
+		type result struct {
+			c1, c2 *cipherState
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			c1, c2, err := DoHandshake(serverPipe, &responder)
+			done <- result{c1, c2, err}
+		}()
+
+		c1, _, err := DoHandshake(clientPipe, &initiator)
+		if err != nil {
+			t.Fatal("initiator failed the handshake", err)
+		}
+		r := <-done
+		if r.err != nil {
+			t.Fatal("responder failed the handshake", r.err)
+		}
+		if c1 == nil || r.c1 == nil {
+			t.Fatal("the handshake did not return a cipherState")
+		}
+
+		// initiator -> responder
+		ciphertext, _ := c1.encryptWithAd(nil, []byte("hello"))
+		plaintext, err := r.c1.decryptWithAd(nil, ciphertext)
+		if err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+			t.Fatal("transport message not decrypted correctly", err)
+		}
+
+		// already completed
+		if _, _, err = DoHandshake(clientPipe, &initiator); err == nil {
+			t.Fatal("a completed handshake should not be run again")
+		}
+
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
+
+func TestRunHandshake(t *testing.T) {
+	for _, handshakeType := range []noiseHandshakeType{Noise_XX, Noise_N} {
+		serverKey := GenerateKeypair(nil)
+		var initiator, responder handshakeState
+		if handshakeType == Noise_N {
+			initiator = initialize(handshakeType, true, nil, nil, nil, &KeyPair{PublicKey: serverKey.PublicKey}, nil)
+		} else {
+			initiator = initialize(handshakeType, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		}
+		responder = initialize(handshakeType, false, nil, serverKey, nil, nil, nil)
+
+		clientPipe, serverPipe := net.Pipe()
+		type result struct {
+			session *Session
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			session, err := RunHandshake(&responder, serverPipe)
+			done <- result{session, err}
+		}()
+
+		initiatorSession, err := RunHandshake(&initiator, clientPipe)
+		if err != nil {
+			t.Fatal("initiator failed the handshake", err)
+		}
+		r := <-done
+		if r.err != nil {
+			t.Fatal("responder failed the handshake", r.err)
+		}
+		responderSession := r.session
+
+		ciphertext, err := initiatorSession.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal("initiator cannot encrypt", err)
+		}
+		plaintext, err := responderSession.Decrypt(ciphertext)
+		if err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+			t.Fatal("responder cannot decrypt", err)
+		}
+
+		ciphertext, err = responderSession.Encrypt([]byte("ca va?"))
+		if handshakeType == Noise_N {
+			if err != errNoWriteChannel {
+				t.Fatal("the responder should not encrypt with a one-way pattern", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal("responder cannot encrypt", err)
+			}
+			plaintext, err = initiatorSession.Decrypt(ciphertext)
+			if err != nil || !bytes.Equal(plaintext, []byte("ca va?")) {
+				t.Fatal("initiator cannot decrypt", err)
+			}
+		}
+
+		clientPipe.Close()
+		serverPipe.Close()
+	}
+}
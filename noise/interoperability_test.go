@@ -130,3 +130,60 @@ func TestFlynnNoise(t *testing.T) {
 		return
 	}
 }
+
+func TestFlynnNoiseXXfallback(t *testing.T) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+	// the flynn responder re-uses its ephemeral key pair
+	responderKey, _ := cs.GenerateKeypair(rand.Reader)
+	responderEphemeral, _ := cs.GenerateKeypair(rand.Reader)
+	hsR, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:      cs,
+		Random:           rand.Reader,
+		Pattern:          noise.HandshakeXXfallback,
+		StaticKeypair:    responderKey,
+		EphemeralKeypair: responderEphemeral,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// our initiator knows the ephemeral public key of the responder
+	var remoteEphemeral KeyPair
+	copy(remoteEphemeral.PublicKey[:], responderEphemeral.Public)
+	initiator := initialize(Noise_XXfallback, true, nil, GenerateKeypair(nil), nil, nil, &remoteEphemeral)
+
+	// -> e, ee, s, se
+	var message []byte
+	if _, _, err = initiator.writeMessage([]byte("salut"), &message); err != nil {
+		t.Fatal(err)
+	}
+	payload, _, _, err := hsR.ReadMessage(nil, message)
+	if err != nil || !bytes.Equal(payload, []byte("salut")) {
+		t.Fatal("first message failed", err)
+	}
+
+	// <- s, es
+	message, responderCipherRead, _, err := hsR.WriteMessage(nil, []byte("ca va ?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []byte
+	initiatorCipherWrite, _, err := initiator.readMessage(message, &received)
+	if err != nil || !bytes.Equal(received, []byte("ca va ?")) {
+		t.Fatal("second message failed", err)
+	}
+	if initiatorCipherWrite == nil {
+		t.Fatal("the handshake should be finished")
+	}
+
+	// transport message
+	ciphertext, err := initiatorCipherWrite.encryptWithAd([]byte{}, []byte("hello!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := responderCipherRead.Decrypt(nil, []byte{}, ciphertext)
+	if err != nil || !bytes.Equal(plaintext, []byte("hello!")) {
+		t.Fatal("transport message failed", err)
+	}
+}
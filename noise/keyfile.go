@@ -0,0 +1,139 @@
+package noise
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+//
+// Key files
+//
+
+// The type of the key in the single-line format, and the types of the PEM
+// blocks.
+const (
+	publicKeyLineType          = "noise-25519"
+	publicKeyPEMType           = "NOISE PUBLIC KEY"
+	privateKeyPEMType          = "NOISE PRIVATE KEY"
+	encryptedPrivateKeyPEMType = "ENCRYPTED NOISE PRIVATE KEY"
+)
+
+// parameters of argon2id to derive a key from a passphrase
+const (
+	passphraseSaltLen = 16
+	argon2Time        = 1
+	argon2Memory      = 64 * 1024
+	argon2Threads     = 4
+)
+
+// ErrWrongPassphrase is returned by ParsePrivateKeyPEM when an encrypted
+// private key cannot be decrypted with the passphrase.
+var ErrWrongPassphrase = errors.New("noise: wrong passphrase for the private key")
+
+// EncodePublicKeyLine encodes a static public key on a single line, similar
+// to the authorized_keys files of SSH: "noise-25519 <key in base64> comment".
+// The comment is optional.
+func EncodePublicKeyLine(publicKey [32]byte, comment string) string {
+	line := publicKeyLineType + " " + base64.StdEncoding.EncodeToString(publicKey[:])
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// ParsePublicKeyLine parses a line created by EncodePublicKeyLine.
+func ParsePublicKeyLine(line string) (publicKey [32]byte, comment string, err error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(fields) < 2 || fields[0] != publicKeyLineType {
+		return publicKey, "", errors.New("noise: not a " + publicKeyLineType + " public key")
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(key) != 32 {
+		return publicKey, "", errors.New("noise: invalid public key encoding")
+	}
+	copy(publicKey[:], key)
+	if len(fields) == 3 {
+		comment = fields[2]
+	}
+	return publicKey, comment, nil
+}
+
+// EncodePublicKeyPEM encodes a static public key in a PEM block of type
+// "NOISE PUBLIC KEY".
+func EncodePublicKeyPEM(publicKey [32]byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: publicKey[:]})
+}
+
+// ParsePublicKeyPEM parses the first PEM block of data, created by
+// EncodePublicKeyPEM.
+func ParsePublicKeyPEM(data []byte) (publicKey [32]byte, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != publicKeyPEMType || len(block.Bytes) != 32 {
+		return publicKey, errors.New("noise: no " + publicKeyPEMType + " PEM block found")
+	}
+	copy(publicKey[:], block.Bytes)
+	return publicKey, nil
+}
+
+// EncodePrivateKeyPEM encodes the private part of a static key pair in a PEM
+// block. If passphrase is empty the key is stored in clear in a block of
+// type "NOISE PRIVATE KEY". Otherwise the block is of type "ENCRYPTED NOISE
+// PRIVATE KEY" and the key is encrypted with ChaChaPoly under a key derived
+// from the passphrase with argon2id (the KDF of this package is not meant to
+// be used with low-entropy secrets).
+func EncodePrivateKeyPEM(keyPair *KeyPair, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: keyPair.PrivateKey[:]}), nil
+	}
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := io.ReadFull(randReader, salt); err != nil {
+		return nil, errors.New("noise: cannot generate a salt: " + err.Error())
+	}
+	ciphertext := encrypt(CipherChaChaPoly, passphraseKey(passphrase, salt), 0, []byte(encryptedPrivateKeyPEMType), keyPair.PrivateKey[:])
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedPrivateKeyPEMType, Bytes: append(salt, ciphertext...)}), nil
+}
+
+// ParsePrivateKeyPEM parses the first PEM block of data, created by
+// EncodePrivateKeyPEM, and returns the key pair. The passphrase is only
+// used if the private key is encrypted.
+func ParsePrivateKeyPEM(data, passphrase []byte) (*KeyPair, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("noise: no PEM block found")
+	}
+	var privateKey [32]byte
+	switch block.Type {
+	case privateKeyPEMType:
+		if len(block.Bytes) != 32 {
+			return nil, errors.New("noise: invalid private key")
+		}
+		copy(privateKey[:], block.Bytes)
+	case encryptedPrivateKeyPEMType:
+		if len(block.Bytes) != passphraseSaltLen+32+NoiseTagLength {
+			return nil, errors.New("noise: invalid encrypted private key")
+		}
+		salt := block.Bytes[:passphraseSaltLen]
+		plaintext, err := decrypt(CipherChaChaPoly, passphraseKey(passphrase, salt), 0, []byte(encryptedPrivateKeyPEMType), block.Bytes[passphraseSaltLen:])
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+		copy(privateKey[:], plaintext)
+		for i := range plaintext {
+			plaintext[i] = 0
+		}
+	default:
+		return nil, errors.New("noise: unexpected PEM block of type " + block.Type)
+	}
+	return GenerateKeypair(&privateKey), nil
+}
+
+// passphraseKey derives the key encrypting a private key from a passphrase
+func passphraseKey(passphrase, salt []byte) (key [32]byte) {
+	copy(key[:], argon2.IDKey(passphrase, salt, argon2Time, argon2Memory, argon2Threads, 32))
+	return
+}
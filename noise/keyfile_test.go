@@ -0,0 +1,61 @@
+package noise
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublicKeyLine(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	for _, comment := range []string{"", "alice@laptop", "a comment with spaces"} {
+		line := EncodePublicKeyLine(keyPair.PublicKey, comment)
+		if !strings.HasPrefix(line, "noise-25519 ") {
+			t.Fatal("unexpected format:", line)
+		}
+		publicKey, parsedComment, err := ParsePublicKeyLine(line + "\n")
+		if err != nil || publicKey != keyPair.PublicKey || parsedComment != comment {
+			t.Fatal("the public key line did not round trip", err)
+		}
+	}
+	for _, invalid := range []string{"", "ssh-ed25519 AAAA", "noise-25519 !!!", "noise-25519 AAAA"} {
+		if _, _, err := ParsePublicKeyLine(invalid); err == nil {
+			t.Fatal("an invalid line should be rejected:", invalid)
+		}
+	}
+}
+
+func TestKeyPEM(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+
+	encoded := EncodePublicKeyPEM(keyPair.PublicKey)
+	if !strings.HasPrefix(string(encoded), "-----BEGIN NOISE PUBLIC KEY-----") {
+		t.Fatal("unexpected PEM block:", string(encoded))
+	}
+	if publicKey, err := ParsePublicKeyPEM(encoded); err != nil || publicKey != keyPair.PublicKey {
+		t.Fatal("the public key PEM block did not round trip", err)
+	}
+
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		encoded, err := EncodePrivateKeyPEM(keyPair, []byte(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := strings.Contains(string(encoded), "ENCRYPTED NOISE PRIVATE KEY")
+		if encrypted != (passphrase != "") {
+			t.Fatal("the private key should be encrypted if and only if a passphrase is used")
+		}
+		parsed, err := ParsePrivateKeyPEM(encoded, []byte(passphrase))
+		if err != nil || *parsed != *keyPair {
+			t.Fatal("the private key PEM block did not round trip", err)
+		}
+		if encrypted {
+			if _, err = ParsePrivateKeyPEM(encoded, []byte("wrong")); err != ErrWrongPassphrase {
+				t.Fatal("a wrong passphrase should return ErrWrongPassphrase", err)
+			}
+		}
+	}
+
+	if _, err := ParsePrivateKeyPEM(EncodePublicKeyPEM(keyPair.PublicKey), nil); err == nil {
+		t.Fatal("a public key is not a private key")
+	}
+}
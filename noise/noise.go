@@ -16,8 +16,15 @@ package noise
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/binary"
 	"errors"
+	stdhash "hash"
+	"io"
 	"math"
+	"time"
 )
 
 //
@@ -25,8 +32,9 @@ import (
 //
 
 type cipherState struct {
-	k [32]byte
-	n uint64
+	cipher CipherFunction
+	k      [32]byte
+	n      uint64
 }
 
 func (c *cipherState) initializeKey(key []byte) {
@@ -56,7 +64,7 @@ func (c *cipherState) encryptWithAd(ad, plaintext []byte) (ciphertext []byte, er
 
 	// If k is non-empty returns encrypt(k, n++, ad, plaintext).
 	if c.hasKey() {
-		ciphertext = encrypt(c.k, c.n, ad, plaintext)
+		ciphertext = encrypt(c.cipher, c.k, c.n, ad, plaintext)
 		c.n++
 		return
 	}
@@ -77,7 +85,7 @@ func (c *cipherState) decryptWithAd(ad, ciphertext []byte) (plaintext []byte, er
 
 	// If k is non-empty returns decrypt(k, n++, ad, ciphertext).
 	if c.hasKey() {
-		plaintext, err = decrypt(c.k, c.n, ad, ciphertext)
+		plaintext, err = decrypt(c.cipher, c.k, c.n, ad, ciphertext)
 
 		// If an authentication failure occurs in decrypt() then n is not incremented and an error is signaled to the caller.
 		if err != nil {
@@ -95,9 +103,17 @@ func (c *cipherState) decryptWithAd(ad, ciphertext []byte) (plaintext []byte, er
 	return
 }
 
+// clear erases the key of a cipherState, which can be nil
+func (c *cipherState) clear() {
+	if c != nil {
+		c.k = [32]byte{}
+		c.n = 0
+	}
+}
+
 // TODO: add documentation for public functions, also test this function
 func (c *cipherState) Rekey() {
-	c.k = rekey(c.k)
+	c.k = rekey(c.cipher, c.k)
 }
 
 //
@@ -108,6 +124,37 @@ type symmetricState struct {
 	cipherState cipherState
 	ck          [hashLen]byte
 	h           [hashLen]byte
+
+	// if set, records the operations performed (for auditing)
+	recorder *opRecorder
+}
+
+// symmetricOp is an operation of the SymmetricState object
+type symmetricOp uint8
+
+const (
+	opMixKey symmetricOp = iota
+	opMixHash
+	opMixKeyAndHash
+	opEncryptAndHash
+	opDecryptAndHash
+	opSplit
+)
+
+func (op symmetricOp) String() string {
+	return [...]string{"MixKey", "MixHash", "MixKeyAndHash", "EncryptAndHash", "DecryptAndHash", "Split"}[op]
+}
+
+// opRecorder records the sequence of operations performed on a
+// symmetricState, so that it can be compared to the specification
+type opRecorder struct {
+	ops []symmetricOp
+}
+
+func (r *opRecorder) record(op symmetricOp) {
+	if r != nil {
+		r.ops = append(r.ops, op)
+	}
 }
 
 func (s *symmetricState) initializeSymmetric(protocolName []byte) {
@@ -126,6 +173,7 @@ func (s *symmetricState) initializeSymmetric(protocolName []byte) {
 }
 
 func (s *symmetricState) mixKey(inputKeyMaterial [32]byte) {
+	s.recorder.record(opMixKey)
 
 	output := hkdf(s.ck[:], inputKeyMaterial[:], 2)
 	copy(s.ck[:], output[:hashLen])
@@ -136,16 +184,23 @@ func (s *symmetricState) mixKey(inputKeyMaterial [32]byte) {
 }
 
 func (s *symmetricState) mixHash(data []byte) {
+	s.recorder.record(opMixHash)
+	s.absorb(data)
+}
+
+// absorb implements MixHash without recording it, for the other operations
+func (s *symmetricState) absorb(data []byte) {
 	s.h = hash(append(s.h[:], data...))
 }
 
 func (s *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+	s.recorder.record(opMixKeyAndHash)
 
 	output := hkdf(s.ck[:], inputKeyMaterial, 3)
 
 	copy(s.ck[:], output[:hashLen])
 
-	s.mixHash(output[hashLen : hashLen*2])
+	s.absorb(output[hashLen : hashLen*2])
 
 	// The output of HKDF is taken as is because we use hashLen = 32
 
@@ -155,6 +210,7 @@ func (s *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
 // encrypts the plaintext and authenticates the hash
 // then insert the ciphertext in the running hash
 func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+	s.recorder.record(opEncryptAndHash)
 
 	// Note that if k is empty, the encryptWithAd() call will set ciphertext equal to plaintext.
 	ciphertext, err = s.cipherState.encryptWithAd(s.h[:], plaintext)
@@ -163,13 +219,14 @@ func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, er
 		return
 	}
 
-	s.mixHash(ciphertext)
+	s.absorb(ciphertext)
 
 	return
 }
 
 // decrypts the ciphertext and authenticates the hash
 func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	s.recorder.record(opDecryptAndHash)
 
 	// Note that if k is empty, the decryptWithAd() call will set plaintext equal to ciphertext.
 	plaintext, err = s.cipherState.decryptWithAd(s.h[:], ciphertext)
@@ -178,14 +235,15 @@ func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, er
 		return
 	}
 
-	s.mixHash(ciphertext)
+	s.absorb(ciphertext)
 
 	return
 }
 
 func (s symmetricState) Split() (c1, c2 *cipherState) {
-	c1 = new(cipherState)
-	c2 = new(cipherState)
+	s.recorder.record(opSplit)
+	c1 = &cipherState{cipher: s.cipherState.cipher}
+	c2 = &cipherState{cipher: s.cipherState.cipher}
 	output := hkdf(s.ck[:], []byte{}, 2)
 	// The output of HKDF is taken as is because we use hashLen = 32
 	c1.initializeKey(output[:hashLen])
@@ -197,11 +255,17 @@ func (s symmetricState) Split() (c1, c2 *cipherState) {
 // HandshakeState object
 //
 
+// handshakeState is not safe for concurrent use: the handshake messages are
+// written and read in turns, by a single goroutine. Once the handshake is
+// completed, the CipherState objects it returns can be used from different
+// goroutines, see Session and NewHalfSessions.
 type handshakeState struct {
 	// the symmetricState object
 	symmetricState symmetricState
+	// the handshake pattern used
+	handshakeType noiseHandshakeType
 	/* Empty is a special value which indicates the variable has not yet been initialized.
-	we'll use KeyPair.privateKey = 0 as Empty
+	we use an all-zero KeyPair as Empty, see KeyPair.isEmpty()
 	*/
 	s  KeyPair // The local static key pair
 	e  KeyPair // The local ephemeral key pair
@@ -221,113 +285,423 @@ type handshakeState struct {
 	// pre-shared key
 	psk []byte
 
+	// if true, ephemeral keys are encoded with Elligator 2
+	obfuscateEphemeral bool
+
+	// labels used to derive the transport keys, see split
+	splitLabels [2][]byte
+
+	// if true, payloads can only be sent in the messages returned by
+	// SafePayloadMessages
+	enforceSafePayloads bool
+
+	// set when a message could not be read, see ErrHandshakeFailed
+	failed bool
+	// set once the last message has been processed, see IsHandshakeComplete
+	completed bool
+
+	// number of messages processed, and the same counter shared by all the
+	// copies of the handshakeState, see checkGeneration
+	generation       uint64
+	sharedGeneration *uint64
+
+	// if true, payloads are encoded as described in compression.go
+	compressPayloads bool
+
+	// if true, received public keys must be canonical, see Config.StrictEncoding
+	strictEncoding bool
+
+	// if not zero, the first message carries a timestamp, see freshness.go
+	freshness time.Duration
+
+	// if set, the source of randomness of the ephemeral keys, see Config.Rand
+	rand io.Reader
+	// if true, see Config.HedgedEphemerals
+	hedgedEphemerals bool
+
+	// if set, the result of the ss DH, see PrecomputeStaticShared
+	staticShared [32]byte
+
+	// if set, the static key the remote peer must send, see
+	// Config.ExpectedRemoteStatic
+	expectedRemoteStatic [32]byte
+
+	// the hash of h and of the prologue received so far, nil once the
+	// pre-messages have been processed (see AddPrologue)
+	prologue    stdhash.Hash
+	prologueLen int
+
 	// for test vectors
 	debugEphemeral *KeyPair
 }
 
+// checkKeys verifies that the keys required by a handshake pattern for a given
+// role have been supplied, and that static keys are not re-used as ephemeral keys.
+func checkKeys(handshakePattern handshakePattern, initiator bool, s, e, rs, re *KeyPair) error {
+	if handshakePattern.requiresLocalStatic(initiator) && (s == nil || s.isEmpty()) {
+		return errors.New("noise: pattern " + handshakePattern.name + " requires a local static key")
+	}
+	if handshakePattern.requiresRemoteStatic(initiator) && (rs == nil || rs.isEmpty()) {
+		return errors.New("noise: pattern " + handshakePattern.name + " requires a remote static key")
+	}
+	if handshakePattern.requiresLocalEphemeral(initiator) && (e == nil || e.isEmpty()) {
+		return errors.New("noise: pattern " + handshakePattern.name + " requires a local ephemeral key")
+	}
+	if handshakePattern.requiresRemoteEphemeral(initiator) && (re == nil || re.isEmpty()) {
+		return errors.New("noise: pattern " + handshakePattern.name + " requires a remote ephemeral key")
+	}
+	if s != nil && e != nil && !s.isEmpty() && s.PrivateKey == e.PrivateKey {
+		return ErrKeyReuse
+	}
+	if rs != nil && re != nil && !rs.isEmpty() && rs.PublicKey == re.PublicKey {
+		return ErrKeyReuse
+	}
+	return nil
+}
+
+// ErrKeyReuse is returned when the same key is supplied as a static key and as
+// an ephemeral key, which would break the security of the handshake.
+var ErrKeyReuse = errors.New("noise: the same key cannot be used as a static and an ephemeral key")
+
+// NewHandshake creates a handshakeState from a Config, for an initiator or a
+// responder. Unlike initialize, it verifies that the configuration contains
+// the keys required by the handshake pattern before doing anything, and
+// returns an error if it does not.
+func NewHandshake(config *Config, initiator bool) (*handshakeState, error) {
+	if config == nil {
+		return nil, errors.New("noise: no Config set")
+	}
+	var rs *KeyPair
+	if config.RemoteKey != nil {
+		if len(config.RemoteKey) != 32 {
+			return nil, errors.New("noise: the provided remote key is not 32-byte")
+		}
+		rs = &KeyPair{}
+		copy(rs.PublicKey[:], config.RemoteKey)
+	}
+	h, err := newHandshakeState(config.HandshakePattern, config.ProtocolName, config.Cipher, initiator, config.Prologue, config.KeyPair, nil, rs, nil)
+	if err != nil {
+		return nil, err
+	}
+	if patterns[config.HandshakePattern].usesPsk() && len(config.PreSharedKey) != 32 {
+		return nil, errors.New("noise: pattern " + patterns[config.HandshakePattern].name + " requires a 32-byte pre-shared key")
+	}
+	h.psk = config.PreSharedKey
+	h.obfuscateEphemeral = config.ObfuscateEphemeral
+	h.splitLabels = config.SplitLabels
+	h.enforceSafePayloads = config.EnforceSafePayloads
+	h.rand = config.Rand
+	h.compressPayloads = config.PayloadCompression
+	h.staticShared = config.StaticShared
+	h.expectedRemoteStatic = config.ExpectedRemoteStatic
+	h.strictEncoding = config.StrictEncoding
+	h.hedgedEphemerals = config.HedgedEphemerals
+	return &h, nil
+}
+
 // This allows you to initialize a peer.
 // * see `patterns` for a list of available handshakePatterns
 // * initiator = false means the instance is for a responder
 // * prologue is a byte string record of anything that happened prior the Noise handshakeState
 // * s, e, rs, re are the local and remote static/ephemeral key pairs to be set (if they exist)
-// the function returns a handshakeState object.
-func initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState) {
+// if e is set, it is used instead of generating a new ephemeral key pair
+// the function returns a handshakeState object, and panics if the keys required
+// by the handshake pattern are not set. See NewHandshake for a version returning
+// an error.
+func initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair) handshakeState {
+	h, err := newHandshakeState(handshakeType, "", CipherChaChaPoly, initiator, prologue, s, e, rs, re)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// newHandshakeState implements initialize and NewHandshake. If protocolName
+// is empty, the protocol name of the specification is used.
+func newHandshakeState(handshakeType noiseHandshakeType, protocolName string, cipher CipherFunction, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState, err error) {
 	handshakePattern, ok := patterns[handshakeType]
 	if !ok {
-		panic("Noise: the supplied handshakePattern does not exist")
+		return h, ErrUnknownPattern
+	}
+	if err = checkKeys(handshakePattern, initiator, s, e, rs, re); err != nil {
+		return
 	}
 
-	h.symmetricState.initializeSymmetric([]byte("Noise_" + handshakePattern.name + "_25519_ChaChaPoly_SHA256"))
+	if len(prologue) > MaxPrologueLength {
+		return h, errPrologueTooLong
+	}
 
-	h.symmetricState.mixHash(prologue)
+	if cipher != CipherChaChaPoly && cipher != CipherAESGCM {
+		return h, errors.New("noise: unknown cipher function")
+	}
+	if protocolName == "" {
+		protocolName = handshakePattern.protocolName(cipher)
+	}
+	if err = checkMacLenSuffix(protocolName); err != nil {
+		return
+	}
+	h.symmetricState.initializeSymmetric([]byte(protocolName))
+	h.symmetricState.cipherState.cipher = cipher
+
+	// MixHash(prologue) is computed in a streaming fashion, more of the
+	// prologue can be added via AddPrologue until the first message
+	h.prologue = sha256.New()
+	h.prologue.Write(h.symmetricState.h[:])
+	h.prologue.Write(prologue)
+	h.prologueLen = len(prologue)
 
 	if s != nil {
 		h.s = *s
 	}
 	if e != nil {
-		panic("Noise: fallback patterns are not implemented")
+		h.e = *e
 	}
 	if rs != nil {
 		h.rs = *rs
 	}
 	if re != nil {
-		panic("Noise: fallback patterns are not implemented")
+		h.re = *re
 	}
 
+	h.handshakeType = handshakeType
 	h.initiator = initiator
 	h.shouldWrite = initiator
+	h.messagePatterns = handshakePattern.messagePatterns
+
+	return
+}
+
+// MaxPrologueLength is the maximum length of a prologue, including all the
+// chunks added via AddPrologue.
+const MaxPrologueLength = 1 << 24
+
+var errPrologueTooLong = errors.New("noise: the prologue is too long")
+
+// AddPrologue appends a chunk to the prologue. It can be called several times
+// before the first call to writeMessage or readMessage, which allows binding
+// a large transcript without buffering it. Adding a prologue in several chunks
+// is equivalent to passing their concatenation as a single prologue.
+func (h *handshakeState) AddPrologue(chunk []byte) error {
+	if h.prologue == nil {
+		return errors.New("noise: the prologue cannot be modified once the handshake has started")
+	}
+	if len(chunk) > MaxPrologueLength-h.prologueLen {
+		return errPrologueTooLong
+	}
+	h.prologue.Write(chunk)
+	h.prologueLen += len(chunk)
+	return nil
+}
+
+// AddPrologueTagged appends a segment of data to the prologue, prefixed by a
+// tag identifying the layer of the protocol that adds it. The tag and the
+// data are both length-prefixed (on 2 and 4 bytes, big-endian), so that the
+// segments of different layers cannot be confused with each other, unlike
+// chunks added with AddPrologue. Both peers must add the same segments in the
+// same order.
+func (h *handshakeState) AddPrologueTagged(tag string, data []byte) error {
+	if len(tag) > math.MaxUint16 {
+		return errors.New("noise: the prologue tag is too long")
+	}
+	if len(data) > MaxPrologueLength-h.prologueLen-6-len(tag) {
+		return errPrologueTooLong
+	}
+	segment := make([]byte, 0, 6+len(tag))
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(tag)))
+	segment = append(segment, tag...)
+	segment = binary.BigEndian.AppendUint32(segment, uint32(len(data)))
+	if err := h.AddPrologue(segment); err != nil {
+		return err
+	}
+	return h.AddPrologue(data)
+}
+
+// finishPrologue ends the prologue and processes the pre-messages. It is
+// called before the first message is written or read.
+func (h *handshakeState) finishPrologue() error {
+	if h.prologue == nil {
+		return nil
+	}
+	copy(h.symmetricState.h[:], h.prologue.Sum(nil))
+	h.prologue = nil
+	h.symmetricState.recorder.record(opMixHash)
+
+	handshakePattern := patterns[h.handshakeType]
+	initiator := h.initiator
 
 	//Calls MixHash() once for each public key listed in the pre-messages from handshake_pattern, with the specified public key as input (see Section 7 for an explanation of pre-messages). If both initiator and responder have pre-messages, the initiator's public keys are hashed first.
+	// Ephemeral public keys are also used to call MixKey() if the handshake makes use of a pre-shared key.
+
+	psk := handshakePattern.usesPsk()
 
 	// initiator pre-message pattern
 	for _, token := range handshakePattern.preMessagePatterns[0] {
-		if token == token_s {
+		switch token {
+		case token_s:
 			if initiator {
-				if s == nil {
-					panic("Noise: the static key of the client should be set")
-				}
-				h.symmetricState.mixHash(s.PublicKey[:])
+				h.symmetricState.mixHash(h.s.PublicKey[:])
 			} else {
-				if rs == nil {
-					panic("Noise: the remote static key of the server should be set")
-				}
-				h.symmetricState.mixHash(rs.PublicKey[:])
+				h.symmetricState.mixHash(h.rs.PublicKey[:])
+			}
+		case token_e:
+			if initiator {
+				h.mixPreMessageEphemeral(h.e.PublicKey, psk)
+			} else {
+				h.mixPreMessageEphemeral(h.re.PublicKey, psk)
 			}
-		} else {
-			panic("Noise: token of pre-message not supported")
+		default:
+			return errors.New("noise: token of pre-message not supported")
 		}
 	}
 
 	// responder pre-message pattern
 	for _, token := range handshakePattern.preMessagePatterns[1] {
-		if token == token_s {
+		switch token {
+		case token_s:
 			if initiator {
-				if rs == nil {
-					panic("Noise: the remote static key of the client should be set")
-				}
-				h.symmetricState.mixHash(rs.PublicKey[:])
+				h.symmetricState.mixHash(h.rs.PublicKey[:])
 			} else {
-				if s == nil {
-					panic("Noise: the static key of the server should be set")
-				}
-				h.symmetricState.mixHash(s.PublicKey[:])
+				h.symmetricState.mixHash(h.s.PublicKey[:])
 			}
-		} else {
-			panic("Noise: token of pre-message not supported")
+		case token_e:
+			if initiator {
+				h.mixPreMessageEphemeral(h.re.PublicKey, psk)
+			} else {
+				h.mixPreMessageEphemeral(h.e.PublicKey, psk)
+			}
+		default:
+			return errors.New("noise: token of pre-message not supported")
 		}
 	}
 
-	h.messagePatterns = handshakePattern.messagePatterns
+	return nil
+}
 
-	return
+// mixPreMessageEphemeral processes an ephemeral public key of a pre-message
+func (h *handshakeState) mixPreMessageEphemeral(publicKey [32]byte, psk bool) {
+	h.symmetricState.mixHash(publicKey[:])
+	if psk {
+		h.symmetricState.mixKey(publicKey)
+	}
+}
+
+// mixDH calls MixKey with the result of a DH between a local key pair and a
+// remote public key.
+func (h *handshakeState) mixDH(keyPair KeyPair, publicKey [32]byte) error {
+	shared, err := dh(keyPair, publicKey)
+	if err != nil {
+		return err
+	}
+	h.symmetricState.mixKey(shared)
+	return nil
 }
 
+// mixStaticDH processes the ss token, with the precomputed DH if there is one
+func (h *handshakeState) mixStaticDH() error {
+	if h.staticShared != [32]byte{} {
+		h.symmetricState.mixKey(h.staticShared)
+		return nil
+	}
+	return h.mixDH(h.s, h.rs.PublicKey)
+}
+
+// writeMessage writes the next handshake message, with its payload, to
+// messageBuffer. Once a key has been established, the payload is always
+// encrypted, even if it is empty: the message then ends with a 16-byte
+// authentication tag. For example the last message of Noise_XX without
+// payload is made of the encrypted static key (48 bytes) followed by the
+// 16-byte tag of the empty payload. This is required by the specification.
 // TODO: pointer to a slice as argument!
 func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1, c2 *cipherState, err error) {
+	return h.writeMessagePayload(payload, false, messageBuffer)
+}
+
+// writeCompressedMessage is like writeMessage, but deflates the payload when
+// payload compression is enabled (see Config.PayloadCompression). Only
+// payloads that do not mix secret data with data an attacker can influence
+// must be written with it.
+func (h *handshakeState) writeCompressedMessage(payload []byte, messageBuffer *[]byte) (c1, c2 *cipherState, err error) {
+	if !h.compressPayloads {
+		return nil, nil, errors.New("noise: payload compression is not enabled")
+	}
+	return h.writeMessagePayload(payload, true, messageBuffer)
+}
+
+// writeMessagePayload implements writeMessage and writeCompressedMessage
+func (h *handshakeState) writeMessagePayload(payload []byte, compress bool, messageBuffer *[]byte) (c1, c2 *cipherState, err error) {
+	if h.failed {
+		return nil, nil, ErrHandshakeFailed
+	}
+	if err = h.checkGeneration(); err != nil {
+		return
+	}
 	// is it our turn to write?
 	if !h.shouldWrite {
-		panic("Noise: unexpected call to WriteMessage should be ReadMessage")
+		return nil, nil, ErrWrongRole
 	}
 	// do we have a token to process?
 	if len(h.messagePatterns) == 0 || len(h.messagePatterns[0]) == 0 {
 		panic("Noise: no more tokens or message patterns to write")
 	}
+	if h.enforceSafePayloads && len(payload) > 0 && !isSafePayloadMessage(h.handshakeType, len(patterns[h.handshakeType].messagePatterns)-len(h.messagePatterns)) {
+		return nil, nil, ErrEarlyPayload
+	}
+	if h.initiator && h.sendsFreshness() {
+		if payload, err = addFreshness(h.rand, payload); err != nil {
+			return
+		}
+	}
+	if h.compressPayloads {
+		if payload, err = encodePayload(payload, compress); err != nil {
+			return
+		}
+	}
+	if err = h.finishPrologue(); err != nil {
+		return
+	}
+
+	// allocate the whole message at once
+	if size := messageSize(h.messagePatterns[0], h.symmetricState.cipherState.hasKey(), len(h.psk) > 0, len(payload)); cap(*messageBuffer)-len(*messageBuffer) < size {
+		buffer := make([]byte, len(*messageBuffer), len(*messageBuffer)+size)
+		copy(buffer, *messageBuffer)
+		*messageBuffer = buffer
+	}
 
 	// process the patterns
-	for _, pattern := range h.messagePatterns[0] {
+	for position, pattern := range h.messagePatterns[0] {
 
 		switch pattern {
 		default:
-			panic("Noise: token not recognized")
+			return nil, nil, h.unknownTokenError(position, pattern)
 		case token_e:
 			// debug
 			if h.debugEphemeral != nil {
 				h.e = *h.debugEphemeral
-			} else {
-				h.e = *GenerateKeypair(nil)
+			} else if h.e.isEmpty() {
+				r := h.rand
+				if h.hedgedEphemerals {
+					r = &hedgedReader{r: h.rand, key: h.s.PrivateKey[:], transcript: h.symmetricState.h[:]}
+				}
+				var e *KeyPair
+				if h.obfuscateEphemeral {
+					e, err = newRepresentableEphemeral(r)
+				} else {
+					e, err = newEphemeral(r)
+				}
+				if err != nil {
+					return
+				}
+				h.e = *e
+			}
+			// the representative of the key is sent and hashed instead
+			wire := h.e.PublicKey
+			if h.obfuscateEphemeral {
+				if wire, err = obfuscatedEphemeral(h.rand, h.e.PublicKey); err != nil {
+					return
+				}
 			}
-			*messageBuffer = append(*messageBuffer, h.e.PublicKey[:]...)
-			h.symmetricState.mixHash(h.e.PublicKey[:])
+			*messageBuffer = append(*messageBuffer, wire[:]...)
+			h.symmetricState.mixHash(wire[:])
 			if len(h.psk) > 0 {
 				h.symmetricState.mixKey(h.e.PublicKey)
 			}
@@ -340,24 +714,36 @@ func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1
 			*messageBuffer = append(*messageBuffer, ciphertext...)
 
 		case token_ee:
-			h.symmetricState.mixKey(dh(h.e, h.re.PublicKey))
+			if err = h.mixDH(h.e, h.re.PublicKey); err != nil {
+				return
+			}
 
 		case token_es:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				if err = h.mixDH(h.e, h.rs.PublicKey); err != nil {
+					return
+				}
 			} else {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				if err = h.mixDH(h.s, h.re.PublicKey); err != nil {
+					return
+				}
 			}
 
 		case token_se:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				if err = h.mixDH(h.s, h.re.PublicKey); err != nil {
+					return
+				}
 			} else {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				if err = h.mixDH(h.e, h.rs.PublicKey); err != nil {
+					return
+				}
 			}
 
 		case token_ss:
-			h.symmetricState.mixKey(dh(h.s, h.rs.PublicKey))
+			if err = h.mixStaticDH(); err != nil {
+				return
+			}
 		case token_psk:
 			h.symmetricState.mixKeyAndHash(h.psk)
 		}
@@ -375,7 +761,7 @@ func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1
 	if len(h.messagePatterns) == 1 {
 		// If there are no more message patterns returns two new CipherState objects
 		h.messagePatterns = nil
-		c1, c2 = h.symmetricState.Split()
+		c1, c2 = h.split()
 	} else {
 		// remove the pattern from the messagePattern
 		h.messagePatterns = h.messagePatterns[1:]
@@ -387,83 +773,415 @@ func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1
 	return
 }
 
+// ErrBufferTooSmall is returned by writeMessageInto when the handshake
+// message does not fit in the buffer.
+var ErrBufferTooSmall = errors.New("noise: the buffer is too small for the handshake message")
+
+// errPayloadCompressed is returned by the functions that need the length of
+// the payload on the wire, which is unknown once it can be deflated
+var errPayloadCompressed = errors.New("noise: the length of the payload is not known with payload compression")
+
+// payloadOverhead returns the number of bytes added to the payload of the
+// next message by the encodings of the handshakeState: the timestamp of the
+// first message (see freshness.go) and the byte prefixing raw payloads with
+// payload compression (see compression.go)
+func (h *handshakeState) payloadOverhead() int {
+	overhead := 0
+	if h.sendsFreshness() {
+		overhead += freshnessLen
+	}
+	if h.compressPayloads {
+		overhead++
+	}
+	return overhead
+}
+
+// sendsFreshness returns true if the next message is the first one and
+// carries a timestamp, see Builder.WithFreshness
+func (h *handshakeState) sendsFreshness() bool {
+	return h.freshness > 0 && len(patterns[h.handshakeType].messagePatterns) == len(h.messagePatterns)
+}
+
+// NextMessageSize returns the length of the next handshake message when it
+// is written with writeMessage and carries a payload of payloadLen bytes.
+// Unlike MessageSize, it includes the encodings enabled by the configuration
+// of the handshakeState. Like the first message, it ends the prologue. It
+// returns -1 once the handshake is completed.
+func (h *handshakeState) NextMessageSize(payloadLen int) int {
+	if len(h.messagePatterns) == 0 || h.finishPrologue() != nil {
+		return -1
+	}
+	return messageSize(h.messagePatterns[0], h.symmetricState.cipherState.hasKey(), len(h.psk) > 0, payloadLen+h.payloadOverhead())
+}
+
+// writeMessageInto is like writeMessage, but writes the handshake message at
+// the start of dst and returns its length instead of appending it to a slice
+// that might need to grow. The size of the message is computed beforehand
+// (see NextMessageSize) and ErrBufferTooSmall is returned if dst is too
+// small, in which case the handshakeState is not modified.
+func (h *handshakeState) writeMessageInto(dst, payload []byte) (n int, c1, c2 *cipherState, err error) {
+	if h.shouldWrite && len(h.messagePatterns) > 0 {
+		if err = h.finishPrologue(); err != nil {
+			return
+		}
+		if len(dst) < h.NextMessageSize(len(payload)) {
+			return 0, nil, nil, ErrBufferTooSmall
+		}
+	}
+	message := dst[:0:len(dst)]
+	c1, c2, err = h.writeMessage(payload, &message)
+	// the message did not fit and was written to another buffer, which
+	// should not happen as its size is computed beforehand
+	if err == nil && len(message) > 0 && &message[0] != &dst[0] {
+		return 0, nil, nil, ErrBufferTooSmall
+	}
+	return len(message), c1, c2, err
+}
+
+// readMessageTo is like readMessage, but writes the payload to payloadDst
+// instead of appending it to a slice. The payload is decrypted in an internal
+// buffer and only written once the message has been authenticated: nothing is
+// written to payloadDst if readMessage fails. An error returned by payloadDst
+// is returned as is, after the handshakeState has processed the message.
+func (h *handshakeState) readMessageTo(message []byte, payloadDst io.Writer) (c1, c2 *cipherState, err error) {
+	var payload []byte
+	if c1, c2, err = h.readMessage(message, &payload); err != nil {
+		return
+	}
+	if len(payload) > 0 {
+		_, err = payloadDst.Write(payload)
+	}
+	return
+}
+
+// split calls Split on the symmetricState. If labels are set, each key is
+// then derived again as HMAC-HASH(key, label) where the first label is used
+// for the initiator to responder key and the second one for the other
+// direction.
+func (h *handshakeState) split() (c1, c2 *cipherState) {
+	h.completed = true
+	c1, c2 = h.symmetricState.Split()
+	if h.splitLabels[0] != nil || h.splitLabels[1] != nil {
+		c1.initializeKey(hmacHash(c1.k[:], h.splitLabels[0]))
+		c2.initializeKey(hmacHash(c2.k[:], h.splitLabels[1]))
+	}
+	return
+}
+
+// IsHandshakeComplete returns true once the last handshake message has been
+// written or read, which is when writeMessage and readMessage return the
+// CipherState objects instead of nil. It is false for a failed handshake.
+func (h *handshakeState) IsHandshakeComplete() bool {
+	return h.completed
+}
+
+// A HandshakeAction is the next operation expected from a peer, see
+// NextAction.
+type HandshakeAction int8
+
+// The actions returned by NextAction.
+const (
+	// the handshake is completed or has failed
+	ActionNone HandshakeAction = iota
+	// the next message must be written with writeMessage
+	ActionWrite
+	// the next message must be read with readMessage
+	ActionRead
+)
+
+func (a HandshakeAction) String() string {
+	switch a {
+	case ActionWrite:
+		return "write"
+	case ActionRead:
+		return "read"
+	default:
+		return "none"
+	}
+}
+
+// NextAction returns whether the next handshake message must be written or
+// read, and its direction in the notation of the specification: "->" for a
+// message sent by the initiator, "<-" for a message sent by the responder.
+// It returns ActionNone and an empty direction once the handshake is
+// completed (see IsHandshakeComplete) or has failed.
+func (h *handshakeState) NextAction() (action HandshakeAction, direction string) {
+	if h.failed || h.completed || len(h.messagePatterns) == 0 {
+		return ActionNone, ""
+	}
+	action = ActionRead
+	if h.shouldWrite {
+		action = ActionWrite
+	}
+	if h.shouldWrite == h.initiator {
+		return action, "->"
+	}
+	return action, "<-"
+}
+
+// ErrTrailingData is returned by readMessageStrict when a handshake message
+// is longer than expected.
+var ErrTrailingData = errors.New("noise: the handshake message contains trailing data")
+
+// unknownTokenError returns the error for an unexpected token at a position
+// of the current message pattern.
+func (h *handshakeState) unknownTokenError(position int, t token) error {
+	handshakePattern := patterns[h.handshakeType]
+	return &UnknownTokenError{
+		MessageIndex: len(handshakePattern.messagePatterns) - len(h.messagePatterns),
+		Position:     position,
+		Token:        t.String(),
+		Pattern:      handshakePattern.name,
+	}
+}
+
+// readMessageStrict is like readMessage, but verifies that the message has
+// exactly the length expected from its message pattern and from the length
+// of its payload (payloadLen, 0 for messages carrying no payload). Otherwise
+// additional bytes would make their way into the payload.
+func (h *handshakeState) readMessageStrict(message []byte, payloadLen int, payloadBuffer *[]byte) (c1, c2 *cipherState, err error) {
+	if !h.failed && !h.shouldWrite && len(h.messagePatterns) > 0 {
+		// the message is rejected before modifying the state, which can
+		// still be used
+		if err = h.finishPrologue(); err != nil {
+			return
+		}
+		if h.compressPayloads {
+			return nil, nil, errPayloadCompressed
+		}
+		if len(message) > h.NextMessageSize(payloadLen) {
+			return nil, nil, ErrTrailingData
+		}
+	}
+	return h.readMessage(message, payloadBuffer)
+}
+
+// PayloadLen returns the length of the plaintext payload that message, the
+// next handshake message to be read, carries. It is computed from the
+// message pattern and the length of the message without decrypting
+// anything, and can be used to allocate the payload buffer of readMessage.
+// It returns an error if the message is too short for its message pattern,
+// or if payload compression is enabled.
+func (h *handshakeState) PayloadLen(message []byte) (int, error) {
+	if h.shouldWrite || len(h.messagePatterns) == 0 {
+		return 0, errors.New("noise: no handshake message to read")
+	}
+	if h.compressPayloads {
+		return 0, errPayloadCompressed
+	}
+	if err := h.finishPrologue(); err != nil {
+		return 0, err
+	}
+	overhead := h.NextMessageSize(0)
+	if len(message) < overhead {
+		return 0, errors.New("noise: the handshake message is too short")
+	}
+	return len(message) - overhead, nil
+}
+
+// ErrHandshakeFailed is returned by all the calls to writeMessage and
+// readMessage following a failure of readMessage: the handshakeState has
+// then been partially updated with the content of the invalid message and
+// cannot be used anymore. Clone can be used beforehand to try reading a
+// message without losing the handshakeState.
+var ErrHandshakeFailed = errors.New("noise: the handshake failed and cannot be continued")
+
+// ErrResponderAuthFailed is returned by readMessage when the initiator cannot
+// decrypt the first message of the responder, in handshake patterns where
+// the static key of the responder is known beforehand (like IK). As the first
+// message of the initiator is encrypted to this key, only its owner can
+// reply: this usually means that the initiator reached the wrong server, or
+// a server using another key. Note that a message corrupted in transit fails
+// in the same way: the two cases are cryptographically indistinguishable.
+var ErrResponderAuthFailed = errors.New("noise: the responder could not prove that it owns the expected static key")
+
+// authenticatesResponder returns true if the next message read is the first
+// message of the responder and the responder's static key was known before
+// the handshake, so that the keys of the message depend on it
+func (h *handshakeState) authenticatesResponder() bool {
+	handshakePattern := patterns[h.handshakeType]
+	if !h.initiator || len(handshakePattern.messagePatterns)-len(h.messagePatterns) != 1 {
+		return false
+	}
+	for _, token := range handshakePattern.preMessagePatterns[1] {
+		if token == token_s {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrStateCopied is returned by writeMessage and readMessage when the
+// handshakeState is a copy of another one (for example a struct embedding it
+// copied by value) and one of the two has already processed a message since
+// the copy was made. The two copies would otherwise diverge and fail later
+// with errors that are hard to understand. Use Clone to copy a
+// handshakeState on purpose.
+var ErrStateCopied = errors.New("noise: the handshakeState was copied and used after the copy")
+
+// checkGeneration verifies that no copy of the handshakeState has processed a
+// message since the copy, and counts a new message. Copies share the counter
+// pointed to by sharedGeneration, which is allocated on the first message:
+// the one that falls behind is the one that was not used.
+func (h *handshakeState) checkGeneration() error {
+	if h.sharedGeneration == nil {
+		h.sharedGeneration = new(uint64)
+		*h.sharedGeneration = h.generation
+	}
+	if *h.sharedGeneration != h.generation {
+		return ErrStateCopied
+	}
+	h.generation++
+	*h.sharedGeneration = h.generation
+	return nil
+}
+
+// fail marks the handshakeState as failed and erases its keys
+func (h *handshakeState) fail() {
+	h.failed = true
+	h.clear()
+}
+
 // ReadMessage takes a byte sequence containing a Noise handshake message,
 // and a payload_buffer to write the message's plaintext payload into.
 // TODO: a pointer to a slice? that should not be!
 func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1, c2 *cipherState, err error) {
+	if h.failed {
+		return nil, nil, ErrHandshakeFailed
+	}
+	if err = h.checkGeneration(); err != nil {
+		return
+	}
 	// is it our turn to read?
 	if h.shouldWrite {
-		panic("Noise: unexpected call to ReadMessage should be WriteMessage")
+		return nil, nil, ErrWrongRole
 	}
 	// do we have a token to process?
 	if len(h.messagePatterns) == 0 || len(h.messagePatterns[0]) == 0 {
 		panic("Noise: no more message pattern to read")
 	}
+	if err = h.finishPrologue(); err != nil {
+		return
+	}
+	if len(message) == 0 && messageSize(h.messagePatterns[0], h.symmetricState.cipherState.hasKey(), len(h.psk) > 0, 0) > 0 {
+		return nil, nil, h.messageError(ErrEmptyMessage)
+	}
+	// a message that cannot be read leaves the state partially updated
+	defer func() {
+		if err != nil {
+			h.fail()
+		}
+	}()
+	authenticatesResponder := h.authenticatesResponder()
 
 	// process the patterns
 	offset := 0
 
-	for _, pattern := range h.messagePatterns[0] {
+	for position, pattern := range h.messagePatterns[0] {
 
 		switch pattern {
 		default:
-			panic("noise: token not recognized")
+			return nil, nil, h.unknownTokenError(position, pattern)
 		case token_e:
 			if len(message[offset:]) < dhLen {
-				return nil, nil, errors.New("noise: the received ephemeral key is to short")
+				return nil, nil, h.messageError(ErrShortMessage)
 			}
 			copy(h.re.PublicKey[:], message[offset:offset+dhLen])
 			offset += dhLen
+			// a representative is not a point, it is decoded to a canonical one
+			if h.strictEncoding && !h.obfuscateEphemeral && !isCanonicalKey(h.re.PublicKey) {
+				return nil, nil, ErrNonCanonicalKey
+			}
 			h.symmetricState.mixHash(h.re.PublicKey[:])
+			if h.obfuscateEphemeral {
+				h.re.PublicKey = elligatorPublicKey(h.re.PublicKey)
+			}
 			if len(h.psk) > 0 {
 				h.symmetricState.mixKey(h.re.PublicKey)
 			}
 		case token_s:
 			tagLen := 0
 			if h.symmetricState.cipherState.hasKey() {
-				tagLen = 16
+				tagLen = NoiseTagLength
 			}
 			if len(message[offset:]) < dhLen+tagLen {
-				return nil, nil, errors.New("noise: the received static key is to short")
+				return nil, nil, h.messageError(ErrShortMessage)
 			}
 			var plaintext []byte
 			plaintext, err = h.symmetricState.decryptAndHash(message[offset : offset+dhLen+tagLen])
 			if err != nil {
-				return
+				if authenticatesResponder {
+					return nil, nil, ErrResponderAuthFailed
+				}
+				return nil, nil, h.messageError(err)
 			}
-			// if we already know the remote static, compare
 			copy(h.rs.PublicKey[:], plaintext)
 			offset += dhLen + tagLen
+			if h.strictEncoding && !isCanonicalKey(h.rs.PublicKey) {
+				return nil, nil, ErrNonCanonicalKey
+			}
+			// a pinned key is checked before being used in a DH
+			if h.expectedRemoteStatic != [32]byte{} && subtle.ConstantTimeCompare(h.rs.PublicKey[:], h.expectedRemoteStatic[:]) != 1 {
+				return nil, nil, ErrPinMismatch
+			}
 
 		case token_ee:
-			h.symmetricState.mixKey(dh(h.e, h.re.PublicKey))
+			if err = h.mixDH(h.e, h.re.PublicKey); err != nil {
+				return
+			}
 
 		case token_es:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				if err = h.mixDH(h.e, h.rs.PublicKey); err != nil {
+					return
+				}
 			} else {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				if err = h.mixDH(h.s, h.re.PublicKey); err != nil {
+					return
+				}
 			}
 
 		case token_se:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				if err = h.mixDH(h.s, h.re.PublicKey); err != nil {
+					return
+				}
 			} else {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				if err = h.mixDH(h.e, h.rs.PublicKey); err != nil {
+					return
+				}
 			}
 
 		case token_ss:
-			h.symmetricState.mixKey(dh(h.s, h.rs.PublicKey))
+			if err = h.mixStaticDH(); err != nil {
+				return
+			}
 		case token_psk:
 			h.symmetricState.mixKeyAndHash(h.psk)
 		}
 	}
 
 	// Appends decrpyAndHash(payload) to the buffer
+	if h.symmetricState.cipherState.hasKey() && len(message[offset:]) < NoiseTagLength {
+		return nil, nil, h.messageError(ErrShortMessage)
+	}
 	var plaintext []byte
 	plaintext, err = h.symmetricState.decryptAndHash(message[offset:])
 	if err != nil {
-		return
+		if authenticatesResponder {
+			return nil, nil, ErrResponderAuthFailed
+		}
+		return nil, nil, h.messageError(err)
+	}
+	if h.compressPayloads {
+		if plaintext, err = decodePayload(plaintext); err != nil {
+			return
+		}
+	}
+	if !h.initiator && h.sendsFreshness() {
+		if plaintext, err = checkFreshness(plaintext, h.freshness); err != nil {
+			return
+		}
 	}
 	*payloadBuffer = append(*payloadBuffer, plaintext...)
 
@@ -471,7 +1189,7 @@ func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1,
 	if len(h.messagePatterns) == 1 {
 		// If there are no more message patterns returns two new CipherState objects
 		h.messagePatterns = nil
-		c1, c2 = h.symmetricState.Split()
+		c1, c2 = h.split()
 	} else {
 		h.messagePatterns = h.messagePatterns[1:]
 	}
@@ -482,6 +1200,212 @@ func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1,
 	return
 }
 
+// Clone returns a deep copy of the handshakeState. The copy can be used to
+// process a message speculatively (for example to try different static keys)
+// without modifying the original handshakeState if the attempt fails.
+func (h *handshakeState) Clone() handshakeState {
+	clone := *h
+	clone.sharedGeneration = nil
+	if h.symmetricState.recorder != nil {
+		clone.symmetricState.recorder = &opRecorder{ops: append([]symmetricOp(nil), h.symmetricState.recorder.ops...)}
+	}
+	if h.psk != nil {
+		clone.psk = make([]byte, len(h.psk))
+		copy(clone.psk, h.psk)
+	}
+	if h.prologue != nil {
+		// the hash functions of the standard library can be serialized
+		state, err := h.prologue.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		clone.prologue = sha256.New()
+		if err = clone.prologue.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			panic(err)
+		}
+	}
+	return clone
+}
+
+//
+// Exporter
+//
+
+// maxExportLength is the maximum length of keying material obtained via
+// Export (the limit of HKDF with SHA-256)
+const maxExportLength = maxHkdfLength
+
+// Export derives length bytes of keying material, bound to the completed
+// handshake and to label, in the manner of TLS exporters. Both peers obtain
+// the same output for the same label. The keying material is independent
+// from the transport keys, which are not modified.
+func (h *handshakeState) Export(label []byte, length int) ([]byte, error) {
+	if h.messagePatterns != nil || h.symmetricState.h == [hashLen]byte{} {
+		return nil, errors.New("noise: keying material can only be exported after the handshake")
+	}
+	if length < 0 || length > maxExportLength {
+		return nil, errors.New("noise: invalid length for the exported keying material")
+	}
+
+	// HKDF-Extract with the chaining key as salt, the handshake hash binds
+	// the output to the transcript
+	prk := hmacHash(h.symmetricState.ck[:], append([]byte("NoiseGo exporter"), h.symmetricState.h[:]...))
+
+	// HKDF-Expand with the label as info
+	return hkdfExpand(prk, label, length), nil
+}
+
+// acknowledgementLen is the length of the acknowledgements produced by Acknowledge
+const acknowledgementLen = 16
+
+// Acknowledge returns a short acknowledgement, derived from the completed
+// handshake, that the recipient of a one-way pattern (like Noise_N) can send
+// back to prove that it has processed the handshake message. The sender
+// verifies it with VerifyAcknowledge.
+func (h *handshakeState) Acknowledge() ([]byte, error) {
+	return h.Export([]byte("NoiseGo acknowledgement"), acknowledgementLen)
+}
+
+// VerifyAcknowledge verifies an acknowledgement created by the other peer
+// with Acknowledge.
+func (h *handshakeState) VerifyAcknowledge(ack []byte) error {
+	expected, err := h.Acknowledge()
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expected, ack) != 1 {
+		return errors.New("noise: invalid acknowledgement")
+	}
+	return nil
+}
+
+//
+// Serialization
+//
+
+// the size of a serialized handshakeState, without the pre-shared key
+const serializedHandshakeStateLen = 1 + 1 + 1 + 1 + hashLen*2 + 32 + 8 + 1 + 64*4 + 1
+
+// MarshalBinary serializes a handshakeState that is waiting for its next
+// message. The output contains secret keys and must be stored securely.
+// The prologue is ended: AddPrologue cannot be called afterwards.
+func (h *handshakeState) MarshalBinary() ([]byte, error) {
+	handshakePattern, ok := patterns[h.handshakeType]
+	if !ok || h.messagePatterns == nil {
+		return nil, errors.New("noise: only an initialized handshakeState can be serialized")
+	}
+	if h.failed {
+		return nil, ErrHandshakeFailed
+	}
+	if err := h.finishPrologue(); err != nil {
+		return nil, err
+	}
+	if len(h.psk) > 255 {
+		return nil, errors.New("noise: the pre-shared key is too long to be serialized")
+	}
+
+	out := make([]byte, 0, serializedHandshakeStateLen+len(h.psk))
+	out = append(out, byte(h.handshakeType))
+	out = append(out, boolToByte(h.initiator), boolToByte(h.shouldWrite))
+	// number of message patterns already processed
+	out = append(out, byte(len(handshakePattern.messagePatterns)-len(h.messagePatterns)))
+
+	// symmetricState
+	out = append(out, h.symmetricState.ck[:]...)
+	out = append(out, h.symmetricState.h[:]...)
+	out = append(out, h.symmetricState.cipherState.k[:]...)
+	var nonce [8]byte
+	binary.BigEndian.PutUint64(nonce[:], h.symmetricState.cipherState.n)
+	out = append(out, nonce[:]...)
+	out = append(out, byte(h.symmetricState.cipherState.cipher))
+
+	// key pairs
+	for _, kp := range []*KeyPair{&h.s, &h.e, &h.rs, &h.re} {
+		out = append(out, kp.PrivateKey[:]...)
+		out = append(out, kp.PublicKey[:]...)
+	}
+
+	// pre-shared key
+	out = append(out, byte(len(h.psk)))
+	out = append(out, h.psk...)
+
+	return out, nil
+}
+
+// UnmarshalBinary restores a handshakeState serialized via MarshalBinary.
+// The receiver must have been initialized with the same handshake pattern
+// and cipher function.
+func (h *handshakeState) UnmarshalBinary(data []byte) error {
+	if len(data) < serializedHandshakeStateLen {
+		return errors.New("noise: serialized handshakeState is too short")
+	}
+	if h.messagePatterns == nil {
+		return errors.New("noise: can only restore into an initialized handshakeState")
+	}
+	if noiseHandshakeType(data[0]) != h.handshakeType {
+		return errors.New("noise: serialized handshakeState uses a different handshake pattern")
+	}
+	handshakePattern := patterns[h.handshakeType]
+	processed := int(data[3])
+	if processed >= len(handshakePattern.messagePatterns) {
+		return errors.New("noise: serialized handshakeState is not in the middle of a handshake")
+	}
+	if CipherFunction(data[4+hashLen*2+32+8]) != h.symmetricState.cipherState.cipher {
+		return errors.New("noise: serialized handshakeState uses a different cipher function")
+	}
+	pskLen := int(data[serializedHandshakeStateLen-1])
+	if len(data) != serializedHandshakeStateLen+pskLen {
+		return errors.New("noise: serialized handshakeState has an incorrect length")
+	}
+	// the local key pairs, if set, must be consistent
+	keysOffset := 4 + hashLen*2 + 32 + 8 + 1
+	for _, offset := range []int{keysOffset, keysOffset + 64} {
+		var kp KeyPair
+		copy(kp.PrivateKey[:], data[offset:offset+32])
+		copy(kp.PublicKey[:], data[offset+32:offset+64])
+		if !kp.isEmpty() && !kp.Valid() {
+			return errors.New("noise: serialized handshakeState contains an invalid key pair")
+		}
+		kp.clear()
+	}
+
+	h.initiator = data[1] == 1
+	h.shouldWrite = data[2] == 1
+	h.prologue = nil
+	h.prologueLen = 0
+	h.messagePatterns = handshakePattern.messagePatterns[processed:]
+
+	offset := 4
+	offset += copy(h.symmetricState.ck[:], data[offset:])
+	offset += copy(h.symmetricState.h[:], data[offset:])
+	offset += copy(h.symmetricState.cipherState.k[:], data[offset:offset+32])
+	h.symmetricState.cipherState.n = binary.BigEndian.Uint64(data[offset:])
+	offset += 8
+	offset++ // cipher function
+
+	for _, kp := range []*KeyPair{&h.s, &h.e, &h.rs, &h.re} {
+		offset += copy(kp.PrivateKey[:], data[offset:offset+32])
+		offset += copy(kp.PublicKey[:], data[offset:offset+32])
+	}
+
+	offset++ // psk length
+	if pskLen > 0 {
+		h.psk = make([]byte, pskLen)
+		copy(h.psk, data[offset:])
+	} else {
+		h.psk = nil
+	}
+
+	return nil
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 //
 // Clearing stuff
 //
@@ -492,6 +1416,17 @@ func (h *handshakeState) clear() {
 	h.e.clear()
 	h.rs.clear()
 	h.re.clear()
+	h.staticShared = [32]byte{}
+}
+
+// isEmpty returns true if the key pair has not been set. Empty is a
+// special value the specification uses for uninitialized keys.
+func (kp *KeyPair) isEmpty() bool {
+	acc := byte(0)
+	for i := 0; i < len(kp.PrivateKey); i++ {
+		acc |= kp.PrivateKey[i] | kp.PublicKey[i]
+	}
+	return acc == 0
 }
 
 // TODO: is there a better way to get rid of secrets in Go?
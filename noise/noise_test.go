@@ -0,0 +1,1000 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestMarshalHandshakeState(t *testing.T) {
+	initiator := initialize(Noise_XX, true, []byte("prologue"), GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, []byte("prologue"), GenerateKeypair(nil), nil, nil, nil)
+
+	// -> e
+	var message1, payload1 []byte
+	if _, _, err := initiator.writeMessage([]byte("first"), &message1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := responder.readMessage(message1, &payload1); err != nil {
+		t.Fatal(err)
+	}
+
+	// park both handshakes
+	serializedInitiator, err := initiator.MarshalBinary()
+	if err != nil {
+		t.Fatal("cannot serialize the initiator", err)
+	}
+	serializedResponder, err := responder.MarshalBinary()
+	if err != nil {
+		t.Fatal("cannot serialize the responder", err)
+	}
+
+	// restoring into a different pattern should fail
+	wrongPattern := initialize(Noise_NX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	if err := wrongPattern.UnmarshalBinary(serializedResponder); err == nil {
+		t.Fatal("restoring into a handshake with a different pattern should fail")
+	}
+	wrongCipher, _ := newHandshakeState(Noise_XX, "", CipherAESGCM, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	if err := wrongCipher.UnmarshalBinary(serializedResponder); err == nil {
+		t.Fatal("restoring into a handshake with a different cipher function should fail")
+	}
+
+	// a corrupted static key should be detected
+	corrupted := append([]byte(nil), serializedInitiator...)
+	corrupted[4+hashLen*2+32+8+1+32] ^= 1
+	corruptedInitiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	if err := corruptedInitiator.UnmarshalBinary(corrupted); err == nil {
+		t.Fatal("restoring a corrupted key pair should fail")
+	}
+
+	// restore and complete the handshake
+	restoredInitiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	if err := restoredInitiator.UnmarshalBinary(serializedInitiator); err != nil {
+		t.Fatal("cannot restore the initiator", err)
+	}
+	restoredResponder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	if err := restoredResponder.UnmarshalBinary(serializedResponder); err != nil {
+		t.Fatal("cannot restore the responder", err)
+	}
+
+	initiatorSession, responderSession := completeHandshake(t, &restoredInitiator, &restoredResponder)
+
+	ciphertext, err := initiatorSession.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := responderSession.Decrypt(ciphertext)
+	if err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("restored handshake did not produce a working session", err)
+	}
+}
+
+func TestMissingRequiredKeys(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	remoteKey := &KeyPair{PublicKey: GenerateKeypair(nil).PublicKey}
+	testCases := []struct {
+		handshakeType noiseHandshakeType
+		initiator     bool
+		s, rs         *KeyPair
+		valid         bool
+	}{
+		{Noise_XX, true, nil, nil, false},
+		{Noise_XX, false, nil, nil, false},
+		{Noise_XX, true, &KeyPair{}, nil, false},
+		{Noise_XX, true, keyPair, nil, true},
+		{Noise_NK, true, nil, nil, false},
+		{Noise_NK, true, nil, remoteKey, true},
+		{Noise_NK, false, nil, nil, false},
+		{Noise_NK, false, keyPair, nil, true},
+		{Noise_IK, true, keyPair, nil, false},
+		{Noise_IK, true, nil, remoteKey, false},
+		{Noise_IK, true, keyPair, remoteKey, true},
+		{Noise_NX, true, nil, nil, true},
+		{Noise_N, false, nil, nil, false},
+		{Noise_KK, false, keyPair, nil, false},
+		{Noise_KK, false, keyPair, remoteKey, true},
+	}
+	for idx, testCase := range testCases {
+		err := checkKeys(patterns[testCase.handshakeType], testCase.initiator, testCase.s, nil, testCase.rs, nil)
+		if testCase.valid && err != nil {
+			t.Errorf("test case %d should be valid: %s", idx, err)
+		} else if !testCase.valid && err == nil {
+			t.Errorf("test case %d should have been rejected", idx)
+		}
+	}
+}
+
+func TestSuppliedEphemeral(t *testing.T) {
+	ephemeral := GenerateKeypair(nil)
+	initiator := initialize(Noise_NX, true, nil, nil, ephemeral, nil, nil)
+
+	var message []byte
+	if _, _, err := initiator.writeMessage(nil, &message); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message[:dhLen], ephemeral.PublicKey[:]) {
+		t.Fatal("the supplied ephemeral key was not used")
+	}
+}
+
+func TestCloneHandshakeState(t *testing.T) {
+	initiatorKey := GenerateKeypair(nil)
+	responderKey := GenerateKeypair(nil)
+	remoteKey := &KeyPair{PublicKey: responderKey.PublicKey}
+
+	initiator := initialize(Noise_IK, true, nil, initiatorKey, nil, remoteKey, nil)
+	responder := initialize(Noise_IK, false, nil, responderKey, nil, nil, nil)
+
+	// -> e, es, s, ss
+	var message []byte
+	if _, _, err := initiator.writeMessage([]byte("hello"), &message); err != nil {
+		t.Fatal(err)
+	}
+
+	// try to read the message with a different static key
+	clone := responder.Clone()
+	clone.s = *GenerateKeypair(nil)
+	var payload []byte
+	if _, _, err := clone.readMessage(message, &payload); err == nil {
+		t.Fatal("reading with the wrong static key should fail")
+	}
+
+	// the original state should be untouched
+	payload = payload[:0]
+	if _, _, err := responder.readMessage(message, &payload); err != nil {
+		t.Fatal("reading with the original state failed", err)
+	}
+	if !bytes.Equal(payload, []byte("hello")) {
+		t.Fatal("payload not correctly decrypted")
+	}
+
+	completeHandshake(t, &initiator, &responder)
+}
+
+func TestNewHandshake(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	testCases := []struct {
+		config    Config
+		initiator bool
+		err       string
+	}{
+		{Config{HandshakePattern: Noise_IK, KeyPair: keyPair}, true, "noise: pattern IK requires a remote static key"},
+		{Config{HandshakePattern: Noise_IK, RemoteKey: keyPair.PublicKey[:]}, true, "noise: pattern IK requires a local static key"},
+		{Config{HandshakePattern: Noise_XX}, false, "noise: pattern XX requires a local static key"},
+		{Config{HandshakePattern: Noise_KK, KeyPair: keyPair}, false, "noise: pattern KK requires a remote static key"},
+		{Config{HandshakePattern: Noise_NK, RemoteKey: keyPair.PublicKey[:16]}, true, "noise: the provided remote key is not 32-byte"},
+		{Config{HandshakePattern: Noise_NNpsk2}, true, "noise: pattern NNpsk2 requires a 32-byte pre-shared key"},
+		{Config{HandshakePattern: Noise_NN}, true, "noise: unknown handshake pattern"},
+	}
+	for _, testCase := range testCases {
+		_, err := NewHandshake(&testCase.config, testCase.initiator)
+		if err == nil || err.Error() != testCase.err {
+			t.Errorf("expected error %q, got %v", testCase.err, err)
+		}
+	}
+
+	// valid configurations
+	valid := []Config{
+		{HandshakePattern: Noise_NK, RemoteKey: keyPair.PublicKey[:]},
+		{HandshakePattern: Noise_NNpsk2, PreSharedKey: make([]byte, 32)},
+		{HandshakePattern: Noise_XX, KeyPair: keyPair},
+	}
+	for _, config := range valid {
+		if _, err := NewHandshake(&config, true); err != nil {
+			t.Error("valid configuration rejected:", err)
+		}
+	}
+}
+
+func TestPreMessageEphemeral(t *testing.T) {
+	// the ephemeral key pair that was sent in a previous handshake
+	ephemeral := GenerateKeypair(nil)
+	remoteEphemeral := &KeyPair{PublicKey: ephemeral.PublicKey}
+
+	// the ephemeral keys must be set
+	if _, err := newHandshakeState(Noise_XXfallback, "", CipherChaChaPoly, true, nil, GenerateKeypair(nil), nil, nil, nil); err == nil {
+		t.Fatal("the initiator should require a remote ephemeral key")
+	}
+	if _, err := newHandshakeState(Noise_XXfallback, "", CipherChaChaPoly, false, nil, GenerateKeypair(nil), nil, nil, nil); err == nil {
+		t.Fatal("the responder should require an ephemeral key")
+	}
+
+	initiator := initialize(Noise_XXfallback, true, nil, GenerateKeypair(nil), nil, nil, remoteEphemeral)
+	responder := initialize(Noise_XXfallback, false, nil, GenerateKeypair(nil), ephemeral, nil, nil)
+
+	// the pre-messages are processed at the end of the prologue
+	if err := initiator.finishPrologue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.finishPrologue(); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.symmetricState.h != responder.symmetricState.h {
+		t.Fatal("the pre-message ephemeral was not hashed in the same way by both peers")
+	}
+
+	initiatorSession, responderSession := completeHandshake(t, &initiator, &responder)
+	ciphertext, err := responderSession.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := initiatorSession.Decrypt(ciphertext); err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("both peers did not agree on the same keys", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	if _, err := initiator.Export([]byte("label"), 32); err == nil {
+		t.Fatal("keying material should not be exported before the end of the handshake")
+	}
+
+	initiatorSession, responderSession := completeHandshake(t, &initiator, &responder)
+
+	for _, label := range []string{"", "label", "another label"} {
+		for _, length := range []int{0, 1, 32, 33, 100} {
+			out1, err := initiator.Export([]byte(label), length)
+			if err != nil {
+				t.Fatal("cannot export", err)
+			}
+			out2, err := responder.Export([]byte(label), length)
+			if err != nil {
+				t.Fatal("cannot export", err)
+			}
+			if len(out1) != length || !bytes.Equal(out1, out2) {
+				t.Fatal("peers exported different keying material for", label, length)
+			}
+		}
+	}
+
+	// different labels give different outputs, and shorter outputs are prefixes
+	out1, _ := initiator.Export([]byte("a"), 64)
+	out2, _ := initiator.Export([]byte("b"), 64)
+	if bytes.Equal(out1, out2) {
+		t.Fatal("different labels should give different keying material")
+	}
+	out3, _ := initiator.Export([]byte("a"), 40)
+	if !bytes.Equal(out1[:40], out3) {
+		t.Fatal("exported keying material should not depend on its length")
+	}
+
+	// the transport keys are still usable
+	ciphertext, _ := initiatorSession.Encrypt([]byte("hello"))
+	if _, err := responderSession.Decrypt(ciphertext); err != nil {
+		t.Fatal("transport keys were modified by Export", err)
+	}
+}
+
+func TestAddPrologueTagged(t *testing.T) {
+	type segment struct{ tag, data string }
+	handshake := func(initiatorSegments, responderSegments []segment) error {
+		initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+		for _, s := range initiatorSegments {
+			if err := initiator.AddPrologueTagged(s.tag, []byte(s.data)); err != nil {
+				t.Fatal("cannot add to the prologue", err)
+			}
+		}
+		for _, s := range responderSegments {
+			if err := responder.AddPrologueTagged(s.tag, []byte(s.data)); err != nil {
+				t.Fatal("cannot add to the prologue", err)
+			}
+		}
+		var message, payload []byte
+		initiator.writeMessage(nil, &message)
+		if _, _, err := responder.readMessage(message, &payload); err != nil {
+			return err
+		}
+		message = message[:0]
+		responder.writeMessage(nil, &message)
+		_, _, err := initiator.readMessage(message, &payload)
+		return err
+	}
+
+	segments := []segment{{"application", "v1"}, {"transport", "tcp"}}
+	if err := handshake(segments, segments); err != nil {
+		t.Fatal("the same segments should lead to the same state", err)
+	}
+	if err := handshake(segments, []segment{segments[1], segments[0]}); err == nil {
+		t.Fatal("reordered segments should make the handshake fail")
+	}
+	if err := handshake([]segment{{"ab", "c"}}, []segment{{"a", "bc"}}); err == nil {
+		t.Fatal("segments should not be confused when their concatenation is the same")
+	}
+}
+
+func TestAddPrologue(t *testing.T) {
+	responderKey := GenerateKeypair(nil)
+	remoteKey := &KeyPair{PublicKey: responderKey.PublicKey}
+	single := initialize(Noise_NK, true, []byte("a long transcript"), nil, nil, remoteKey, nil)
+	chunked := initialize(Noise_NK, true, []byte("a long"), nil, nil, remoteKey, nil)
+	if err := chunked.AddPrologue([]byte(" trans")); err != nil {
+		t.Fatal("cannot add to the prologue", err)
+	}
+
+	// a clone should not be affected by the rest of the prologue
+	clone := chunked.Clone()
+
+	if err := chunked.AddPrologue([]byte("cript")); err != nil {
+		t.Fatal("cannot add to the prologue", err)
+	}
+	if err := clone.AddPrologue([]byte("cript!")); err != nil {
+		t.Fatal("cannot add to the prologue", err)
+	}
+
+	var messages [3][]byte
+	for i, h := range []*handshakeState{&single, &chunked, &clone} {
+		h.debugEphemeral = responderKey
+		if _, _, err := h.writeMessage([]byte("payload"), &messages[i]); err != nil {
+			t.Fatal("cannot write message", err)
+		}
+	}
+	if !bytes.Equal(messages[0], messages[1]) {
+		t.Fatal("a chunked prologue should be equivalent to a single prologue")
+	}
+	if bytes.Equal(messages[0], messages[2]) {
+		t.Fatal("the clone should have its own prologue")
+	}
+
+	// too late
+	if err := chunked.AddPrologue([]byte("more")); err == nil {
+		t.Fatal("the prologue should not be modified after the first message")
+	}
+
+	// too long, without hashing MaxPrologueLength bytes
+	h := initialize(Noise_NK, true, nil, nil, nil, remoteKey, nil)
+	h.prologueLen = MaxPrologueLength
+	if err := h.AddPrologue([]byte{0}); err != errPrologueTooLong {
+		t.Fatal("the prologue should not exceed MaxPrologueLength", err)
+	}
+}
+
+func TestNNpsk0EarlyData(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	initiator, err := NewHandshake(&Config{HandshakePattern: Noise_NNpsk0, PreSharedKey: psk}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongPsk := bytes.Repeat([]byte{2}, 32)
+	attacker, err := NewHandshake(&Config{HandshakePattern: Noise_NNpsk0, PreSharedKey: wrongPsk}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshake(&Config{HandshakePattern: Noise_NNpsk0, PreSharedKey: psk}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	earlyData := []byte("early application data")
+	var message []byte
+	if _, _, err = initiator.writeMessage(earlyData, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	// the payload is encrypted
+	if len(message) != dhLen+len(earlyData)+NoiseTagLength || bytes.Contains(message, earlyData) {
+		t.Fatal("the early data should be encrypted")
+	}
+
+	// it cannot be read without the pre-shared key
+	var payload []byte
+	if _, _, err = attacker.readMessage(message, &payload); err == nil {
+		t.Fatal("the early data should not be decrypted without the pre-shared key")
+	}
+	if _, _, err = responder.readMessage(message, &payload); err != nil || !bytes.Equal(payload, earlyData) {
+		t.Fatal("the responder cannot decrypt the early data", err)
+	}
+}
+
+func TestProtocolName(t *testing.T) {
+	for _, names := range [][2]string{
+		{"", ""},
+		{"", "Noise_XX_25519_ChaChaPoly_SHA256"},
+		{"MyService_v1", "MyService_v1"},
+		{"MyService_v1", "MyService_v2"},
+		{"", "MyService_v1"},
+	} {
+		initiator, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ProtocolName: names[0]}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ProtocolName: names[1]}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var message, payload []byte
+		initiator.writeMessage(nil, &message)
+		if _, _, err = responder.readMessage(message, &payload); err != nil {
+			t.Fatal(err)
+		}
+		message = message[:0]
+		responder.writeMessage(nil, &message)
+		_, _, err = initiator.readMessage(message, &payload)
+
+		sameName := names[0] == names[1] || names[0] == "" && names[1] == patterns[Noise_XX].protocolName(CipherChaChaPoly)
+		if sameName && err != nil {
+			t.Fatal("the handshake failed with the same protocol names", names, err)
+		}
+		if !sameName && err == nil {
+			t.Fatal("the handshake succeeded with different protocol names", names)
+		}
+	}
+}
+
+func TestProtocolNameMacLen(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	// a peer asking for 32-byte MACs fails before any message is sent
+	if _, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: keyPair, ProtocolName: "MyService_XX_mac32"}, true); err != errUnsupportedMacLen {
+		t.Fatal("32-byte MACs should be rejected", err)
+	}
+	if _, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: keyPair, ProtocolName: "MyService_XX_mac8"}, true); err == nil {
+		t.Fatal("an invalid MAC length should be rejected")
+	}
+
+	// a peer using _mac16 does not complete a handshake with a peer using
+	// another protocol name
+	initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: keyPair, ProtocolName: "MyService_XX_mac16"}, true)
+	responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ProtocolName: "MyService_XX"}, false)
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	if _, _, err := responder.readMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+	message = message[:0]
+	responder.writeMessage(nil, &message)
+	if _, _, err := initiator.readMessage(message, &payload); err == nil {
+		t.Fatal("different MAC length suffixes should not complete a handshake")
+	}
+
+	// peers using _mac16 complete the handshake with 16-byte tags
+	var err error
+	initiator, err = NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: keyPair, ProtocolName: "MyService_XX_mac16"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err = NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), ProtocolName: "MyService_XX_mac16"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completeHandshake(t, initiator, responder)
+}
+
+func TestSymmetricOperationsXX(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	initiator.symmetricState.recorder = &opRecorder{}
+	responder.symmetricState.recorder = &opRecorder{}
+
+	completeHandshake(t, &initiator, &responder)
+
+	// as specified in section 5.3 of the specification
+	expected := []symmetricOp{
+		opMixHash, // prologue
+		// -> e
+		opMixHash, opEncryptAndHash,
+		// <- e, ee, s, es
+		opMixHash, opMixKey, opDecryptAndHash, opMixKey, opDecryptAndHash,
+		// -> s, se
+		opEncryptAndHash, opMixKey, opEncryptAndHash, opSplit,
+	}
+	for _, peer := range []*handshakeState{&initiator, &responder} {
+		ops := peer.symmetricState.recorder.ops
+		if len(ops) != len(expected) {
+			t.Fatal("unexpected number of operations", ops)
+		}
+		for idx, op := range ops {
+			want := expected[idx]
+			// the responder decrypts what the initiator encrypts
+			if !peer.initiator {
+				if want == opEncryptAndHash {
+					want = opDecryptAndHash
+				} else if want == opDecryptAndHash {
+					want = opEncryptAndHash
+				}
+			}
+			if op != want {
+				t.Fatalf("operation %d is %s instead of %s (initiator: %t)", idx, op, want, peer.initiator)
+			}
+		}
+	}
+}
+
+func TestKeyReuse(t *testing.T) {
+	keyPair := GenerateKeypair(nil)
+	remoteKey := &KeyPair{PublicKey: GenerateKeypair(nil).PublicKey}
+
+	// s == e
+	sameKey := *keyPair
+	if _, err := newHandshakeState(Noise_XX, "", CipherChaChaPoly, true, nil, keyPair, &sameKey, nil, nil); err != ErrKeyReuse {
+		t.Fatal("a static key used as ephemeral key should be rejected", err)
+	}
+	// rs == re, in a pattern with a remote ephemeral pre-message
+	if _, err := newHandshakeState(Noise_XXfallback, "", CipherChaChaPoly, true, nil, keyPair, nil, remoteKey, remoteKey); err != ErrKeyReuse {
+		t.Fatal("a remote static key used as remote ephemeral key should be rejected", err)
+	}
+
+	// different keys are fine
+	if _, err := newHandshakeState(Noise_XX, "", CipherChaChaPoly, true, nil, keyPair, GenerateKeypair(nil), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHandshakeState(Noise_XXfallback, "", CipherChaChaPoly, true, nil, keyPair, nil, remoteKey, &KeyPair{PublicKey: GenerateKeypair(nil).PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMessageStrict(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+
+	// without strict mode, the trailing data ends up in the payload
+	clone := responder.Clone()
+	if _, _, err := clone.readMessage(append(message, 0xff), &payload); err != nil || len(payload) != 1 {
+		t.Fatal("trailing data should be read as the payload", err)
+	}
+
+	if _, _, err := responder.readMessageStrict(append(message, 0xff), 0, &payload); err != ErrTrailingData {
+		t.Fatal("trailing data should be rejected", err)
+	}
+	payload = payload[:0]
+	if _, _, err := responder.readMessageStrict(message, 0, &payload); err != nil || len(payload) != 0 {
+		t.Fatal("a message of the expected length should be accepted", err)
+	}
+
+	// with an encrypted payload
+	message = message[:0]
+	responder.writeMessage([]byte("hello"), &message)
+	if _, _, err := initiator.readMessageStrict(append(message, 0xff), 5, &payload); err != ErrTrailingData {
+		t.Fatal("trailing data should be rejected", err)
+	}
+	if _, _, err := initiator.readMessageStrict(message, 5, &payload); err != nil || !bytes.Equal(payload, []byte("hello")) {
+		t.Fatal("a message of the expected length should be accepted", err)
+	}
+}
+
+func TestSplitLabels(t *testing.T) {
+	v1 := [2][]byte{[]byte("initiator v1"), []byte("responder v1")}
+	v2 := [2][]byte{[]byte("initiator v2"), []byte("responder v2")}
+	for _, labels := range [][2][2][]byte{
+		{{}, {}},
+		{v1, v1},
+		{v1, v2},
+		{{}, v1},
+	} {
+		initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), SplitLabels: labels[0]}, true)
+		responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), SplitLabels: labels[1]}, false)
+		initiatorSession, responderSession := completeHandshake(t, initiator, responder)
+
+		same := bytes.Equal(labels[0][0], labels[1][0]) && bytes.Equal(labels[0][1], labels[1][1])
+		for _, direction := range [][2]*Session{{initiatorSession, responderSession}, {responderSession, initiatorSession}} {
+			ciphertext, _ := direction[0].Encrypt([]byte("hello"))
+			_, err := direction[1].Decrypt(ciphertext)
+			if same && err != nil {
+				t.Fatal("the same labels should produce a working session", err)
+			}
+			if !same && err == nil {
+				t.Fatal("different labels should not produce a working session")
+			}
+		}
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	responderKey := GenerateKeypair(nil)
+	initiator := initialize(Noise_N, true, nil, nil, nil, &KeyPair{PublicKey: responderKey.PublicKey}, nil)
+	responder := initialize(Noise_N, false, nil, responderKey, nil, nil, nil)
+
+	if _, err := responder.Acknowledge(); err == nil {
+		t.Fatal("an acknowledgement should only be created after the handshake")
+	}
+
+	var message, payload []byte
+	initiator.writeMessage([]byte("request"), &message)
+	if _, _, err := responder.readMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := responder.Acknowledge()
+	if err != nil {
+		t.Fatal("cannot create an acknowledgement", err)
+	}
+	if err = initiator.VerifyAcknowledge(ack); err != nil {
+		t.Fatal("the acknowledgement should be valid", err)
+	}
+
+	// tampered
+	ack[0] ^= 1
+	if err = initiator.VerifyAcknowledge(ack); err == nil {
+		t.Fatal("a tampered acknowledgement should fail verification")
+	}
+	if err = initiator.VerifyAcknowledge(nil); err == nil {
+		t.Fatal("an empty acknowledgement should fail verification")
+	}
+}
+
+func TestFinalMessageWithoutPayload(t *testing.T) {
+	// the same keys as vectors/flynn.txt, without a prologue and payloads
+	keys := make([]*KeyPair, 4)
+	for i := range keys {
+		var privateKey [32]byte
+		for j := range privateKey {
+			privateKey[j] = byte(i + 1)
+		}
+		keys[i] = GenerateKeypair(&privateKey)
+	}
+	initiator := initialize(Noise_XX, true, nil, keys[0], nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, keys[1], nil, nil, nil)
+	initiator.debugEphemeral = keys[2]
+	responder.debugEphemeral = keys[3]
+
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage(nil, &message)
+	initiator.readMessage(message, &payload)
+	message = message[:0]
+	initiator.writeMessage(nil, &message)
+
+	// obtained with flynn/noise: the encrypted static key followed by the tag of the empty payload
+	expected, _ := hex.DecodeString("c3e615be84281bf0e2732370ffa2becd8110548e0d540bb01de64834d81268f3" +
+		"65a256ee58640493765d0a5f1fd343e1" + "8a901716650f0bb3828f59a0ea459736")
+	if !bytes.Equal(message, expected) {
+		t.Fatalf("unexpected final message %x", message)
+	}
+	if _, _, err := responder.readMessage(message, &payload); err != nil || len(payload) != 0 {
+		t.Fatal("cannot read the final message", err)
+	}
+}
+
+func TestCipherAESGCM(t *testing.T) {
+	initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), Cipher: CipherAESGCM}, true)
+	responder, _ := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), Cipher: CipherAESGCM}, false)
+	initiatorSession, responderSession := completeHandshake(t, initiator, responder)
+	ciphertext, _ := initiatorSession.Encrypt([]byte("hello"))
+	if len(ciphertext) != len("hello")+16 {
+		t.Fatal("AESGCM should produce a 16-byte tag")
+	}
+	if plaintext, err := responderSession.Decrypt(ciphertext); err != nil || string(plaintext) != "hello" {
+		t.Fatal("AESGCM session round trip failed", err)
+	}
+
+	// both peers must agree on the cipher function
+	initiator, _ = NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), Cipher: CipherAESGCM}, true)
+	responder, _ = NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil)}, false)
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage(nil, &message)
+	if _, _, err := initiator.readMessage(message, &payload); err == nil {
+		t.Fatal("different cipher functions should not complete a handshake")
+	}
+
+	if _, err := NewHandshake(&Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), Cipher: CipherFunction(42)}, true); err == nil {
+		t.Fatal("an unknown cipher function should be rejected")
+	}
+}
+
+func TestStaticKeyMacLen(t *testing.T) {
+	for _, cipher := range []CipherFunction{CipherChaChaPoly, CipherAESGCM} {
+		initiator, _ := newHandshakeState(Noise_XX, "", cipher, true, nil, GenerateKeypair(nil), nil, nil, nil)
+		responder, _ := newHandshakeState(Noise_XX, "", cipher, false, nil, GenerateKeypair(nil), nil, nil, nil)
+		var message, payload []byte
+		initiator.writeMessage(nil, &message)
+		responder.readMessage(message, &payload)
+
+		// <- e, ee, s, es: the static key is followed by its tag
+		message = message[:0]
+		responder.writeMessage([]byte("payload"), &message)
+		if len(message) != dhLen+dhLen+NoiseTagLength+len("payload")+NoiseTagLength {
+			t.Fatal("unexpected message length", len(message))
+		}
+		truncated := initiator.Clone()
+		if _, _, err := truncated.readMessage(message[:dhLen+dhLen+NoiseTagLength-1], &payload); err == nil {
+			t.Fatal("a truncated static key should be rejected")
+		}
+		payload = payload[:0]
+		if _, _, err := initiator.readMessage(message, &payload); err != nil || string(payload) != "payload" {
+			t.Fatal("the static key did not round trip", err)
+		}
+		if initiator.rs.PublicKey != responder.s.PublicKey {
+			t.Fatal("the received static key is not the one sent")
+		}
+	}
+}
+
+func TestPayloadLen(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	if _, err := initiator.PayloadLen(nil); err == nil {
+		t.Fatal("the initiator has no message to read yet")
+	}
+
+	writer, reader := &initiator, &responder
+	for idx, payload := range []string{"", "hello", "a longer payload for the last message"} {
+		var message []byte
+		writer.writeMessage([]byte(payload), &message)
+		predicted, err := reader.PayloadLen(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = reader.PayloadLen(message[:len(message)-len(payload)-1]); err == nil {
+			t.Fatal("a truncated message should be rejected", idx)
+		}
+		decrypted := make([]byte, 0, predicted)
+		if _, _, err = reader.readMessage(message, &decrypted); err != nil {
+			t.Fatal(err)
+		}
+		if predicted != len(decrypted) || string(decrypted) != payload {
+			t.Fatalf("message %d: predicted a payload of %d bytes, got %d", idx, predicted, len(decrypted))
+		}
+		writer, reader = reader, writer
+	}
+}
+
+func TestReadMessageTo(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage([]byte("encrypted payload"), &message)
+
+	// a tampered message writes nothing
+	tampered := append([]byte(nil), message...)
+	tampered[len(tampered)-1] ^= 1
+	attempt := initiator.Clone()
+	var buffer bytes.Buffer
+	if _, _, err := attempt.readMessageTo(tampered, &buffer); err == nil || buffer.Len() != 0 {
+		t.Fatal("a tampered message should fail without writing anything", err, buffer.Len())
+	}
+
+	if _, _, err := initiator.readMessageTo(message, &buffer); err != nil || buffer.String() != "encrypted payload" {
+		t.Fatal("the payload was not written", err, buffer.String())
+	}
+}
+
+func TestWriteMessageInto(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	payload := []byte("hello")
+	size := MessageSize(Noise_XX, 0, len(payload))
+	if _, _, _, err := initiator.writeMessageInto(make([]byte, size-1), payload); err != ErrBufferTooSmall {
+		t.Fatal("a buffer too small should return ErrBufferTooSmall", err)
+	}
+
+	// the message is written at the start of the buffer
+	dst := make([]byte, size+10)
+	n, _, _, err := initiator.writeMessageInto(dst, payload)
+	if err != nil || n != size {
+		t.Fatal("cannot write the message", n, err)
+	}
+	var received []byte
+	if _, _, err = responder.readMessage(dst[:n], &received); err != nil || !bytes.Equal(received, payload) {
+		t.Fatal("the message was not correctly written", err)
+	}
+
+	dst = make([]byte, MessageSize(Noise_XX, 1, 0))
+	if _, _, _, err = responder.writeMessageInto(dst[:len(dst)-1], nil); err != ErrBufferTooSmall {
+		t.Fatal("a buffer too small should return ErrBufferTooSmall", err)
+	}
+	if n, _, _, err = responder.writeMessageInto(dst, nil); err != nil || n != len(dst) {
+		t.Fatal("cannot write the message into a buffer of the exact size", err)
+	}
+}
+
+func TestStateCopied(t *testing.T) {
+	type peer struct {
+		handshakeState
+	}
+	initiator := peer{initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)}
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage(nil, &message)
+
+	// the copy is used first, the original cannot be used anymore
+	copied := initiator
+	if _, _, err := copied.readMessage(message, &payload); err != nil {
+		t.Fatal("the copy should be able to read the message", err)
+	}
+	if _, _, err := initiator.readMessage(message, &payload); err != ErrStateCopied {
+		t.Fatal("using the state after a copy should return ErrStateCopied", err)
+	}
+
+	// a clone does not share the counter
+	clone := copied.Clone()
+	message = message[:0]
+	if _, _, err := clone.writeMessage(nil, &message); err != nil {
+		t.Fatal("a clone should be usable", err)
+	}
+	if _, _, err := copied.writeMessage(nil, &message); err != nil {
+		t.Fatal("the original should be usable after a clone", err)
+	}
+}
+
+func TestFailedHandshakeState(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage([]byte("payload"), &message)
+
+	// a single corrupted message poisons the state
+	corrupted := append([]byte(nil), message...)
+	corrupted[len(corrupted)-1] ^= 1
+	if _, _, err := initiator.readMessage(corrupted, &payload); err == nil || err == ErrHandshakeFailed {
+		t.Fatal("the corrupted message should be rejected", err)
+	}
+	if _, _, err := initiator.readMessage(message, &payload); err != ErrHandshakeFailed {
+		t.Fatal("the valid message should not be read after a failure", err)
+	}
+	if _, _, err := initiator.writeMessage(nil, &message); err != ErrHandshakeFailed {
+		t.Fatal("no message should be written after a failure", err)
+	}
+	if _, err := initiator.MarshalBinary(); err != ErrHandshakeFailed {
+		t.Fatal("a failed state should not be serialized", err)
+	}
+	if initiator.s.PrivateKey != [32]byte{} || initiator.e.PrivateKey != [32]byte{} {
+		t.Fatal("the keys of a failed state should be erased")
+	}
+}
+
+func TestPrecomputeStaticShared(t *testing.T) {
+	initiatorKey, responderKey := GenerateKeypair(nil), GenerateKeypair(nil)
+	shared, err := PrecomputeStaticShared(initiatorKey, responderKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := sha256.Sum256([]byte("ephemerals"))
+
+	// runs a KK handshake and returns the transport keys of the initiator
+	handshake := func(initiatorShared, responderShared [32]byte) (*cipherState, *cipherState, error) {
+		initiator, _ := NewHandshake(&Config{HandshakePattern: Noise_KK, KeyPair: initiatorKey, RemoteKey: responderKey.PublicKey[:], StaticShared: initiatorShared, Rand: bytes.NewReader(seed[:])}, true)
+		responder, _ := NewHandshake(&Config{HandshakePattern: Noise_KK, KeyPair: responderKey, RemoteKey: initiatorKey.PublicKey[:], StaticShared: responderShared, Rand: bytes.NewReader(seed[:])}, false)
+		var message, payload []byte
+		initiator.writeMessage(nil, &message)
+		if _, _, err := responder.readMessage(message, &payload); err != nil {
+			return nil, nil, err
+		}
+		message = message[:0]
+		responder.writeMessage(nil, &message)
+		return initiator.readMessage(message, &payload)
+	}
+
+	c1, c2, err := handshake([32]byte{}, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2, err := handshake(shared, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1.k != p1.k || c2.k != p2.k {
+		t.Fatal("the precomputed DH should give the same session")
+	}
+	if _, _, err = handshake([32]byte{1}, [32]byte{}); err == nil {
+		t.Fatal("a wrong precomputed DH should make the handshake fail")
+	}
+}
+
+func TestResponderAuthFailed(t *testing.T) {
+	serverKey, otherServerKey := GenerateKeypair(nil), GenerateKeypair(nil)
+	initiator := initialize(Noise_IK, true, nil, GenerateKeypair(nil), nil, &KeyPair{PublicKey: serverKey.PublicKey}, nil)
+	var message, payload []byte
+	initiator.writeMessage(nil, &message)
+
+	// the reply of another server, to a client that expects its key
+	otherInitiator := initialize(Noise_IK, true, nil, GenerateKeypair(nil), nil, &KeyPair{PublicKey: otherServerKey.PublicKey}, nil)
+	otherServer := initialize(Noise_IK, false, nil, otherServerKey, nil, nil, nil)
+	var otherMessage []byte
+	otherInitiator.writeMessage(nil, &otherMessage)
+	if _, _, err := otherServer.readMessage(otherMessage, &payload); err != nil {
+		t.Fatal(err)
+	}
+	otherMessage = otherMessage[:0]
+	otherServer.writeMessage(nil, &otherMessage)
+
+	if _, _, err := initiator.readMessage(otherMessage, &payload); err != ErrResponderAuthFailed {
+		t.Fatal("the reply of the wrong server should return ErrResponderAuthFailed", err)
+	}
+
+	// when the key of the responder is received, a pinned key is checked
+	// before any DH with it
+	initiator = initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	initiator.expectedRemoteStatic = serverKey.PublicKey
+	responder := initialize(Noise_XX, false, nil, otherServerKey, nil, nil, nil)
+	message = message[:0]
+	initiator.writeMessage(nil, &message)
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	responder.writeMessage(nil, &message)
+	if _, _, err := initiator.readMessage(message, &payload); err != ErrPinMismatch {
+		t.Fatal("an unexpected static key should return ErrPinMismatch", err)
+	}
+}
+
+func TestNextAction(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	// drive the handshake without knowing the pattern
+	var initiatorActions, responderActions []string
+	record := func(h *handshakeState, action HandshakeAction, direction string) {
+		if h == &initiator {
+			initiatorActions = append(initiatorActions, action.String()+" "+direction)
+		} else {
+			responderActions = append(responderActions, action.String()+" "+direction)
+		}
+	}
+	for !initiator.IsHandshakeComplete() || !responder.IsHandshakeComplete() {
+		writer, reader := &initiator, &responder
+		if action, _ := writer.NextAction(); action != ActionWrite {
+			writer, reader = reader, writer
+		}
+		action, direction := writer.NextAction()
+		if action != ActionWrite {
+			t.Fatal("one of the peers should write", action)
+		}
+		record(writer, action, direction)
+		var message, payload []byte
+		if _, _, err := writer.writeMessage(nil, &message); err != nil {
+			t.Fatal(err)
+		}
+		action, direction = reader.NextAction()
+		record(reader, action, direction)
+		if _, _, err := reader.readMessage(message, &payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if strings.Join(initiatorActions, ", ") != "write ->, read <-, write ->" {
+		t.Fatal("unexpected actions for the initiator", initiatorActions)
+	}
+	if strings.Join(responderActions, ", ") != "read ->, write <-, read ->" {
+		t.Fatal("unexpected actions for the responder", responderActions)
+	}
+	if action, direction := initiator.NextAction(); action != ActionNone || direction != "" {
+		t.Fatal("no action is expected after the handshake", action, direction)
+	}
+}
+
+func TestIsHandshakeComplete(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	writer, reader := &initiator, &responder
+	for idx := 0; idx < 3; idx++ {
+		if initiator.IsHandshakeComplete() || responder.IsHandshakeComplete() {
+			t.Fatal("the handshake should not be complete before the last message", idx)
+		}
+		var message, payload []byte
+		c1, _, err := writer.writeMessage(nil, &message)
+		if err != nil || (c1 != nil) != writer.IsHandshakeComplete() {
+			t.Fatal("IsHandshakeComplete should be true when the CipherStates are returned", idx, err)
+		}
+		r1, _, err := reader.readMessage(message, &payload)
+		if err != nil || (r1 != nil) != reader.IsHandshakeComplete() {
+			t.Fatal("IsHandshakeComplete should be true when the CipherStates are returned", idx, err)
+		}
+		writer, reader = reader, writer
+	}
+	if !initiator.IsHandshakeComplete() || !responder.IsHandshakeComplete() {
+		t.Fatal("the handshake should be complete after the last message")
+	}
+}
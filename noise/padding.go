@@ -0,0 +1,78 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//
+// Padding
+//
+
+// A PaddingPolicy returns the length, at least length, to which a plaintext
+// of length bytes is padded before being encrypted by a Session, see
+// Session.SetPaddingPolicy. Padding hides the exact length of the messages
+// from an observer, at the cost of bandwidth.
+type PaddingPolicy func(length int) int
+
+// PadToPowerOfTwo pads every message to the next power of two. An observer
+// only learns the order of magnitude of the length of a message.
+func PadToPowerOfTwo(length int) int {
+	padded := 1
+	for padded < length {
+		padded <<= 1
+	}
+	return padded
+}
+
+// PadToBlockSize returns a PaddingPolicy padding every message to a multiple
+// of blockSize bytes.
+func PadToBlockSize(blockSize int) PaddingPolicy {
+	return func(length int) int {
+		if blockSize <= 0 {
+			return length
+		}
+		return (length + blockSize - 1) / blockSize * blockSize
+	}
+}
+
+// paddingLengthLen is the length of the field encoding the length of the
+// plaintext at the start of a padded message
+const paddingLengthLen = 2
+
+var errBadPadding = errors.New("noise: the padding of the message is invalid")
+
+// pad encodes plaintext as its length (2 bytes, big-endian), the plaintext
+// and zeros, up to the length given by policy. The length field is counted in
+// the length given to policy, and the result never exceeds
+// NoiseMaxPlaintextSize.
+func pad(policy PaddingPolicy, plaintext []byte) ([]byte, error) {
+	length := paddingLengthLen + len(plaintext)
+	if length > NoiseMaxPlaintextSize {
+		return nil, errors.New("noise: the message is too long to be padded")
+	}
+	padded := policy(length)
+	if padded < length {
+		padded = length
+	}
+	if padded > NoiseMaxPlaintextSize {
+		padded = NoiseMaxPlaintextSize
+	}
+	out := make([]byte, padded)
+	binary.BigEndian.PutUint16(out, uint16(len(plaintext)))
+	copy(out[paddingLengthLen:], plaintext)
+	return out, nil
+}
+
+// unpad returns the plaintext of a message encoded by pad. The padding is
+// authenticated along with the rest of the message and is not checked.
+func unpad(padded []byte) ([]byte, error) {
+	if len(padded) < paddingLengthLen {
+		return nil, errBadPadding
+	}
+	length := int(binary.BigEndian.Uint16(padded))
+	if length > len(padded)-paddingLengthLen {
+		return nil, errBadPadding
+	}
+	return padded[paddingLengthLen : paddingLengthLen+length], nil
+}
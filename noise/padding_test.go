@@ -0,0 +1,44 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	testCases := []struct {
+		policy PaddingPolicy
+		sizes  map[int]int
+	}{
+		{PadToPowerOfTwo, map[int]int{0: 2, 1: 4, 2: 4, 30: 32, 100: 128, NoiseMaxPlaintextSize - 2: NoiseMaxPlaintextSize}},
+		{PadToBlockSize(64), map[int]int{0: 64, 62: 64, 63: 128, 200: 256}},
+	}
+	for _, testCase := range testCases {
+		initiator, responder := newTestSessions(t)
+		initiator.SetPaddingPolicy(testCase.policy)
+		responder.SetPaddingPolicy(testCase.policy)
+		for length, padded := range testCase.sizes {
+			plaintext := bytes.Repeat([]byte{0x42}, length)
+			ciphertext, err := initiator.Encrypt(plaintext)
+			if err != nil {
+				t.Fatal("cannot encrypt", length, err)
+			}
+			if len(ciphertext) != padded+NoiseTagLength {
+				t.Fatal("the length on the wire does not follow the policy", length, len(ciphertext))
+			}
+			decrypted, err := responder.Decrypt(ciphertext)
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("the padding was not removed", length, err)
+			}
+		}
+	}
+
+	initiator, _ := newTestSessions(t)
+	initiator.SetPaddingPolicy(PadToPowerOfTwo)
+	if _, err := initiator.Encrypt(make([]byte, NoiseMaxPlaintextSize-1)); err == nil {
+		t.Fatal("a message too long to be padded should be refused")
+	}
+	if _, err := unpad([]byte{0, 5, 1, 2}); err != errBadPadding {
+		t.Fatal("a length longer than the message should be refused", err)
+	}
+}
@@ -1,5 +1,13 @@
 package noise
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 //
 // Handshake Patterns
 //
@@ -51,6 +59,19 @@ const (
 	Noise_IX
 	Noise_NNpsk2
 
+	// Noise_XXfallback is the pattern used by Noise Pipes when a responder
+	// fails to decrypt the first message of a Noise_IK handshake. The
+	// responder of Noise_IK becomes the initiator of Noise_XXfallback and
+	// uses the ephemeral key it received as a pre-message, while the other
+	// peer re-uses its own ephemeral key pair.
+	Noise_XXfallback
+
+	// Noise_NNpsk0 is a pattern where both peers share a pre-shared key.
+	// As the psk token is processed first, the payload of the first message
+	// is encrypted under the pre-shared key and can carry early data.
+	// This data is not forward secret, and can be replayed.
+	Noise_NNpsk0
+
 	// Not implemented
 	Noise_NN
 	Noise_KN
@@ -252,6 +273,25 @@ var patterns = map[noiseHandshakeType]handshakePattern{
 		},
 	},
 
+	/*
+		XXfallback(e, s, rs, re):
+		  <- e
+		  ...
+		  -> e, ee, s, se
+		  <- s, es
+	*/
+	Noise_XXfallback: handshakePattern{
+		name: "XXfallback",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_e}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_ee, token_s, token_se}, // →
+			messagePattern{token_s, token_es},                    // ←
+		},
+	},
+
 	/*
 		NNpsk2():
 		  -> e
@@ -268,4 +308,622 @@ var patterns = map[noiseHandshakeType]handshakePattern{
 			messagePattern{token_e, token_ee, token_psk}, // ←
 		},
 	},
+
+	/*
+		NNpsk0():
+		  -> psk, e
+		  <- e, ee
+	*/
+	Noise_NNpsk0: handshakePattern{
+		name: "NNpsk0",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_psk, token_e}, // →
+			messagePattern{token_e, token_ee},  // ←
+		},
+	},
+}
+
+// protocolName returns the name of the Noise protocol using the handshake
+// pattern with the functions implemented by this package
+func (hp handshakePattern) protocolName(cipher CipherFunction) string {
+	return "Noise_" + hp.name + "_" + NoiseDH + "_" + cipher.String() + "_" + NoiseHASH
+}
+
+// errUnsupportedMacLen is returned for a "_mac32" suffix, see checkMacLenSuffix
+var errUnsupportedMacLen = errors.New("noise: 32-byte MACs are not supported by the cipher functions of this package")
+
+// checkMacLenSuffix verifies the "_macNN" suffix of a custom protocol name,
+// for example "MyApp_XX_mac16". The cipher functions of this package have
+// 16-byte tags that cannot be extended, so the suffix can only state this
+// length: a peer asking for 32-byte tags fails when its handshakeState is
+// created, instead of failing the handshake later on, and any other length
+// is invalid. As two peers can only complete a handshake if they use the same
+// protocol name, a peer using "_mac16" does not interoperate with a peer
+// using another suffix, or none.
+func checkMacLenSuffix(protocolName string) error {
+	idx := strings.LastIndex(protocolName, "_mac")
+	if idx == -1 {
+		return nil
+	}
+	macLen, err := strconv.Atoi(protocolName[idx+len("_mac"):])
+	if err != nil {
+		// not a MAC length suffix
+		return nil
+	}
+	switch macLen {
+	case NoiseTagLength:
+		return nil
+	case 32:
+		return errUnsupportedMacLen
+	default:
+		return errors.New("noise: invalid MAC length " + strconv.Itoa(macLen) + " in the protocol name")
+	}
+}
+
+//
+// Keys required
+//
+
+// requiresLocalStatic returns true if a peer needs a static key pair in order
+// to go through the handshake pattern (it sends it, or uses it in a DH).
+func (hp handshakePattern) requiresLocalStatic(initiator bool) bool {
+	preMessage := hp.preMessagePatterns[1]
+	localDH, firstMessage := token_es, 1
+	if initiator {
+		preMessage = hp.preMessagePatterns[0]
+		localDH, firstMessage = token_se, 0
+	}
+	for _, token := range preMessage {
+		if token == token_s {
+			return true
+		}
+	}
+	for idx := firstMessage; idx < len(hp.messagePatterns); idx += 2 {
+		for _, token := range hp.messagePatterns[idx] {
+			if token == token_s {
+				return true
+			}
+		}
+	}
+	for _, pattern := range hp.messagePatterns {
+		for _, token := range pattern {
+			if token == localDH || token == token_ss {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// staticKeyMessage returns the index of the message in which a peer sends its
+// static key, or of the first message it writes if the static key is known
+// from a pre-message. It returns -1 if the peer has no static key or writes
+// no message.
+func (hp handshakePattern) staticKeyMessage(initiator bool) int {
+	preMessage := hp.preMessagePatterns[1]
+	firstMessage := 1
+	if initiator {
+		preMessage = hp.preMessagePatterns[0]
+		firstMessage = 0
+	}
+	for _, token := range preMessage {
+		if token == token_s && firstMessage < len(hp.messagePatterns) {
+			return firstMessage
+		}
+	}
+	for idx := firstMessage; idx < len(hp.messagePatterns); idx += 2 {
+		for _, token := range hp.messagePatterns[idx] {
+			if token == token_s {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// requiresLocalEphemeral returns true if a peer needs to be initialized with
+// an ephemeral key pair, transmitted in a pre-message.
+func (hp handshakePattern) requiresLocalEphemeral(initiator bool) bool {
+	preMessage := hp.preMessagePatterns[1]
+	if initiator {
+		preMessage = hp.preMessagePatterns[0]
+	}
+	for _, token := range preMessage {
+		if token == token_e {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresRemoteEphemeral returns true if a peer needs to be initialized with
+// the ephemeral public key of the other peer, transmitted in a pre-message.
+func (hp handshakePattern) requiresRemoteEphemeral(initiator bool) bool {
+	preMessage := hp.preMessagePatterns[0]
+	if initiator {
+		preMessage = hp.preMessagePatterns[1]
+	}
+	for _, token := range preMessage {
+		if token == token_e {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresRemoteStatic returns true if a peer needs to know the static public
+// key of the other peer prior to the handshake.
+func (hp handshakePattern) requiresRemoteStatic(initiator bool) bool {
+	preMessage := hp.preMessagePatterns[0]
+	if initiator {
+		preMessage = hp.preMessagePatterns[1]
+	}
+	for _, token := range preMessage {
+		if token == token_s {
+			return true
+		}
+	}
+	return false
+}
+
+// usesPsk returns true if the handshake pattern contains a psk token
+func (hp handshakePattern) usesPsk() bool {
+	for _, pattern := range hp.messagePatterns {
+		for _, token := range pattern {
+			if token == token_psk {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Message sizes
+//
+
+// messageSize computes the length of a handshake message from its message
+// pattern. hasKey indicates if the symmetricState already has a key when the
+// message is processed, and psk if the handshake makes use of a pre-shared key.
+func messageSize(pattern messagePattern, hasKey, psk bool, payloadLen int) int {
+	size := 0
+	for _, token := range pattern {
+		switch token {
+		case token_e:
+			size += dhLen
+			if psk {
+				hasKey = true
+			}
+		case token_s:
+			size += dhLen
+			if hasKey {
+				size += NoiseTagLength
+			}
+		case token_ee, token_es, token_se, token_ss, token_psk:
+			hasKey = true
+		}
+	}
+	size += payloadLen
+	if hasKey {
+		size += NoiseTagLength
+	}
+	return size
+}
+
+// MessageSize returns the length of the handshake message at index
+// messageIndex (starting at 0) of the handshake pattern handshakeType, when
+// it carries a payload of payloadLen bytes. This can be used to allocate
+// buffers of the correct size. It returns -1 if the pattern is not
+// implemented or if it does not contain such a message. The encodings of the
+// payload enabled by the Config, like payload compression, are not included:
+// see handshakeState.NextMessageSize.
+func MessageSize(handshakeType noiseHandshakeType, messageIndex, payloadLen int) int {
+	handshakePattern, ok := patterns[handshakeType]
+	if !ok || messageIndex < 0 || messageIndex >= len(handshakePattern.messagePatterns) {
+		return -1
+	}
+
+	psk := handshakePattern.usesPsk()
+
+	// find out if a key has been set by the previous messages
+	hasKey := false
+	for _, pattern := range handshakePattern.messagePatterns[:messageIndex] {
+		for _, token := range pattern {
+			if token != token_s && (token != token_e || psk) {
+				hasKey = true
+			}
+		}
+	}
+
+	return messageSize(handshakePattern.messagePatterns[messageIndex], hasKey, psk, payloadLen)
+}
+
+// A WireField is a field of a handshake message on the wire, see
+// DescribeWire.
+type WireField struct {
+	// "ephemeral", "static" or "payload"
+	Name string
+	// the length of the field in bytes, excluding the payload itself for a
+	// payload field
+	Length int
+	// true if the field is encrypted and authenticated
+	Encrypted bool
+}
+
+// String describes the field, for example "static: 48 bytes AEAD" or
+// "payload: N+16 bytes AEAD".
+func (f WireField) String() string {
+	length := strconv.Itoa(f.Length)
+	if f.Name == "payload" {
+		length = "N"
+		if f.Length > 0 {
+			length += "+" + strconv.Itoa(f.Length)
+		}
+	}
+	protection := "cleartext"
+	if f.Encrypted {
+		protection = "AEAD"
+	}
+	return f.Name + ": " + length + " bytes " + protection
+}
+
+// A MessageLayout lists the fields of a handshake message in the order they
+// appear on the wire.
+type MessageLayout struct {
+	// "->" for a message sent by the initiator, "<-" for the responder
+	Direction string
+	Fields    []WireField
+}
+
+// DescribeWire returns the layout of each handshake message of a pattern
+// (for example "XX" or "Noise_XX"), computed from its tokens, for
+// documentation or wire diagrams. The last field of each message is the
+// payload, of any length N.
+func DescribeWire(pattern string) ([]MessageLayout, error) {
+	handshakeType, err := LookupPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	handshakePattern := patterns[handshakeType]
+	psk := handshakePattern.usesPsk()
+
+	layouts := make([]MessageLayout, len(handshakePattern.messagePatterns))
+	hasKey := false
+	for idx, messagePattern := range handshakePattern.messagePatterns {
+		layouts[idx].Direction = "->"
+		if idx%2 == 1 {
+			layouts[idx].Direction = "<-"
+		}
+		for _, token := range messagePattern {
+			switch token {
+			case token_e:
+				layouts[idx].Fields = append(layouts[idx].Fields, WireField{Name: "ephemeral", Length: dhLen})
+				if psk {
+					hasKey = true
+				}
+			case token_s:
+				field := WireField{Name: "static", Length: dhLen, Encrypted: hasKey}
+				if hasKey {
+					field.Length += NoiseTagLength
+				}
+				layouts[idx].Fields = append(layouts[idx].Fields, field)
+			case token_ee, token_es, token_se, token_ss, token_psk:
+				hasKey = true
+			}
+		}
+		payload := WireField{Name: "payload", Encrypted: hasKey}
+		if hasKey {
+			payload.Length = NoiseTagLength
+		}
+		layouts[idx].Fields = append(layouts[idx].Fields, payload)
+	}
+	return layouts, nil
+}
+
+// GuessPattern returns the candidate patterns (given by name, like "XX" or
+// "Noise_XX") whose first handshake message can have the length of
+// firstMessage. As the length of the payload is unknown, this is only a
+// heuristic that can help routing a message to the right handshakeState when
+// several patterns are accepted: it does not authenticate anything. Unknown
+// candidates are ignored.
+func GuessPattern(firstMessage []byte, candidates []string) []string {
+	var plausible []string
+	for _, candidate := range candidates {
+		handshakeType, err := LookupPattern(candidate)
+		if err != nil {
+			continue
+		}
+		if len(firstMessage) >= MessageSize(handshakeType, 0, 0) {
+			plausible = append(plausible, candidate)
+		}
+	}
+	return plausible
+}
+
+//
+// Pattern names
+//
+
+// ErrUnknownPattern is returned when a handshake pattern is not implemented
+var ErrUnknownPattern = errors.New("noise: unknown handshake pattern")
+
+// SupportedPatterns returns the sorted list of the names of the handshake
+// patterns implemented by this package (for example "XX" for Noise_XX).
+func SupportedPatterns() []string {
+	names := make([]string, 0, len(patterns))
+	for _, handshakePattern := range patterns {
+		names = append(names, handshakePattern.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupPattern returns the handshake pattern corresponding to a name like
+// "XX" or "Noise_XX". If the pattern is not implemented, the error returned
+// wraps ErrUnknownPattern and suggests the closest implemented pattern.
+func LookupPattern(name string) (noiseHandshakeType, error) {
+	name = strings.TrimPrefix(name, "Noise_")
+	for handshakeType, handshakePattern := range patterns {
+		if handshakePattern.name == name {
+			return handshakeType, nil
+		}
+	}
+
+	// find the closest match
+	suggestion, distance := "", -1
+	for _, candidate := range SupportedPatterns() {
+		if d := levenshtein(strings.ToUpper(name), strings.ToUpper(candidate)); distance == -1 || d < distance {
+			suggestion, distance = candidate, d
+		}
+	}
+	return 0, fmt.Errorf("%w %q (did you mean %q?)", ErrUnknownPattern, name, suggestion)
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+//
+// Custom patterns
+//
+
+var tokenNames = map[token]string{
+	token_e:   "e",
+	token_s:   "s",
+	token_es:  "es",
+	token_se:  "se",
+	token_ss:  "ss",
+	token_ee:  "ee",
+	token_psk: "psk",
+}
+
+func (t token) String() string {
+	if name, ok := tokenNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("token(%d)", uint8(t))
+}
+
+// UnknownTokenError is returned when a handshake pattern contains a token
+// that is not part of the specification.
+type UnknownTokenError struct {
+	// the index of the message containing the token, starting at 0. For
+	// pre-messages, it is -2 for the initiator and -1 for the responder
+	MessageIndex int
+	// the index of the token in its message, starting at 0
+	Position int
+	Token    string
+	Pattern  string
+}
+
+func (e *UnknownTokenError) Error() string {
+	return fmt.Sprintf("noise: unknown token %q at position %d of message %d in pattern %s", e.Token, e.Position, e.MessageIndex, e.Pattern)
+}
+
+// ErrTooManyPatterns is returned by ParseHandshakePattern when all the
+// handshake types available for custom patterns are in use.
+var ErrTooManyPatterns = errors.New("noise: too many custom handshake patterns")
+
+// freeCustomPattern returns the lowest handshake type above the built-in
+// ones that is not used by a pattern, or false if there is none left
+func freeCustomPattern() (noiseHandshakeType, bool) {
+	for handshakeType := Noise_IN + 1; handshakeType > Noise_IN; handshakeType++ {
+		if _, ok := patterns[handshakeType]; !ok {
+			return handshakeType, true
+		}
+	}
+	return 0, false
+}
+
+// ParseHandshakePattern registers a custom handshake pattern and returns its
+// handshake type. The pattern is written as in the specification, one
+// message per string, optionally prefixed by its direction. The pre-messages,
+// if any, come first and are separated from the messages by "...":
+//
+//	ParseHandshakePattern("NK1", []string{"<- s", "...", "-> e", "<- e, ee, es"})
+//
+// A misspelled token is reported with an *UnknownTokenError. The psk tokens
+// must be placed as indicated by the psk modifiers of the name (see
+// checkPskPlacement). Handshake types are 8-bit integers, which leaves room
+// for 110 custom patterns: ErrTooManyPatterns is returned once they are all
+// used. Patterns must be registered before any handshake is started, as
+// ParseHandshakePattern is not safe for concurrent use.
+func ParseHandshakePattern(name string, messages []string) (noiseHandshakeType, error) {
+	if _, err := LookupPattern(name); err == nil {
+		return 0, errors.New("noise: a handshake pattern named " + name + " already exists")
+	}
+	pattern := handshakePattern{
+		name:               name,
+		preMessagePatterns: []messagePattern{messagePattern{}, messagePattern{}},
+	}
+	full := strings.Join(messages, "; ")
+
+	// find the pre-messages
+	for idx, message := range messages {
+		if strings.TrimSpace(message) != "..." {
+			continue
+		}
+		if idx > 2 {
+			return 0, errors.New("noise: pattern " + name + " has more than two pre-messages")
+		}
+		for _, preMessage := range messages[:idx] {
+			fromInitiator, tokens, err := parseMessagePattern(preMessage, -1, full)
+			if err != nil {
+				return 0, err
+			}
+			if fromInitiator {
+				pattern.preMessagePatterns[0] = tokens
+			} else {
+				pattern.preMessagePatterns[1] = tokens
+			}
+		}
+		messages = messages[idx+1:]
+		break
+	}
+	if len(messages) == 0 {
+		return 0, errors.New("noise: pattern " + name + " has no message")
+	}
+
+	for idx, message := range messages {
+		fromInitiator, tokens, err := parseMessagePattern(message, idx, full)
+		if err != nil {
+			return 0, err
+		}
+		if fromInitiator != (idx%2 == 0) {
+			return 0, fmt.Errorf("noise: message %d of pattern %s is not sent in the expected direction", idx, name)
+		}
+		pattern.messagePatterns = append(pattern.messagePatterns, tokens)
+	}
+	if err := checkPskPlacement(pattern); err != nil {
+		return 0, err
+	}
+
+	handshakeType, ok := freeCustomPattern()
+	if !ok {
+		return 0, ErrTooManyPatterns
+	}
+	patterns[handshakeType] = pattern
+	return handshakeType, nil
+}
+
+// unregisterPattern removes a custom pattern registered by
+// ParseHandshakePattern, so that its name and its handshake type can be
+// registered again
+func unregisterPattern(handshakeType noiseHandshakeType) {
+	if handshakeType > Noise_IN {
+		delete(patterns, handshakeType)
+	}
+}
+
+// pskModifiers returns the numbers of the psk modifiers of a pattern name,
+// for example [0 2] for "NNpsk0+psk2"
+func pskModifiers(name string) ([]int, error) {
+	var modifiers []int
+	for _, part := range strings.Split(name, "psk")[1:] {
+		digits := strings.TrimSuffix(part, "+")
+		number, err := strconv.Atoi(digits)
+		if err != nil || number < 0 {
+			return nil, errors.New("noise: invalid psk modifier in pattern name " + name)
+		}
+		modifiers = append(modifiers, number)
+	}
+	return modifiers, nil
+}
+
+// checkPskPlacement verifies that the psk tokens are where the psk modifiers
+// of the name of the pattern place them: psk0 at the beginning of the first
+// message, and pskN at the end of the Nth message (starting at 1). Otherwise
+// the pattern would not be interoperable with other implementations.
+func checkPskPlacement(pattern handshakePattern) error {
+	modifiers, err := pskModifiers(pattern.name)
+	if err != nil {
+		return err
+	}
+	expected := make(map[[2]int]bool) // message index and position of the token
+	for _, number := range modifiers {
+		if number > len(pattern.messagePatterns) {
+			return fmt.Errorf("noise: pattern %s has no message %d for its psk%d modifier", pattern.name, number, number)
+		}
+		if number == 0 {
+			expected[[2]int{0, 0}] = true
+		} else {
+			expected[[2]int{number - 1, len(pattern.messagePatterns[number-1]) - 1}] = true
+		}
+	}
+	found := 0
+	for idx, message := range pattern.messagePatterns {
+		for position, t := range message {
+			if t != token_psk {
+				continue
+			}
+			if !expected[[2]int{idx, position}] {
+				return fmt.Errorf("noise: the psk token at position %d of message %d of pattern %s does not match its psk modifiers", position, idx, pattern.name)
+			}
+			found++
+		}
+	}
+	if found != len(expected) {
+		return fmt.Errorf("noise: pattern %s is missing psk tokens for its psk modifiers", pattern.name)
+	}
+	return nil
+}
+
+// parseMessagePattern parses a message like "-> e, es". Messages without a
+// direction are sent by the initiator if idx is even. For pre-messages, idx
+// is negative and a direction is required.
+func parseMessagePattern(message string, idx int, full string) (fromInitiator bool, tokens messagePattern, err error) {
+	message = strings.TrimSpace(message)
+	switch {
+	case strings.HasPrefix(message, "->"):
+		fromInitiator, message = true, message[2:]
+	case strings.HasPrefix(message, "<-"):
+		fromInitiator, message = false, message[2:]
+	case idx < 0:
+		return false, nil, errors.New("noise: the pre-messages of a pattern must have a direction")
+	default:
+		fromInitiator = idx%2 == 0
+	}
+	if idx < 0 {
+		idx = -1
+		if fromInitiator {
+			idx = -2
+		}
+	}
+	tokens = messagePattern{}
+	if strings.TrimSpace(message) == "" {
+		return
+	}
+outer:
+	for position, name := range strings.Split(message, ",") {
+		name = strings.TrimSpace(name)
+		for t, tokenName := range tokenNames {
+			if tokenName == name {
+				tokens = append(tokens, t)
+				continue outer
+			}
+		}
+		return false, nil, &UnknownTokenError{MessageIndex: idx, Position: position, Token: name, Pattern: full}
+	}
+	return
 }
@@ -3,6 +3,9 @@ package noise
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/ed25519"
@@ -282,3 +285,208 @@ func TestNoiseN(t *testing.T) {
 		t.Fatal("client can't write on socket")
 	}
 }
+
+func TestMessageSize(t *testing.T) {
+	payload := []byte("some payload")
+	for _, pattern := range patternsToTest {
+		testVector := testVectors[pattern.protocolName]
+		initiator, responder := setupInitiatorAndResponder(pattern.patternName, CipherChaChaPoly, testVector)
+		writer, reader := &initiator, &responder
+		for idx := 0; idx < len(patterns[pattern.patternName].messagePatterns); idx++ {
+			var message, plaintext []byte
+			writer.writeMessage(payload, &message)
+			if _, _, err := reader.readMessage(message, &plaintext); err != nil {
+				t.Fatal(err)
+			}
+			if size := MessageSize(pattern.patternName, idx, len(payload)); size != len(message) {
+				t.Fatalf("message %d of %s is %d bytes, MessageSize returned %d", idx, pattern.protocolName, len(message), size)
+			}
+			writer, reader = reader, writer
+		}
+	}
+	if MessageSize(Noise_XX, 3, 0) != -1 || MessageSize(Noise_NN, 0, 0) != -1 {
+		t.Fatal("MessageSize should return -1 for messages that do not exist")
+	}
+}
+
+func TestLookupPattern(t *testing.T) {
+	for _, name := range SupportedPatterns() {
+		handshakeType, err := LookupPattern("Noise_" + name)
+		if err != nil || patterns[handshakeType].name != name {
+			t.Fatal("cannot find pattern", name, err)
+		}
+	}
+
+	_, err := LookupPattern("Xx")
+	if !errors.Is(err, ErrUnknownPattern) {
+		t.Fatal("an unknown pattern should return ErrUnknownPattern")
+	}
+	if !strings.Contains(err.Error(), `did you mean "XX"?`) {
+		t.Fatal("the closest pattern was not suggested:", err)
+	}
+}
+
+func TestGuessPattern(t *testing.T) {
+	candidates := []string{"N", "XX", "Noise_IK", "unknown"}
+	testCases := []struct {
+		length   int
+		expected []string
+	}{
+		{10, nil},
+		{dhLen + 5, []string{"XX"}}, // unambiguous
+		{dhLen + NoiseTagLength, []string{"N", "XX"}}, // ambiguous
+		{200, []string{"N", "XX", "Noise_IK"}},
+	}
+	for _, testCase := range testCases {
+		guess := GuessPattern(make([]byte, testCase.length), candidates)
+		if strings.Join(guess, ",") != strings.Join(testCase.expected, ",") {
+			t.Fatalf("unexpected guess for a message of %d bytes: %v", testCase.length, guess)
+		}
+	}
+}
+
+func TestParseHandshakePattern(t *testing.T) {
+	// a typo in the second message
+	_, err := ParseHandshakePattern("XXtypo", []string{"-> e", "<- e, ee, sz, es", "-> s, se"})
+	var tokenErr *UnknownTokenError
+	if !errors.As(err, &tokenErr) {
+		t.Fatal("expected an UnknownTokenError, got", err)
+	}
+	if tokenErr.MessageIndex != 1 || tokenErr.Position != 2 || tokenErr.Token != "sz" || tokenErr.Pattern != "-> e; <- e, ee, sz, es; -> s, se" {
+		t.Fatalf("unexpected error: %+v", tokenErr)
+	}
+	// and in a pre-message
+	_, err = ParseHandshakePattern("NKtypo", []string{"<- k", "...", "-> e, es", "<- e, ee"})
+	if !errors.As(err, &tokenErr) || tokenErr.MessageIndex != -1 || tokenErr.Position != 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = ParseHandshakePattern("XX", []string{"-> e", "<- e, ee"}); err == nil {
+		t.Fatal("an existing pattern should not be replaced")
+	}
+	if _, err = ParseHandshakePattern("NNwrong", []string{"-> e", "-> e, ee"}); err == nil {
+		t.Fatal("messages should alternate between the peers")
+	}
+
+	// a valid custom pattern can be used for a handshake
+	handshakeType, err := ParseHandshakePattern("NKcustom", []string{"<- s", "...", "-> e, es", "<- e, ee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterPattern(handshakeType) })
+	if found, err := LookupPattern("NKcustom"); err != nil || found != handshakeType {
+		t.Fatal("the custom pattern was not registered", err)
+	}
+	responderKey := GenerateKeypair(nil)
+	initiator := initialize(handshakeType, true, nil, nil, nil, &KeyPair{PublicKey: responderKey.PublicKey}, nil)
+	responder := initialize(handshakeType, false, nil, responderKey, nil, nil, nil)
+	completeHandshake(t, &initiator, &responder)
+}
+
+func TestParseHandshakePatternExhausted(t *testing.T) {
+	registered := 0
+	var last noiseHandshakeType
+	for {
+		handshakeType, err := ParseHandshakePattern("NNcustom"+strconv.Itoa(registered), []string{"-> e", "<- e, ee"})
+		if err == ErrTooManyPatterns {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handshakeType <= Noise_IN {
+			t.Fatal("a custom pattern was given the type of a built-in pattern", handshakeType)
+		}
+		t.Cleanup(func() { unregisterPattern(handshakeType) })
+		registered++
+		last = handshakeType
+	}
+	if registered != 110 {
+		t.Fatal("unexpected number of custom patterns", registered)
+	}
+	if patterns[Noise_N].name != "N" || patterns[Noise_NNpsk0].name != "NNpsk0" {
+		t.Fatal("the built-in patterns should not be replaced")
+	}
+
+	// the type of an unregistered pattern can be reused
+	unregisterPattern(last)
+	handshakeType, err := ParseHandshakePattern("NNreused", []string{"-> e", "<- e, ee"})
+	if err != nil || handshakeType != last {
+		t.Fatal("the freed handshake type should be reused", handshakeType, err)
+	}
+}
+
+func TestUnknownTokenInMessage(t *testing.T) {
+	h := initialize(Noise_NX, true, nil, nil, nil, nil, nil)
+	h.messagePatterns = []messagePattern{{token_e, token(42)}}
+	var message []byte
+	_, _, err := h.writeMessage(nil, &message)
+	var tokenErr *UnknownTokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Position != 1 || tokenErr.Token != "token(42)" {
+		t.Fatal("an unknown token should return an UnknownTokenError", err)
+	}
+}
+
+func TestParseHandshakePatternPsk(t *testing.T) {
+	invalid := []struct {
+		name     string
+		messages []string
+	}{
+		{"NNpsk0bad", []string{"-> e", "<- e, ee"}},             // invalid modifier
+		{"NNpsk0", []string{"-> e, psk", "<- e, ee"}},           // not at the beginning
+		{"NNpsk2", []string{"-> psk, e", "<- e, ee"}},           // not in the right message
+		{"NNpsk1", []string{"-> e", "<- e, ee"}},                // missing
+		{"NNpsk3", []string{"-> e", "<- e, ee, psk"}},           // no such message
+		{"NNx", []string{"-> e", "<- e, ee, psk"}},              // no modifier
+		{"NNpsk0+psk2", []string{"-> psk, e", "<- e, ee"}},      // one missing
+		{"NNpsk1+psk2", []string{"-> e, psk", "<- e, psk, ee"}}, // one misplaced
+	}
+	for _, testCase := range invalid {
+		if _, err := ParseHandshakePattern(testCase.name, testCase.messages); err == nil {
+			t.Error("a misplaced psk token should be rejected in", testCase.name)
+		}
+	}
+
+	handshakeType, err := ParseHandshakePattern("NNpsk0+psk2", []string{"-> psk, e", "<- e, ee, psk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterPattern(handshakeType) })
+	psk := make([]byte, 32)
+	initiator := initialize(handshakeType, true, nil, nil, nil, nil, nil)
+	responder := initialize(handshakeType, false, nil, nil, nil, nil, nil)
+	initiator.psk, responder.psk = psk, psk
+	completeHandshake(t, &initiator, &responder)
+}
+
+func TestDescribeWire(t *testing.T) {
+	layouts, err := DescribeWire("Noise_XX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-> ephemeral: 32 bytes cleartext, payload: N bytes cleartext",
+		"<- ephemeral: 32 bytes cleartext, static: 48 bytes AEAD, payload: N+16 bytes AEAD",
+		"-> static: 48 bytes AEAD, payload: N+16 bytes AEAD",
+	}
+	if len(layouts) != len(expected) {
+		t.Fatal("unexpected number of messages", len(layouts))
+	}
+	for idx, layout := range layouts {
+		var fields []string
+		size := 0
+		for _, field := range layout.Fields {
+			fields = append(fields, field.String())
+			size += field.Length
+		}
+		if description := layout.Direction + " " + strings.Join(fields, ", "); description != expected[idx] {
+			t.Fatal("unexpected layout", idx, description)
+		}
+		if size != MessageSize(Noise_XX, idx, 0) {
+			t.Fatal("the layout does not match the size of the message", idx, size)
+		}
+	}
+
+	if _, err = DescribeWire("unknown"); !errors.Is(err, ErrUnknownPattern) {
+		t.Fatal("an unknown pattern should return ErrUnknownPattern", err)
+	}
+}
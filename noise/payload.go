@@ -0,0 +1,76 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+//
+// Payload encoding
+//
+
+// A PayloadCodec encodes several fields into the single payload of a
+// handshake message, and decodes them on the other side.
+type PayloadCodec interface {
+	Encode(fields ...[]byte) ([]byte, error)
+	Decode(payload []byte) ([][]byte, error)
+}
+
+// LengthPrefixedCodec is the default PayloadCodec. Each field is prefixed
+// with its length (2 bytes, big-endian), which is enough as a Noise message
+// cannot be longer than 65535 bytes.
+type LengthPrefixedCodec struct{}
+
+var errFieldTooLong = errors.New("noise: a payload field cannot be longer than 65535 bytes")
+
+// Encode concatenates the fields, each prefixed with its length.
+func (LengthPrefixedCodec) Encode(fields ...[]byte) ([]byte, error) {
+	size := 0
+	for _, field := range fields {
+		if len(field) > math.MaxUint16 {
+			return nil, errFieldTooLong
+		}
+		size += 2 + len(field)
+	}
+	payload := make([]byte, 0, size)
+	for _, field := range fields {
+		payload = append(payload, byte(len(field)>>8), byte(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload, nil
+}
+
+// Decode splits a payload encoded with Encode into its fields. The fields
+// returned point into payload.
+func (LengthPrefixedCodec) Decode(payload []byte) ([][]byte, error) {
+	var fields [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return nil, errors.New("noise: the payload contains a truncated field length")
+		}
+		length := int(binary.BigEndian.Uint16(payload))
+		payload = payload[2:]
+		if len(payload) < length {
+			return nil, errors.New("noise: the payload contains a truncated field")
+		}
+		fields = append(fields, payload[:length])
+		payload = payload[length:]
+	}
+	return fields, nil
+}
+
+// EncodeFields encodes several fields into a payload with the
+// LengthPrefixedCodec. It panics if a field is longer than 65535 bytes.
+func EncodeFields(fields ...[]byte) []byte {
+	payload, err := LengthPrefixedCodec{}.Encode(fields...)
+	if err != nil {
+		panic(err)
+	}
+	return payload
+}
+
+// DecodeFields decodes a payload encoded with EncodeFields.
+func DecodeFields(payload []byte) ([][]byte, error) {
+	return LengthPrefixedCodec{}.Decode(payload)
+}
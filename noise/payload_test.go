@@ -0,0 +1,46 @@
+package noise
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadFields(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+
+	fields := [][]byte{[]byte("v1"), {}, []byte("certificate"), make([]byte, 300)}
+
+	var message, payload []byte
+	if _, _, err := initiator.writeMessage(EncodeFields(fields...), &message); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := responder.readMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeFields(payload)
+	if err != nil {
+		t.Fatal("cannot decode the payload", err)
+	}
+	if len(decoded) != len(fields) {
+		t.Fatal("unexpected number of fields", len(decoded))
+	}
+	for idx := range fields {
+		if !bytes.Equal(decoded[idx], fields[idx]) {
+			t.Fatal("field not decoded correctly", idx)
+		}
+	}
+
+	// truncated payloads
+	encoded := EncodeFields([]byte("hello"))
+	for _, truncated := range [][]byte{encoded[:1], encoded[:len(encoded)-1]} {
+		if _, err = DecodeFields(truncated); err == nil {
+			t.Fatal("a truncated payload should not be decoded")
+		}
+	}
+
+	// too long
+	if _, err = (LengthPrefixedCodec{}).Encode(make([]byte, 65536)); err != errFieldTooLong {
+		t.Fatal("a field too long should not be encoded")
+	}
+}
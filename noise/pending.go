@@ -0,0 +1,98 @@
+package noise
+
+import "errors"
+
+//
+// Pending writes
+//
+
+// QueueWrite queues data to be sent to the other peer as soon as possible.
+// With Config.PiggybackWrites, queued data is sent during the handshake, in
+// the payload of the first handshake message written that is authenticated
+// by its sender and encrypted to the static key of the recipient (see
+// SafePayloadMessages). It saves a round trip for protocols where the client
+// speaks first (for example in the last message of XX) and is received by
+// the other peer through Read. Data that could not be sent during the
+// handshake, because no such message is written by this peer or because it
+// does not fit in the message, is sent once the handshake is completed,
+// before any other write. Once the handshake is completed, QueueWrite is the
+// same as Write. QueueWrite does not start the handshake.
+func (c *Conn) QueueWrite(b []byte) error {
+	c.pendingLock.Lock()
+	if !c.pendingFlushed {
+		c.pendingWrites = append(c.pendingWrites, b...)
+		c.pendingLock.Unlock()
+		return nil
+	}
+	c.pendingLock.Unlock()
+	_, err := c.Write(b)
+	return err
+}
+
+// PendingWrites returns the number of bytes queued by QueueWrite and not
+// sent yet.
+func (c *Conn) PendingWrites() int {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	return len(c.pendingWrites)
+}
+
+// takePendingWrites returns the queued data that can be sent in the payload
+// of the next handshake message, along with payload, the payload Conn sends
+// anyway
+func (c *Conn) takePendingWrites(hs *handshakeState, payload []byte) []byte {
+	processed := len(patterns[hs.handshakeType].messagePatterns) - len(hs.messagePatterns)
+	if !isSafePayloadMessage(hs.handshakeType, processed) {
+		return nil
+	}
+	// what is left in the message once the tokens, the payload, its fields
+	// and the compression flag are written
+	room := NoiseMaxPlaintextSize - messageSize(hs.messagePatterns[0], hs.symmetricState.cipherState.hasKey(), len(hs.psk) > 0, 0) - len(payload) - 4 - 1
+	if room > 0xffff {
+		room = 0xffff
+	}
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if room > len(c.pendingWrites) {
+		room = len(c.pendingWrites)
+	}
+	if room <= 0 {
+		return nil
+	}
+	early := c.pendingWrites[:room:room]
+	c.pendingWrites = c.pendingWrites[room:]
+	return early
+}
+
+// receivePiggybackedWrites separates the payload of a handshake message from
+// the data queued by the other peer, which is buffered to be returned by Read
+func (c *Conn) receivePiggybackedWrites(payload []byte) ([]byte, error) {
+	fields, err := DecodeFields(payload)
+	if err != nil || len(fields) != 2 {
+		return nil, errors.New("noise: invalid handshake payload")
+	}
+	c.inputBuffer = append(c.inputBuffer, fields[1]...)
+	return fields[0], nil
+}
+
+// flushPendingWrites sends the data queued and not sent during the
+// handshake, and makes the next calls to QueueWrite write directly
+func (c *Conn) flushPendingWrites() error {
+	c.pendingLock.Lock()
+	pending := c.pendingWrites
+	c.pendingWrites = nil
+	c.pendingFlushed = true
+	c.pendingLock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	_, err := c.writeRecords(pending)
+	return err
+}
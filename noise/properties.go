@@ -0,0 +1,205 @@
+package noise
+
+import (
+	"errors"
+	"reflect"
+)
+
+//
+// Security properties
+//
+
+// MessageSecurity contains the security levels of the payload of a message,
+// as defined in section 7.7 of the specification. Source goes from 0 (no
+// authentication) to 2 (sender authentication resistant to key-compromise
+// impersonation), Destination from 0 (no confidentiality) to 5 (strong
+// forward secrecy).
+type MessageSecurity struct {
+	Source, Destination int
+}
+
+// Properties summarizes the security properties of a handshake pattern.
+type Properties struct {
+	// the security levels of each handshake message, followed by the ones
+	// of the transport messages when they differ (as in the specification)
+	Messages []MessageSecurity
+
+	// InitiatorAuthentication is true if the payloads sent by the initiator
+	// after the handshake are authenticated, ResponderAuthentication is the
+	// same thing for the responder
+	InitiatorAuthentication bool
+	ResponderAuthentication bool
+
+	// ForwardSecrecy is true if the payloads sent after the handshake, in
+	// both directions, are encrypted with forward secrecy (destination level
+	// 1 or 5)
+	ForwardSecrecy bool
+
+	// the identity hiding grades of section 7.8 of the specification, or -1
+	// if the peer doesn't have a static key (transmitted or known in
+	// advance) or if the grade is not listed by the specification
+	InitiatorIdentityHiding int
+	ResponderIdentityHiding int
+}
+
+// patternSecurity contains the payload security and identity hiding tables
+// of sections 7.7 and 7.8 of the specification
+var patternSecurity = map[noiseHandshakeType]struct {
+	messages       []MessageSecurity
+	identityHiding [2]int
+}{
+	Noise_N:  {[]MessageSecurity{{0, 2}}, [2]int{-1, 3}},
+	Noise_K:  {[]MessageSecurity{{1, 2}}, [2]int{5, 5}},
+	Noise_X:  {[]MessageSecurity{{1, 2}}, [2]int{4, 3}},
+	Noise_NK: {[]MessageSecurity{{0, 2}, {2, 1}, {0, 5}}, [2]int{-1, 3}},
+	Noise_NX: {[]MessageSecurity{{0, 0}, {2, 1}, {0, 5}}, [2]int{-1, 1}},
+	Noise_XK: {[]MessageSecurity{{0, 2}, {2, 1}, {2, 5}, {2, 5}}, [2]int{8, 3}},
+	Noise_XX: {[]MessageSecurity{{0, 0}, {2, 1}, {2, 5}, {2, 5}}, [2]int{8, 1}},
+	Noise_KK: {[]MessageSecurity{{1, 2}, {2, 4}, {2, 5}, {2, 5}}, [2]int{5, 5}},
+	Noise_KX: {[]MessageSecurity{{0, 0}, {2, 3}, {2, 5}, {2, 5}}, [2]int{7, 6}},
+	Noise_IK: {[]MessageSecurity{{1, 2}, {2, 4}, {2, 5}, {2, 5}}, [2]int{4, 3}},
+	Noise_IX: {[]MessageSecurity{{0, 0}, {2, 3}, {2, 5}, {2, 5}}, [2]int{0, 6}},
+}
+
+// PatternProperties returns the security properties of a handshake pattern
+// (for example "XX" or "Noise_XX"), as listed in the specification. This can
+// be used to choose a pattern, or to validate one against a policy. An error
+// is returned for patterns that are not listed in the tables of the
+// specification.
+func PatternProperties(name string) (Properties, error) {
+	handshakeType, err := LookupPattern(name)
+	if err != nil {
+		return Properties{}, err
+	}
+	security, ok := patternSecurity[handshakeType]
+	if !ok {
+		return Properties{}, errors.New("noise: the security properties of " + patterns[handshakeType].name + " are not listed by the specification")
+	}
+
+	properties := Properties{
+		Messages:                append([]MessageSecurity(nil), security.messages...),
+		InitiatorIdentityHiding: security.identityHiding[0],
+		ResponderIdentityHiding: security.identityHiding[1],
+	}
+
+	// the last message of each peer gives the properties of its transport messages
+	last := len(security.messages) - 1
+	initiatorTransport := security.messages[last-last%2]
+	properties.InitiatorAuthentication = initiatorTransport.Source > 0
+	properties.ForwardSecrecy = initiatorTransport.Destination == 1 || initiatorTransport.Destination == 5
+	if last > 0 {
+		responderTransport := security.messages[last-(last+1)%2]
+		properties.ResponderAuthentication = responderTransport.Source > 0
+		properties.ForwardSecrecy = properties.ForwardSecrecy && (responderTransport.Destination == 1 || responderTransport.Destination == 5)
+	} else {
+		// one-way patterns
+		properties.ForwardSecrecy = false
+	}
+
+	return properties, nil
+}
+
+// ErrEarlyPayload is returned when writing a payload in a handshake message
+// where payloads are not safe, see SafePayloadMessages and
+// Config.EnforceSafePayloads.
+var ErrEarlyPayload = errors.New("noise: payloads are not safe in this handshake message")
+
+// SafePayloadMessages returns the indexes (starting at 0) of the handshake
+// messages of a pattern where a payload is authenticated by its sender and
+// encrypted to the static key of the recipient (source level 1 or more and
+// destination level 2 or more). It returns nil if the pattern does not have
+// such messages, or if its security properties are not listed by the
+// specification.
+func SafePayloadMessages(pattern string) []int {
+	handshakeType, err := LookupPattern(pattern)
+	if err != nil {
+		return nil
+	}
+	var safe []int
+	for idx := range patterns[handshakeType].messagePatterns {
+		if isSafePayloadMessage(handshakeType, idx) {
+			safe = append(safe, idx)
+		}
+	}
+	return safe
+}
+
+// isSafePayloadMessage implements SafePayloadMessages for one message
+func isSafePayloadMessage(handshakeType noiseHandshakeType, idx int) bool {
+	security, ok := patternSecurity[handshakeType]
+	if !ok || idx >= len(security.messages) {
+		return false
+	}
+	return security.messages[idx].Source >= 1 && security.messages[idx].Destination >= 2
+}
+
+//
+// Pattern negotiation
+//
+
+// PatternsCompatible returns true if the names a and b (for example "XX" and
+// "Noise_XX") refer to implemented handshake patterns with the same
+// pre-messages and messages, so that an initiator using one can complete a
+// handshake with a responder using the other.
+func PatternsCompatible(a, b string) bool {
+	typeA, err := LookupPattern(a)
+	if err != nil {
+		return false
+	}
+	typeB, err := LookupPattern(b)
+	if err != nil {
+		return false
+	}
+	patternA, patternB := patterns[typeA], patterns[typeB]
+	return reflect.DeepEqual(patternA.preMessagePatterns, patternB.preMessagePatterns) &&
+		reflect.DeepEqual(patternA.messagePatterns, patternB.messagePatterns)
+}
+
+// NegotiatePattern returns the strongest pattern of offered that is
+// compatible with one of supported, as the name given in offered. Patterns
+// are ranked by the number of peers they authenticate, then by the forward
+// secrecy of their transport messages (see PatternProperties); patterns
+// whose properties are not listed by the specification come last. Ties are
+// broken by the order of offered, which can thus list the preferences of the
+// initiator. It returns false if no pattern is supported by both sides.
+func NegotiatePattern(offered, supported []string) (string, bool) {
+	best, bestStrength := -1, -1
+	for i, candidate := range offered {
+		compatible := false
+		for _, name := range supported {
+			if PatternsCompatible(candidate, name) {
+				compatible = true
+				break
+			}
+		}
+		if !compatible {
+			continue
+		}
+		if strength := patternStrength(candidate); strength > bestStrength {
+			best, bestStrength = i, strength
+		}
+	}
+	if best == -1 {
+		return "", false
+	}
+	return offered[best], true
+}
+
+// patternStrength ranks a pattern for NegotiatePattern
+func patternStrength(name string) int {
+	properties, err := PatternProperties(name)
+	if err != nil {
+		return 0
+	}
+	strength := 1
+	if properties.InitiatorAuthentication {
+		strength += 2
+	}
+	if properties.ResponderAuthentication {
+		strength += 2
+	}
+	if properties.ForwardSecrecy {
+		strength++
+	}
+	return strength
+}
@@ -0,0 +1,128 @@
+package noise
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPatternProperties(t *testing.T) {
+	testCases := []struct {
+		name                                        string
+		initiatorAuth, responderAuth, forwardSecret bool
+		initiatorHiding, responderHiding            int
+	}{
+		{"XX", true, true, true, 8, 1},
+		{"Noise_N", false, false, false, -1, 3},
+		{"KK", true, true, true, 5, 5},
+		{"NK", false, true, true, -1, 3},
+		{"K", true, false, false, 5, 5},
+		{"X", true, false, false, 4, 3},
+	}
+	for _, testCase := range testCases {
+		properties, err := PatternProperties(testCase.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if properties.InitiatorAuthentication != testCase.initiatorAuth ||
+			properties.ResponderAuthentication != testCase.responderAuth ||
+			properties.ForwardSecrecy != testCase.forwardSecret ||
+			properties.InitiatorIdentityHiding != testCase.initiatorHiding ||
+			properties.ResponderIdentityHiding != testCase.responderHiding {
+			t.Fatalf("unexpected properties for %s: %+v", testCase.name, properties)
+		}
+	}
+
+	// every supported pattern has a message for each of its handshake messages
+	for _, name := range SupportedPatterns() {
+		properties, err := PatternProperties(name)
+		if err != nil {
+			continue
+		}
+		handshakeType, _ := LookupPattern(name)
+		if len(properties.Messages) < len(patterns[handshakeType].messagePatterns) {
+			t.Fatal("missing message properties for", name)
+		}
+	}
+
+	if _, err := PatternProperties("NNpsk2"); err == nil {
+		t.Fatal("patterns not listed by the specification should return an error")
+	}
+	if _, err := PatternProperties("XY"); !errors.Is(err, ErrUnknownPattern) {
+		t.Fatal("unknown patterns should return ErrUnknownPattern", err)
+	}
+}
+
+func TestSafePayloadMessages(t *testing.T) {
+	testCases := []struct {
+		name string
+		safe []int
+	}{
+		{"XX", []int{2}},
+		{"Noise_IK", []int{0, 1}},
+		{"NK", nil},
+		{"K", []int{0}},
+		{"NNpsk0", nil},
+		{"unknown", nil},
+	}
+	for _, testCase := range testCases {
+		if safe := SafePayloadMessages(testCase.name); !reflect.DeepEqual(safe, testCase.safe) {
+			t.Errorf("unexpected safe messages for %s: %v", testCase.name, safe)
+		}
+	}
+
+	// in enforced mode, a payload in the first message of XX is rejected
+	config := Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), EnforceSafePayloads: true}
+	initiator, _ := NewHandshake(&config, true)
+	config.KeyPair = GenerateKeypair(nil)
+	responder, _ := NewHandshake(&config, false)
+	var message, payload []byte
+	if _, _, err := initiator.writeMessage([]byte("early"), &message); err != ErrEarlyPayload {
+		t.Fatal("a payload in the first message should be rejected", err)
+	}
+	if _, _, err := initiator.writeMessage(nil, &message); err != nil {
+		t.Fatal("an empty payload should be accepted", err)
+	}
+	responder.readMessage(message, &payload)
+	message = message[:0]
+	if _, _, err := responder.writeMessage([]byte("early"), &message); err != ErrEarlyPayload {
+		t.Fatal("a payload in the second message should be rejected", err)
+	}
+	responder.writeMessage(nil, &message)
+	initiator.readMessage(message, &payload)
+	message = message[:0]
+	if _, _, err := initiator.writeMessage([]byte("safe"), &message); err != nil {
+		t.Fatal("a payload in the third message should be accepted", err)
+	}
+	if _, _, err := responder.readMessage(message, &payload); err != nil || string(payload) != "safe" {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiatePattern(t *testing.T) {
+	if !PatternsCompatible("XX", "Noise_XX") || PatternsCompatible("XX", "IK") || PatternsCompatible("XX", "unknown") {
+		t.Fatal("PatternsCompatible should only accept names of the same pattern")
+	}
+
+	testCases := []struct {
+		offered, supported []string
+		pattern            string
+		ok                 bool
+	}{
+		// the strongest pattern is chosen, whatever the order
+		{[]string{"NK", "XX", "N"}, []string{"N", "Noise_XX", "NK"}, "XX", true},
+		// the order of offered breaks ties
+		{[]string{"IK", "XX"}, []string{"XX", "IK"}, "IK", true},
+		{[]string{"XX", "IK"}, []string{"XX", "IK"}, "XX", true},
+		{[]string{"NK", "XX"}, []string{"NK", "KK"}, "NK", true},
+		// disjoint sets
+		{[]string{"XX", "IK"}, []string{"NK", "N"}, "", false},
+		{nil, []string{"XX"}, "", false},
+	}
+	for _, testCase := range testCases {
+		pattern, ok := NegotiatePattern(testCase.offered, testCase.supported)
+		if pattern != testCase.pattern || ok != testCase.ok {
+			t.Fatal("unexpected negotiated pattern", testCase.offered, testCase.supported, pattern, ok)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package noise
+
+import (
+	"errors"
+	"io"
+)
+
+//
+// Renegotiation
+//
+
+// Renegotiation records carry the messages of a new handshake inside the
+// current session. They are encrypted like application data, but are
+// authenticated with renegotiateAD, and their plaintext starts with their
+// type.
+var renegotiateAD = []byte("NoiseGo renegotiate")
+
+const (
+	// the rest of the record is a handshake message
+	renegotiateMessage = 0
+	// the sender has switched to the new key, see finishRenegotiation
+	renegotiateDone = 1
+)
+
+// Renegotiate runs a new handshake with the other peer inside the current
+// session, to obtain fresh transport keys with forward secrecy and to
+// authenticate both peers again. This peer is the initiator of the new
+// handshake and uses config, while the other peer is the responder and uses
+// the Config of its Conn: both must use the same handshake pattern. If the
+// static key of the other peer was known, it must be the same in the new
+// handshake.
+//
+// The messages of the new handshake are processed by the Read method of the
+// other peer, which must be reading from the connection. Writes are blocked
+// until Renegotiate returns, and application data received in the meantime
+// is buffered for the next calls to Read. The current transport keys are
+// used until the new handshake is completed, and each direction then
+// switches to its new key once both peers have derived it. Two peers must not
+// call Renegotiate at the same time, and a failed renegotiation leaves the
+// connection unusable.
+func (c *Conn) Renegotiate(config *Config) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.in == c.out {
+		return errors.New("noise: one-way patterns cannot be renegotiated")
+	}
+
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.inLock.Lock()
+		defer c.inLock.Unlock()
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	if c.closed {
+		return ErrSessionClosed
+	}
+	if c.closeNotifySent || c.closeNotifyReceived {
+		return errors.New("noise: cannot renegotiate after a close notify")
+	}
+	if c.renegotiation != nil || c.pendingIn != nil {
+		return errors.New("noise: a renegotiation is already in progress")
+	}
+
+	hs, err := NewHandshake(config, true)
+	if err != nil {
+		return err
+	}
+	c.renegotiation = hs
+	if err = c.continueRenegotiation(); err != nil {
+		return err
+	}
+
+	for c.renegotiation != nil || c.pendingIn != nil {
+		noiseMessage, err := ReadFrame(c.conn)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrUnexpectedClose
+			}
+			return err
+		}
+		plaintext, renegotiation, err := c.decryptRecord(noiseMessage)
+		if err != nil {
+			return err
+		}
+		if renegotiation {
+			if err = c.handleRenegotiationRecord(plaintext); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(plaintext) == 0 {
+			c.closeNotifyReceived = true
+			return errors.New("noise: the peer sent a close notify during the renegotiation")
+		}
+		c.inputBuffer = append(c.inputBuffer, plaintext...)
+	}
+	return nil
+}
+
+// decryptRecord decrypts a transport message received by a Conn. It returns
+// true if it is a renegotiation record.
+func (c *Conn) decryptRecord(noiseMessage []byte) (plaintext []byte, renegotiation bool, err error) {
+	plaintext, err = c.in.decryptWithAd([]byte{}, noiseMessage)
+	if err == nil {
+		return plaintext, false, nil
+	}
+	// the nonce is only incremented on success
+	if plaintext, renegErr := c.in.decryptWithAd(renegotiateAD, noiseMessage); renegErr == nil {
+		return plaintext, true, nil
+	}
+	return nil, false, err
+}
+
+// handleRenegotiationRecord processes a renegotiation record, and writes the
+// next handshake messages if any. The locks of both directions must be held.
+func (c *Conn) handleRenegotiationRecord(record []byte) error {
+	if len(record) == 0 {
+		return errors.New("noise: invalid renegotiation record")
+	}
+	switch record[0] {
+	case renegotiateMessage:
+		if c.renegotiation == nil {
+			if c.pendingIn != nil {
+				return errors.New("noise: unexpected renegotiation message")
+			}
+			// the other peer started a renegotiation
+			hs, err := NewHandshake(c.config, false)
+			if err != nil {
+				return err
+			}
+			c.renegotiation = hs
+		}
+		var payload []byte
+		c1, c2, err := c.renegotiation.readMessage(record[1:], &payload)
+		if err != nil {
+			c.renegotiation = nil
+			return err
+		}
+		if c1 != nil {
+			return c.finishRenegotiation(c1, c2, false)
+		}
+		return c.continueRenegotiation()
+	case renegotiateDone:
+		if c.pendingIn == nil || len(record) != 1 {
+			return errors.New("noise: unexpected renegotiation record")
+		}
+		c.in.clear()
+		c.in, c.pendingIn = c.pendingIn, nil
+		return nil
+	default:
+		return errors.New("noise: invalid renegotiation record")
+	}
+}
+
+// continueRenegotiation writes the handshake messages of this peer until the
+// other peer has to answer or the handshake is completed
+func (c *Conn) continueRenegotiation() error {
+	hs := c.renegotiation
+	for hs.shouldWrite && !hs.IsHandshakeComplete() {
+		var message []byte
+		c1, c2, err := hs.writeMessage(nil, &message)
+		if err != nil {
+			c.renegotiation = nil
+			return err
+		}
+		if err = c.writeRenegotiationRecord(renegotiateMessage, message); err != nil {
+			return err
+		}
+		if c1 != nil {
+			return c.finishRenegotiation(c1, c2, true)
+		}
+	}
+	return nil
+}
+
+// finishRenegotiation switches to the new transport keys. The peer that read
+// the last handshake message knows that the other peer has derived the new
+// keys: it switches both directions, after sending a renegotiateDone record
+// with its old key. The peer that wrote the last message switches its
+// sending direction right away, and its receiving direction once it receives
+// the renegotiateDone record, as the other peer might have sent data in the
+// meantime.
+func (c *Conn) finishRenegotiation(c1, c2 *cipherState, wroteLast bool) error {
+	hs := c.renegotiation
+	c.renegotiation = nil
+	defer hs.clear()
+	if !c.hs.rs.isEmpty() && hs.rs.PublicKey != c.hs.rs.PublicKey {
+		return errors.New("noise: the peer authenticated with a different static key during the renegotiation")
+	}
+
+	newOut, newIn := c1, c2
+	if !hs.initiator {
+		newOut, newIn = c2, c1
+	}
+	if wroteLast {
+		c.out.clear()
+		c.out, c.pendingIn = newOut, newIn
+		return nil
+	}
+	c.in.clear()
+	c.in = newIn
+	if err := c.writeRenegotiationRecord(renegotiateDone, nil); err != nil {
+		return err
+	}
+	c.out.clear()
+	c.out = newOut
+	return nil
+}
+
+// writeRenegotiationRecord encrypts and sends a renegotiation record
+func (c *Conn) writeRenegotiationRecord(recordType byte, data []byte) error {
+	ciphertext, err := c.out.encryptWithAd(renegotiateAD, append([]byte{recordType}, data...))
+	if err != nil {
+		return err
+	}
+	return WriteFrame(c.conn, ciphertext)
+}
@@ -0,0 +1,104 @@
+package noise
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRenegotiate(t *testing.T) {
+	clientKey := GenerateKeypair(nil)
+	clientConfig := Config{KeyPair: clientKey, HandshakePattern: Noise_XX, PublicKeyVerifier: verifier}
+	serverConfig := Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX, PublicKeyVerifier: verifier}
+
+	// a TCP connection buffers the records of each peer, which can then be
+	// interleaved
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		server := Server(conn, &serverConfig)
+		defer server.Close()
+		// application data sent while the client starts renegotiating
+		if _, err = server.Write([]byte("interleaved")); err != nil {
+			serverErr <- err
+			return
+		}
+		// echo until the connection is closed, the renegotiation is
+		// processed by Read
+		buf := make([]byte, 100)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				serverErr <- err
+				return
+			}
+			if _, err = server.Write(buf[:n]); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, &clientConfig)
+	defer client.Close()
+	if err = client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	oldOut, oldIn := client.out.k, client.in.k
+
+	if err = client.Renegotiate(&Config{KeyPair: clientKey, HandshakePattern: Noise_XX}); err != nil {
+		t.Fatal("cannot renegotiate", err)
+	}
+	if client.out.k == oldOut || client.in.k == oldIn || client.renegotiation != nil || client.pendingIn != nil {
+		t.Fatal("the renegotiation should switch to new transport keys")
+	}
+
+	// the data received during the renegotiation is still readable, and the
+	// connection works with the new keys
+	buf := make([]byte, 100)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "interleaved" {
+		t.Fatal("the interleaved data should be buffered", err, string(buf[:n]))
+	}
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the connection should work with the new keys", err)
+	}
+
+	// as does a second renegotiation
+	if err = client.Renegotiate(&Config{KeyPair: clientKey, HandshakePattern: Noise_XX}); err != nil {
+		t.Fatal("cannot renegotiate again", err)
+	}
+	if _, err = client.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Fatal("the connection should work after a second renegotiation", err)
+	}
+	client.CloseNotify()
+	if err = <-serverErr; err != nil {
+		t.Fatal("server error", err)
+	}
+
+	// the stream has ended
+	if err = client.Renegotiate(&Config{KeyPair: GenerateKeypair(nil), HandshakePattern: Noise_XX}); err == nil {
+		t.Fatal("renegotiating after a close notify should fail")
+	}
+}
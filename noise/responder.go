@@ -0,0 +1,109 @@
+package noise
+
+import (
+	"errors"
+	"sync"
+)
+
+//
+// Multi-pattern responder
+//
+
+// ErrNoMatchingPattern is returned by Responder.Accept when no registered
+// pattern can read the first message, or when several can and none of them
+// authenticates it.
+var ErrNoMatchingPattern = errors.New("noise: no handshake pattern matches the first message")
+
+// A Responder accepts handshakes using different patterns on the same
+// endpoint, for example N, XX and IK. A handshakeState is registered for
+// each pattern; when a first message is received, the patterns it can belong
+// to are selected with GuessPattern, and the message is read by a copy (see
+// Clone) of the state of each of them. Messages whose payload is encrypted,
+// like the first messages of N and IK, can only be read by the right pattern.
+// Others, like the first message of XX, can be read by any pattern whose
+// first message is not encrypted: they are attributed to such a pattern only
+// if no pattern authenticated the message, and if there is a single one.
+//
+// A Responder is safe for concurrent use once the patterns are registered.
+type Responder struct {
+	mu    sync.RWMutex
+	names []string
+	bases map[string]*handshakeState
+}
+
+// NewResponder returns a Responder without any pattern.
+func NewResponder() *Responder {
+	return &Responder{bases: make(map[string]*handshakeState)}
+}
+
+// Register adds a pattern to the Responder. base must be a responder's
+// handshakeState that has not processed any message: it is copied for each
+// handshake, and its prologue cannot be modified afterwards.
+func (r *Responder) Register(base *handshakeState) error {
+	handshakePattern, ok := patterns[base.handshakeType]
+	if !ok || base.messagePatterns == nil {
+		return errors.New("noise: only an initialized handshakeState can be registered")
+	}
+	if base.initiator || len(base.messagePatterns) != len(handshakePattern.messagePatterns) {
+		return errors.New("noise: the handshakeState must be a responder waiting for its first message")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.bases[handshakePattern.name]; ok {
+		return errors.New("noise: pattern " + handshakePattern.name + " is already registered")
+	}
+	if err := base.finishPrologue(); err != nil {
+		return err
+	}
+	r.names = append(r.names, handshakePattern.name)
+	r.bases[handshakePattern.name] = base
+	return nil
+}
+
+// Accept reads the first message of a handshake with the matching registered
+// pattern. It returns the handshakeState of the handshake, to be continued
+// with writeMessage, along with the payload and the name of the pattern. For
+// one-way patterns the handshake is completed and the CipherStates are
+// returned, as readMessage does.
+func (r *Responder) Accept(firstMessage []byte) (h *handshakeState, pattern string, payload []byte, c1, c2 *cipherState, err error) {
+	type attempt struct {
+		h       handshakeState
+		name    string
+		payload []byte
+		c1, c2  *cipherState
+	}
+	var authenticated, unauthenticated []*attempt
+
+	r.mu.RLock()
+	for _, name := range GuessPattern(firstMessage, r.names) {
+		a := &attempt{h: r.bases[name].Clone(), name: name}
+		if a.c1, a.c2, err = a.h.readMessage(firstMessage, &a.payload); err != nil {
+			continue
+		}
+		// the payload was decrypted with a key derived from a DH
+		if a.h.symmetricState.cipherState.hasKey() {
+			authenticated = append(authenticated, a)
+		} else {
+			unauthenticated = append(unauthenticated, a)
+		}
+	}
+	r.mu.RUnlock()
+
+	candidates := authenticated
+	if len(candidates) == 0 {
+		candidates = unauthenticated
+	}
+	if len(candidates) != 1 {
+		for _, a := range append(authenticated, unauthenticated...) {
+			a.h.clear()
+		}
+		return nil, "", nil, nil, nil, ErrNoMatchingPattern
+	}
+	for _, a := range append(authenticated, unauthenticated...) {
+		if a != candidates[0] {
+			a.h.clear()
+		}
+	}
+	a := candidates[0]
+	return &a.h, a.name, a.payload, a.c1, a.c2, nil
+}
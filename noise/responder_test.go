@@ -0,0 +1,71 @@
+package noise
+
+import "testing"
+
+func TestResponder(t *testing.T) {
+	serverKey := GenerateKeypair(nil)
+	remoteKey := &KeyPair{PublicKey: serverKey.PublicKey}
+	responder := NewResponder()
+	for _, handshakeType := range []noiseHandshakeType{Noise_N, Noise_XX, Noise_IK} {
+		base := initialize(handshakeType, false, nil, serverKey, nil, nil, nil)
+		if err := responder.Register(&base); err != nil {
+			t.Fatal("cannot register the pattern", err)
+		}
+	}
+	duplicate := initialize(Noise_XX, false, nil, serverKey, nil, nil, nil)
+	if err := responder.Register(&duplicate); err == nil {
+		t.Fatal("a pattern cannot be registered twice")
+	}
+
+	clients := []struct {
+		pattern string
+		h       handshakeState
+	}{
+		{"N", initialize(Noise_N, true, nil, nil, nil, remoteKey, nil)},
+		{"XX", initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)},
+		{"IK", initialize(Noise_IK, true, nil, GenerateKeypair(nil), nil, remoteKey, nil)},
+	}
+	for _, client := range clients {
+		var message []byte
+		c1, _, err := client.h.writeMessage([]byte("hello from "+client.pattern), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, pattern, payload, r1, _, err := responder.Accept(message)
+		if err != nil || pattern != client.pattern || string(payload) != "hello from "+client.pattern {
+			t.Fatal("the first message was not accepted with the right pattern", client.pattern, pattern, err)
+		}
+
+		var initiatorSession, responderSession *Session
+		if h.IsHandshakeComplete() {
+			initiatorSession, responderSession = newSession(true, c1, nil), newSession(false, r1, nil)
+		} else {
+			initiatorSession, responderSession = completeHandshake(t, &client.h, h)
+		}
+		ciphertext, _ := initiatorSession.Encrypt([]byte("transport"))
+		if plaintext, err := responderSession.Decrypt(ciphertext); err != nil || string(plaintext) != "transport" {
+			t.Fatal("the sessions do not match", client.pattern, err)
+		}
+	}
+
+	// a message to another server can only be read as XX, the others fail
+	wrongServer := initialize(Noise_IK, true, nil, GenerateKeypair(nil), nil, &KeyPair{PublicKey: GenerateKeypair(nil).PublicKey}, nil)
+	var message []byte
+	wrongServer.writeMessage(nil, &message)
+	if _, pattern, _, _, _, err := responder.Accept(message); err != nil || pattern != "XX" {
+		t.Fatal("an unauthenticated message should be attributed to the only unencrypted pattern", pattern, err)
+	}
+	if _, _, _, _, _, err := responder.Accept(message[:dhLen-1]); err != ErrNoMatchingPattern {
+		t.Fatal("a message too short for all the patterns should not match", err)
+	}
+
+	// XX and NX cannot be told apart from their first message
+	ambiguous := NewResponder()
+	for _, handshakeType := range []noiseHandshakeType{Noise_XX, Noise_NX} {
+		base := initialize(handshakeType, false, nil, serverKey, nil, nil, nil)
+		ambiguous.Register(&base)
+	}
+	if _, _, _, _, _, err := ambiguous.Accept(message); err != ErrNoMatchingPattern {
+		t.Fatal("an ambiguous message should not match", err)
+	}
+}
@@ -0,0 +1,93 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+)
+
+//
+// Self-test
+//
+
+// selfTestKAT contains the known answers checked by SelfTest, in hex
+var selfTestKAT = struct {
+	dh            string
+	kdf           string
+	handshakeHash string
+	ciphertext    string
+}{
+	dh:            "93fea2a7c1aeb62cfd6452ff5badae8bdffcbd7196dc910c89944006d85dbb68",
+	kdf:           "784741545cf44ec227688367daacf51c1a171b0418e680f3dc135e0ea412f200",
+	handshakeHash: "0240ee61c91c1244a589bbb8749166cc375d41c7f0cb90fdadb84e5f4e1ba015",
+	ciphertext:    "6db64cc21ed3c4b6f82ce4c9ed857265486250a32060e43fb82db94a4e2bb0398c",
+}
+
+// SelfTest checks the cryptographic primitives of the package against known
+// answers: a DH, the KDF, and a complete Noise_XX handshake with fixed keys
+// whose handshake hash and first transport message are compared to the
+// expected ones. Applications can call it at startup to fail early if the
+// primitives do not behave as expected, for example after a change in a
+// dependency or a miscompilation.
+func SelfTest() error {
+	// DH
+	alice, err := GenerateKeypairErr(&[32]byte{1})
+	if err != nil {
+		return err
+	}
+	bob, err := GenerateKeypairErr(&[32]byte{2})
+	if err != nil {
+		return err
+	}
+	shared, err := dh(*alice, bob.PublicKey)
+	if err != nil || !matchesKAT(shared[:], selfTestKAT.dh) {
+		return errors.New("noise: self-test failed: unexpected DH output")
+	}
+
+	// KDF
+	if !matchesKAT(KDF([]byte("NoiseGo self-test"), []byte("kdf"), 32), selfTestKAT.kdf) {
+		return errors.New("noise: self-test failed: unexpected KDF output")
+	}
+
+	// handshake
+	keys := make([]*KeyPair, 4)
+	for i := range keys {
+		if keys[i], err = GenerateKeypairErr(&[32]byte{byte(3 + i)}); err != nil {
+			return err
+		}
+	}
+	initiator, err := newHandshakeState(Noise_XX, "", CipherChaChaPoly, true, []byte("NoiseGo self-test"), keys[0], nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	responder, err := newHandshakeState(Noise_XX, "", CipherChaChaPoly, false, []byte("NoiseGo self-test"), keys[1], nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	initiator.debugEphemeral, responder.debugEphemeral = keys[2], keys[3]
+	writer, reader := &initiator, &responder
+	var c1 *cipherState
+	for c1 == nil {
+		var message, payload []byte
+		if c1, _, err = writer.writeMessage([]byte("payload"), &message); err != nil {
+			return err
+		}
+		if _, _, err = reader.readMessage(message, &payload); err != nil || string(payload) != "payload" {
+			return errors.New("noise: self-test failed: the handshake did not complete")
+		}
+		writer, reader = reader, writer
+	}
+	if initiator.symmetricState.h != responder.symmetricState.h || !matchesKAT(initiator.symmetricState.h[:], selfTestKAT.handshakeHash) {
+		return errors.New("noise: self-test failed: unexpected handshake hash")
+	}
+	ciphertext, err := c1.encryptWithAd([]byte{}, []byte("transport message"))
+	if err != nil || !matchesKAT(ciphertext, selfTestKAT.ciphertext) {
+		return errors.New("noise: self-test failed: unexpected transport message")
+	}
+	return nil
+}
+
+func matchesKAT(output []byte, kat string) bool {
+	expected, err := hex.DecodeString(kat)
+	return err == nil && bytes.Equal(output, expected)
+}
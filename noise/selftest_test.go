@@ -0,0 +1,27 @@
+package noise
+
+import "testing"
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	kats := []*string{&selfTestKAT.dh, &selfTestKAT.kdf, &selfTestKAT.handshakeHash, &selfTestKAT.ciphertext}
+	for _, kat := range kats {
+		original := *kat
+		// flip the last hex digit
+		corrupted := []byte(original)
+		if corrupted[len(corrupted)-1] == '0' {
+			corrupted[len(corrupted)-1] = '1'
+		} else {
+			corrupted[len(corrupted)-1] = '0'
+		}
+		*kat = string(corrupted)
+		err := SelfTest()
+		*kat = original
+		if err == nil {
+			t.Fatal("a corrupted known answer should make the self-test fail", original)
+		}
+	}
+}
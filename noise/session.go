@@ -0,0 +1,519 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+//
+// Session object
+//
+
+// A Session holds the two CipherState objects returned at the end of a
+// handshake. It can be used to encrypt and decrypt transport messages
+// without going through the net.Conn interface.
+//
+// A Session is safe for concurrent use. Each direction has its own lock, so
+// encrypting and decrypting do not contend. Within a direction, the order
+// of the messages (and thus the order in which the other peer must decrypt
+// them) is the order in which the lock is acquired.
+type Session struct {
+	initiator       bool
+	in, out         *cipherState
+	inLock, outLock sync.Mutex
+
+	// key usage limits, see SetKeyUsageLimits
+	maxMessages, maxBytes uint64
+	sent, received        keyUsage
+
+	// if set, see SetPaddingPolicy
+	padding PaddingPolicy
+
+	// set if a direction was dropped by SendOnly or ReceiveOnly, protected
+	// by the lock of the direction
+	inDropped, outDropped bool
+
+	// set by Close
+	closed bool
+}
+
+// keyUsage counts the messages and bytes processed in one direction
+type keyUsage struct {
+	messages, bytes uint64
+}
+
+// Default limits on the number of messages and bytes that can be processed
+// in each direction of a Session. They can be changed with SetKeyUsageLimits.
+const (
+	DefaultMaxMessages = 1 << 48
+	DefaultMaxBytes    = 1 << 60
+)
+
+// ErrKeyExhausted is returned by a Session once a direction has reached its
+// key usage limit. The application should then rekey or reconnect.
+var ErrKeyExhausted = errors.New("noise: key usage limit reached for this session")
+
+// ErrSessionClosed is returned when a Session or a Conn is used after a call
+// to Close.
+var ErrSessionClosed = errors.New("noise: the session is closed")
+
+var errNoWriteChannel = errors.New("noise: this session cannot encrypt with a one-way pattern")
+var errNoReadChannel = errors.New("noise: this session cannot decrypt with a one-way pattern")
+
+// newSession creates a Session out of the two CipherState objects returned by
+// the last call to writeMessage or readMessage. The first CipherState is used
+// to encrypt messages from the initiator to the responder, the second one for
+// messages in the other direction. In one-way patterns c2 is nil and only
+// one direction is available.
+func newSession(initiator bool, c1, c2 *cipherState) *Session {
+	s := &Session{
+		initiator:   initiator,
+		maxMessages: DefaultMaxMessages,
+		maxBytes:    DefaultMaxBytes,
+	}
+	if initiator {
+		s.out, s.in = c1, c2
+	} else {
+		s.out, s.in = c2, c1
+	}
+	return s
+}
+
+// SetKeyUsageLimits sets the maximum number of messages and of plaintext
+// bytes that can be encrypted, and decrypted, in each direction of the
+// Session. Once a limit is reached, Encrypt or Decrypt return ErrKeyExhausted.
+func (s *Session) SetKeyUsageLimits(maxMessages, maxBytes uint64) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.maxMessages = maxMessages
+	s.maxBytes = maxBytes
+}
+
+// SetPaddingPolicy pads the messages encrypted by the Session according to
+// policy, see padding.go. The length of the plaintext is encoded at the start
+// of the padded message, and both are encrypted. The other peer must set a
+// padding policy as well to decrypt them (any policy, it is only used to
+// encrypt). A nil policy disables padding. The policy is not serialized by
+// MarshalBinary.
+func (s *Session) SetPaddingPolicy(policy PaddingPolicy) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.padding = policy
+}
+
+// allows returns false if processing a message of length bytes would go over
+// the key usage limits of the Session. The limits can be lowered below the
+// current usage by SetKeyUsageLimits.
+func (s *Session) allows(usage keyUsage, length int) bool {
+	return usage.messages < s.maxMessages && usage.bytes <= s.maxBytes && uint64(length) <= s.maxBytes-usage.bytes
+}
+
+func (u *keyUsage) add(length int) {
+	u.messages++
+	u.bytes += uint64(length)
+}
+
+// Encrypt encrypts a transport message with empty associated data.
+func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
+	return s.EncryptWithAD([]byte{}, plaintext)
+}
+
+// Decrypt decrypts a transport message with empty associated data.
+func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
+	return s.DecryptWithAD([]byte{}, ciphertext)
+}
+
+// EncryptWithAD encrypts a transport message and authenticates the associated
+// data ad along with it. The associated data is not part of the ciphertext:
+// it must be passed unmodified to DecryptWithAD by the other peer.
+func (s *Session) EncryptWithAD(ad, plaintext []byte) ([]byte, error) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if s.out == nil {
+		return nil, missingDirection(s.outDropped, errNoWriteChannel)
+	}
+	if s.padding != nil {
+		var err error
+		if plaintext, err = pad(s.padding, plaintext); err != nil {
+			return nil, err
+		}
+	}
+	if !s.allows(s.sent, len(plaintext)) {
+		return nil, ErrKeyExhausted
+	}
+	ciphertext, err := s.out.encryptWithAd(ad, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.sent.add(len(plaintext))
+	return ciphertext, nil
+}
+
+// DecryptWithAD decrypts a transport message and verifies the associated data
+// ad. If ad differs from the one used by the other peer, decryption fails.
+func (s *Session) DecryptWithAD(ad, ciphertext []byte) ([]byte, error) {
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if s.in == nil {
+		return nil, missingDirection(s.inDropped, errNoReadChannel)
+	}
+	if len(ciphertext) == NoiseTagLength {
+		// this might be a rekey control record
+		if _, err := s.in.decryptWithAd(rekeyAD, ciphertext); err == nil {
+			s.in.Rekey()
+			s.received = keyUsage{}
+			return []byte{}, nil
+		}
+	}
+	// the plaintext is NoiseTagLength bytes shorter than the ciphertext
+	length := len(ciphertext) - NoiseTagLength
+	if length < 0 {
+		length = 0
+	}
+	if !s.allows(s.received, length) {
+		return nil, ErrKeyExhausted
+	}
+	plaintext, err := s.in.decryptWithAd(ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.received.add(len(plaintext))
+	if s.padding != nil {
+		return unpad(plaintext)
+	}
+	return plaintext, nil
+}
+
+// rekeyAD is the associated data of rekey control records
+var rekeyAD = []byte("NoiseGo rekey")
+
+// SendRekey returns a rekey control record, to be sent to the other peer as
+// any transport message, and then rekeys the sending direction of the
+// Session. When the other peer decrypts the control record, it rekeys its
+// receiving direction: all the following messages are encrypted and
+// decrypted with the new key. This requires messages to be delivered in
+// order. A control record is an encrypted empty message, authenticated with
+// associated data specific to rekeying, and Decrypt returns an empty
+// plaintext for it. The key usage counters of the direction are reset.
+func (s *Session) SendRekey() ([]byte, error) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if s.out == nil {
+		return nil, missingDirection(s.outDropped, errNoWriteChannel)
+	}
+	record, err := s.out.encryptWithAd(rekeyAD, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	s.out.Rekey()
+	s.sent = keyUsage{}
+	return record, nil
+}
+
+// SendOnly erases the key used to decrypt, for sessions that only send
+// messages: Decrypt then returns ErrWrongDirection.
+func (s *Session) SendOnly() {
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.in.clear()
+	s.in = nil
+	s.inDropped = true
+}
+
+// ReceiveOnly erases the key used to encrypt, for sessions that only receive
+// messages: Encrypt then returns ErrWrongDirection.
+func (s *Session) ReceiveOnly() {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.out.clear()
+	s.out = nil
+	s.outDropped = true
+}
+
+// missingDirection returns the error for a direction that is not available:
+// ErrWrongDirection if it was dropped, oneWay for one-way patterns
+func missingDirection(dropped bool, oneWay error) error {
+	if dropped {
+		return ErrWrongDirection
+	}
+	return oneWay
+}
+
+// Close erases the transport keys of the Session. Encrypt and Decrypt then
+// return ErrSessionClosed.
+func (s *Session) Close() error {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.closed = true
+	s.out.clear()
+	s.in.clear()
+	return nil
+}
+
+// serializedCipherStateLen is the length of a serialized cipherState: its
+// key, its nonce and its cipher function
+const serializedCipherStateLen = 32 + 8 + 1
+
+// MarshalBinary serializes the Session, so that it can be restored with
+// UnmarshalBinary after a restart of the process. The output contains the
+// transport keys: anyone reading it can decrypt and forge the messages of
+// both directions, past and future ones until the next rekey. It should thus
+// be encrypted before being stored, as EncodePrivateKeyPEM does for private
+// keys: with ChaChaPoly under a key derived by KDF from a secret that is not
+// stored along with it (or by argon2id from a passphrase). It should be
+// erased once restored. The Session must not be used after being serialized,
+// otherwise the restored one would reuse its nonces. The directions dropped
+// by SendOnly and ReceiveOnly remain dropped.
+func (s *Session) MarshalBinary() ([]byte, error) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	out := []byte{boolToByte(s.initiator) | boolToByte(s.in != nil)<<1 | boolToByte(s.out != nil)<<2 |
+		boolToByte(s.inDropped)<<3 | boolToByte(s.outDropped)<<4}
+	for _, c := range []*cipherState{s.in, s.out} {
+		if c == nil {
+			continue
+		}
+		out = append(out, c.k[:]...)
+		out = binary.BigEndian.AppendUint64(out, c.n)
+		out = append(out, byte(c.cipher))
+	}
+	for _, v := range []uint64{s.maxMessages, s.maxBytes, s.sent.messages, s.sent.bytes, s.received.messages, s.received.bytes} {
+		out = binary.BigEndian.AppendUint64(out, v)
+	}
+	return out, nil
+}
+
+// UnmarshalBinary restores a Session serialized by MarshalBinary. It must be
+// called on a new Session.
+func (s *Session) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("noise: invalid serialized session")
+	}
+	flags := data[0]
+	directions := int(flags>>1&1) + int(flags>>2&1)
+	if flags > 31 || len(data) != 1+directions*serializedCipherStateLen+6*8 {
+		return errors.New("noise: invalid serialized session")
+	}
+	// a dropped direction has no key
+	if hasKeys, dropped := flags>>1&3, flags>>3&3; hasKeys&dropped != 0 {
+		return errors.New("noise: invalid serialized session")
+	}
+	data = data[1:]
+
+	var states [2]*cipherState
+	for i := range states {
+		if flags>>(1+i)&1 == 0 {
+			continue
+		}
+		c := &cipherState{cipher: CipherFunction(data[40]), n: binary.BigEndian.Uint64(data[32:40])}
+		if c.cipher != CipherChaChaPoly && c.cipher != CipherAESGCM {
+			return errors.New("noise: invalid serialized session")
+		}
+		copy(c.k[:], data[:32])
+		states[i] = c
+		data = data[serializedCipherStateLen:]
+	}
+
+	var counters [6]uint64
+	for i := range counters {
+		counters[i] = binary.BigEndian.Uint64(data[i*8:])
+	}
+
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+	s.inLock.Lock()
+	defer s.inLock.Unlock()
+	s.initiator = flags&1 == 1
+	s.in, s.out = states[0], states[1]
+	s.inDropped, s.outDropped = flags>>3&1 == 1, flags>>4&1 == 1
+	s.maxMessages, s.maxBytes = counters[0], counters[1]
+	s.sent = keyUsage{counters[2], counters[3]}
+	s.received = keyUsage{counters[4], counters[5]}
+	s.closed = false
+	return nil
+}
+
+//
+// Half sessions
+//
+
+// A HalfSession is one direction of a transport session: it can either only
+// encrypt, or only decrypt. Unlike a Session it has no lock and is meant to
+// be owned by a single goroutine. As the two halves returned by
+// NewHalfSessions share no state, a goroutine can encrypt with one while
+// another decrypts with the other.
+type HalfSession struct {
+	c       *cipherState
+	sending bool
+}
+
+// ErrWrongDirection is returned when encrypting with the read half of a
+// session, or decrypting with its write half. It is also returned by a
+// Session for a direction dropped by SendOnly or ReceiveOnly.
+var ErrWrongDirection = errors.New("noise: this half session cannot be used in this direction")
+
+// NewHalfSessions creates the read and write halves of a session out of the
+// two CipherState objects returned at the end of a handshake, like a Session.
+// In one-way patterns c2 is nil, and the half that would use it is nil.
+func NewHalfSessions(initiator bool, c1, c2 *cipherState) (read, write *HalfSession) {
+	in, out := c2, c1
+	if !initiator {
+		in, out = c1, c2
+	}
+	if in != nil {
+		read = &HalfSession{c: in}
+	}
+	if out != nil {
+		write = &HalfSession{c: out, sending: true}
+	}
+	return read, write
+}
+
+// Encrypt encrypts a transport message with empty associated data.
+func (s *HalfSession) Encrypt(plaintext []byte) ([]byte, error) {
+	return s.EncryptWithAD([]byte{}, plaintext)
+}
+
+// Decrypt decrypts a transport message with empty associated data.
+func (s *HalfSession) Decrypt(ciphertext []byte) ([]byte, error) {
+	return s.DecryptWithAD([]byte{}, ciphertext)
+}
+
+// EncryptWithAD encrypts a transport message and authenticates the
+// associated data ad along with it, see Session.EncryptWithAD.
+func (s *HalfSession) EncryptWithAD(ad, plaintext []byte) ([]byte, error) {
+	if !s.sending {
+		return nil, ErrWrongDirection
+	}
+	return s.c.encryptWithAd(ad, plaintext)
+}
+
+// DecryptWithAD decrypts a transport message and verifies the associated
+// data ad, see Session.DecryptWithAD.
+func (s *HalfSession) DecryptWithAD(ad, ciphertext []byte) ([]byte, error) {
+	if s.sending {
+		return nil, ErrWrongDirection
+	}
+	return s.c.decryptWithAd(ad, ciphertext)
+}
+
+//
+// Sequenced sessions
+//
+
+// ErrOutOfOrder is returned by a SequencedSession when a record does not
+// carry the next sequence number: it has been replayed, reordered, or a
+// record before it has been lost.
+var ErrOutOfOrder = errors.New("noise: the record was received out of order")
+
+// A SequencedSession wraps a Session for reliable, ordered transports. Each
+// record starts with its sequence number (8 bytes, big-endian), which is also
+// authenticated as the associated data of the ciphertext. Records must be
+// decrypted in the order they were encrypted: any other record is rejected
+// with ErrOutOfOrder before being decrypted. A Session alone already rejects
+// such records as its nonces are implicit, but the error cannot be told apart
+// from a corrupted record. For transports that can drop or reorder records,
+// use a DatagramSession and its sliding window instead.
+//
+// The Session must not be used directly anymore, nor rekeyed via SendRekey.
+// A SequencedSession is safe for concurrent use.
+type SequencedSession struct {
+	s                  *Session
+	sendSeq, recvSeq   uint64
+	sendLock, recvLock sync.Mutex
+}
+
+// MarshalBinary serializes the SequencedSession along with its Session, see
+// Session.MarshalBinary and its security caveats.
+func (q *SequencedSession) MarshalBinary() ([]byte, error) {
+	q.sendLock.Lock()
+	defer q.sendLock.Unlock()
+	q.recvLock.Lock()
+	defer q.recvLock.Unlock()
+	out, err := q.s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out = binary.BigEndian.AppendUint64(out, q.sendSeq)
+	return binary.BigEndian.AppendUint64(out, q.recvSeq), nil
+}
+
+// UnmarshalBinary restores a SequencedSession serialized by MarshalBinary. It
+// must be called on a new SequencedSession.
+func (q *SequencedSession) UnmarshalBinary(data []byte) error {
+	if len(data) < 16 {
+		return errors.New("noise: invalid serialized session")
+	}
+	s := new(Session)
+	if err := s.UnmarshalBinary(data[:len(data)-16]); err != nil {
+		return err
+	}
+	q.sendLock.Lock()
+	defer q.sendLock.Unlock()
+	q.recvLock.Lock()
+	defer q.recvLock.Unlock()
+	q.s = s
+	q.sendSeq = binary.BigEndian.Uint64(data[len(data)-16:])
+	q.recvSeq = binary.BigEndian.Uint64(data[len(data)-8:])
+	return nil
+}
+
+// NewSequencedSession wraps s in a SequencedSession. The key usage limits of
+// s still apply.
+func NewSequencedSession(s *Session) *SequencedSession {
+	return &SequencedSession{s: s}
+}
+
+// Encrypt encrypts plaintext in a record carrying the next sequence number.
+func (q *SequencedSession) Encrypt(plaintext []byte) ([]byte, error) {
+	q.sendLock.Lock()
+	defer q.sendLock.Unlock()
+	seq := binary.BigEndian.AppendUint64(make([]byte, 0, 8), q.sendSeq)
+	ciphertext, err := q.s.EncryptWithAD(seq, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	q.sendSeq++
+	return append(seq, ciphertext...), nil
+}
+
+// Decrypt verifies that record carries the next sequence number and decrypts
+// it.
+func (q *SequencedSession) Decrypt(record []byte) ([]byte, error) {
+	if len(record) < 8+NoiseTagLength {
+		return nil, errors.New("noise: the record received is too short")
+	}
+	q.recvLock.Lock()
+	defer q.recvLock.Unlock()
+	if binary.BigEndian.Uint64(record[:8]) != q.recvSeq {
+		return nil, ErrOutOfOrder
+	}
+	plaintext, err := q.s.DecryptWithAD(record[:8], record[8:])
+	if err != nil {
+		return nil, err
+	}
+	q.recvSeq++
+	return plaintext, nil
+}
@@ -0,0 +1,507 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// completeHandshake goes through all the remaining message patterns of two
+// handshakeStates and returns the Sessions obtained by the initiator and the responder
+func completeHandshake(t *testing.T, a, b *handshakeState) (*Session, *Session) {
+	writer, reader := a, b
+	if !writer.shouldWrite {
+		writer, reader = b, a
+	}
+	for {
+		var message, payload []byte
+		c1, c2, err := writer.writeMessage(nil, &message)
+		if err != nil {
+			t.Fatal("handshake message failed to be written", err)
+		}
+		r1, r2, err := reader.readMessage(message, &payload)
+		if err != nil {
+			t.Fatal("handshake message failed to be read", err)
+		}
+		if c1 != nil {
+			if r1 == nil {
+				t.Fatal("peers did not finish the handshake at the same time")
+			}
+			writerSession := newSession(writer.initiator, c1, c2)
+			readerSession := newSession(reader.initiator, r1, r2)
+			if writer.initiator {
+				return writerSession, readerSession
+			}
+			return readerSession, writerSession
+		}
+		writer, reader = reader, writer
+	}
+}
+
+func newTestSessions(t *testing.T) (*Session, *Session) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	return completeHandshake(t, &initiator, &responder)
+}
+
+func TestSessionAD(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+
+	header := []byte("packet header")
+
+	// same AD on both sides
+	ciphertext, err := initiator.EncryptWithAD(header, []byte("hello"))
+	if err != nil {
+		t.Fatal("cannot encrypt", err)
+	}
+	plaintext, err := responder.DecryptWithAD(header, ciphertext)
+	if err != nil {
+		t.Fatal("cannot decrypt", err)
+	}
+	if !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("decrypted message is not correct")
+	}
+
+	// different AD
+	ciphertext, err = responder.EncryptWithAD(header, []byte("ca va?"))
+	if err != nil {
+		t.Fatal("cannot encrypt", err)
+	}
+	if _, err = initiator.DecryptWithAD([]byte("another header"), ciphertext); err == nil {
+		t.Fatal("a mismatched AD should not authenticate")
+	}
+	if _, err = initiator.Decrypt(ciphertext); err == nil {
+		t.Fatal("a missing AD should not authenticate")
+	}
+
+	// a failed decryption shouldn't have modified the state
+	plaintext, err = initiator.DecryptWithAD(header, ciphertext)
+	if err != nil || !bytes.Equal(plaintext, []byte("ca va?")) {
+		t.Fatal("cannot decrypt after an authentication failure", err)
+	}
+}
+
+func TestSessionKeyUsageLimits(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	initiator.SetKeyUsageLimits(3, 10)
+	responder.SetKeyUsageLimits(3, 10)
+
+	// message limit
+	for i := 0; i < 3; i++ {
+		ciphertext, err := initiator.Encrypt([]byte{byte(i)})
+		if err != nil {
+			t.Fatal("cannot encrypt before the limit", err)
+		}
+		if _, err = responder.Decrypt(ciphertext); err != nil {
+			t.Fatal("cannot decrypt before the limit", err)
+		}
+	}
+	if _, err := initiator.Encrypt([]byte{3}); err != ErrKeyExhausted {
+		t.Fatal("encrypting over the message limit should fail", err)
+	}
+
+	// byte limit, in the other direction
+	ciphertext, err := responder.Encrypt(make([]byte, 10))
+	if err != nil {
+		t.Fatal("cannot encrypt up to the byte limit", err)
+	}
+	if _, err = initiator.Decrypt(ciphertext); err != nil {
+		t.Fatal("cannot decrypt up to the byte limit", err)
+	}
+	if _, err = responder.Encrypt([]byte{0}); err != ErrKeyExhausted {
+		t.Fatal("encrypting over the byte limit should fail", err)
+	}
+
+	// the receiving side enforces its own limits
+	responder.SetKeyUsageLimits(3, 20)
+	initiator.SetKeyUsageLimits(3, 10)
+	ciphertext, _ = responder.Encrypt([]byte{0})
+	if _, err = initiator.Decrypt(ciphertext); err != ErrKeyExhausted {
+		t.Fatal("decrypting over the byte limit should fail", err)
+	}
+
+	// lowering a limit below the current usage
+	initiator, responder = newTestSessions(t)
+	for i := 0; i < 2; i++ {
+		ciphertext, _ = initiator.Encrypt(make([]byte, 10))
+		if _, err = responder.Decrypt(ciphertext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initiator.SetKeyUsageLimits(100, 15)
+	responder.SetKeyUsageLimits(100, 15)
+	if _, err = initiator.Encrypt([]byte{0}); err != ErrKeyExhausted {
+		t.Fatal("encrypting over a lowered byte limit should fail", err)
+	}
+	initiator.SetKeyUsageLimits(100, DefaultMaxBytes)
+	ciphertext, _ = initiator.Encrypt([]byte{0})
+	if _, err = responder.Decrypt(ciphertext); err != ErrKeyExhausted {
+		t.Fatal("decrypting over a lowered byte limit should fail", err)
+	}
+}
+
+func TestSessionConcurrency(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	const routines, messages = 8, 20
+
+	// encrypt from several goroutines, in both directions
+	var wg sync.WaitGroup
+	results := make(chan []byte, routines*messages)
+	answers := make(chan []byte, routines*messages)
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				ciphertext, err := initiator.Encrypt([]byte("hello"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				results <- ciphertext
+				answer, err := responder.Encrypt([]byte("ca va?"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				answers <- answer
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	close(answers)
+
+	// the order of the ciphertexts is lost: decrypt them from several
+	// goroutines by trial, a failed decryption does not modify the state
+	for _, test := range []struct {
+		session     *Session
+		ciphertexts chan []byte
+	}{{responder, results}, {initiator, answers}} {
+		var ciphertexts [][]byte
+		for ciphertext := range test.ciphertexts {
+			ciphertexts = append(ciphertexts, ciphertext)
+		}
+		decrypted := make([]int32, len(ciphertexts))
+		var total int32
+		for i := 0; i < routines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for atomic.LoadInt32(&total) < int32(len(ciphertexts)) {
+					for idx, ciphertext := range ciphertexts {
+						if atomic.LoadInt32(&decrypted[idx]) == 1 {
+							continue
+						}
+						if _, err := test.session.Decrypt(ciphertext); err == nil {
+							atomic.StoreInt32(&decrypted[idx], 1)
+							atomic.AddInt32(&total, 1)
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if total != routines*messages {
+			t.Fatal("unexpected number of decrypted messages", total)
+		}
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	initiatorSession, responderSession := completeHandshake(t, &initiator, &responder)
+
+	ciphertext, _ := initiatorSession.Encrypt([]byte("hello"))
+	if err := responderSession.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responderSession.Decrypt(ciphertext); err != ErrSessionClosed {
+		t.Fatal("decrypting after Close should return ErrSessionClosed", err)
+	}
+	if _, err := responderSession.Encrypt([]byte("hello")); err != ErrSessionClosed {
+		t.Fatal("encrypting after Close should return ErrSessionClosed", err)
+	}
+	if responderSession.in.k != [32]byte{} || responderSession.out.k != [32]byte{} {
+		t.Fatal("the transport keys should be erased")
+	}
+}
+
+func TestSessionSendRekey(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	initiatorSession, responderSession := completeHandshake(t, &initiator, &responder)
+	initiatorSession.SetKeyUsageLimits(2, DefaultMaxBytes)
+	responderSession.SetKeyUsageLimits(2, DefaultMaxBytes)
+
+	oldKey := initiatorSession.out.k
+	for i := 0; i < 3; i++ {
+		for _, message := range []string{"before", ""} {
+			ciphertext, err := initiatorSession.Encrypt([]byte(message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := responderSession.Decrypt(ciphertext)
+			if err != nil || string(plaintext) != message {
+				t.Fatal("cannot decrypt a data record", err)
+			}
+		}
+		if _, err := initiatorSession.Encrypt(nil); err != ErrKeyExhausted {
+			t.Fatal("the key usage limit should be reached", err)
+		}
+
+		record, err := initiatorSession.SendRekey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := responderSession.Decrypt(record)
+		if err != nil || len(plaintext) != 0 {
+			t.Fatal("cannot process the rekey control record", err)
+		}
+		if initiatorSession.out.k == oldKey || initiatorSession.out.k != responderSession.in.k {
+			t.Fatal("both peers should have rekeyed")
+		}
+		oldKey = initiatorSession.out.k
+	}
+
+	// the other direction is not affected
+	ciphertext, _ := responderSession.Encrypt([]byte("hello"))
+	if plaintext, err := initiatorSession.Decrypt(ciphertext); err != nil || string(plaintext) != "hello" {
+		t.Fatal("the other direction should still work", err)
+	}
+}
+
+// run with -race to check that the two halves share no state
+func TestHalfSessions(t *testing.T) {
+	initiator := initialize(Noise_XX, true, nil, GenerateKeypair(nil), nil, nil, nil)
+	responder := initialize(Noise_XX, false, nil, GenerateKeypair(nil), nil, nil, nil)
+	var i1, i2, r1, r2 *cipherState
+	for i1 == nil {
+		var message, payload []byte
+		var err error
+		if initiator.shouldWrite {
+			i1, i2, err = initiator.writeMessage(nil, &message)
+			r1, r2, _ = responder.readMessage(message, &payload)
+		} else {
+			r1, r2, err = responder.writeMessage(nil, &message)
+			i1, i2, _ = initiator.readMessage(message, &payload)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	initiatorRead, initiatorWrite := NewHalfSessions(true, i1, i2)
+	responderRead, responderWrite := NewHalfSessions(false, r1, r2)
+
+	if _, err := initiatorRead.Encrypt(nil); err != ErrWrongDirection {
+		t.Fatal("the read half should not encrypt", err)
+	}
+	if _, err := initiatorWrite.Decrypt(nil); err != ErrWrongDirection {
+		t.Fatal("the write half should not decrypt", err)
+	}
+
+	const messages = 100
+	toResponder := make(chan []byte, messages)
+	toInitiator := make(chan []byte, messages)
+	errc := make(chan error, 4)
+	encrypt := func(half *HalfSession, out chan<- []byte) {
+		for i := 0; i < messages; i++ {
+			ciphertext, err := half.Encrypt([]byte("hello"))
+			if err != nil {
+				errc <- err
+				return
+			}
+			out <- ciphertext
+		}
+		errc <- nil
+	}
+	decrypt := func(half *HalfSession, in <-chan []byte) {
+		for i := 0; i < messages; i++ {
+			if plaintext, err := half.Decrypt(<-in); err != nil || string(plaintext) != "hello" {
+				errc <- errors.New("cannot decrypt")
+				return
+			}
+		}
+		errc <- nil
+	}
+	go encrypt(initiatorWrite, toResponder)
+	go decrypt(responderRead, toResponder)
+	go encrypt(responderWrite, toInitiator)
+	go decrypt(initiatorRead, toInitiator)
+	for i := 0; i < 4; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one-way patterns only have one half
+	if read, write := NewHalfSessions(true, i1, nil); read != nil || write == nil {
+		t.Fatal("the initiator of a one-way pattern should only have a write half")
+	}
+}
+
+func TestSequencedSession(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	sender, receiver := NewSequencedSession(initiator), NewSequencedSession(responder)
+
+	var records [3][]byte
+	for i := range records {
+		record, err := sender.Encrypt([]byte{byte(i)})
+		if err != nil {
+			t.Fatal("cannot encrypt the record", err)
+		}
+		records[i] = record
+	}
+
+	if _, err := receiver.Decrypt(records[1]); err != ErrOutOfOrder {
+		t.Fatal("a record received before the previous one should be rejected", err)
+	}
+	// the sequence number is authenticated
+	forged := append([]byte(nil), records[1]...)
+	forged[7] = 0
+	if _, err := receiver.Decrypt(forged); err == nil || err == ErrOutOfOrder {
+		t.Fatal("a record with a modified sequence number should not decrypt", err)
+	}
+	for i, record := range records {
+		plaintext, err := receiver.Decrypt(record)
+		if err != nil || !bytes.Equal(plaintext, []byte{byte(i)}) {
+			t.Fatal("records received in order should be decrypted", i, err)
+		}
+	}
+	if _, err := receiver.Decrypt(records[2]); err != ErrOutOfOrder {
+		t.Fatal("a replayed record should be rejected", err)
+	}
+}
+
+func TestMarshalSession(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	responder.SetKeyUsageLimits(100, 1000)
+	first, _ := initiator.Encrypt([]byte("first"))
+	if _, err := responder.Decrypt(first); err != nil {
+		t.Fatal(err)
+	}
+	// produced before the round trip, decrypted after it
+	second, _ := initiator.Encrypt([]byte("second"))
+
+	serialized, err := responder.MarshalBinary()
+	if err != nil {
+		t.Fatal("cannot serialize the session", err)
+	}
+	if err = new(Session).UnmarshalBinary(serialized[:len(serialized)-1]); err == nil {
+		t.Fatal("a truncated session should not be restored")
+	}
+	restored := new(Session)
+	if err = restored.UnmarshalBinary(serialized); err != nil {
+		t.Fatal("cannot restore the session", err)
+	}
+	plaintext, err := restored.Decrypt(second)
+	if err != nil || string(plaintext) != "second" {
+		t.Fatal("the restored session cannot decrypt", err)
+	}
+	ciphertext, _ := restored.Encrypt([]byte("reply"))
+	if plaintext, err = initiator.Decrypt(ciphertext); err != nil || string(plaintext) != "reply" {
+		t.Fatal("the restored session cannot encrypt", err)
+	}
+	if restored.maxMessages != 100 || restored.received.messages != 2 {
+		t.Fatal("the key usage counters were not restored")
+	}
+
+	// with sequence numbers
+	sender, receiver := NewSequencedSession(initiator), NewSequencedSession(restored)
+	record, _ := sender.Encrypt([]byte("sequenced"))
+	receiver.Decrypt(record)
+	record, _ = sender.Encrypt([]byte("sequenced"))
+	serialized, err = receiver.MarshalBinary()
+	if err != nil {
+		t.Fatal("cannot serialize the sequenced session", err)
+	}
+	restoredReceiver := new(SequencedSession)
+	if err = restoredReceiver.UnmarshalBinary(serialized); err != nil {
+		t.Fatal("cannot restore the sequenced session", err)
+	}
+	if plaintext, err = restoredReceiver.Decrypt(record); err != nil || string(plaintext) != "sequenced" {
+		t.Fatal("the restored sequenced session cannot decrypt", err)
+	}
+
+	restored.Close()
+	if _, err = restored.MarshalBinary(); err != ErrSessionClosed {
+		t.Fatal("a closed session cannot be serialized", err)
+	}
+}
+
+func TestSendOnly(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	initiator.SendOnly()
+	responder.ReceiveOnly()
+	if initiator.in != nil || responder.out != nil {
+		t.Fatal("the unused directions should be dropped")
+	}
+
+	ciphertext, err := initiator.Encrypt([]byte("log line"))
+	if err != nil {
+		t.Fatal("the kept direction should still encrypt", err)
+	}
+	if plaintext, err := responder.Decrypt(ciphertext); err != nil || string(plaintext) != "log line" {
+		t.Fatal("the kept direction should still decrypt", err)
+	}
+	if _, err = initiator.Decrypt(ciphertext); err != ErrWrongDirection {
+		t.Fatal("a send-only session cannot decrypt", err)
+	}
+	if _, err = responder.Encrypt([]byte("reply")); err != ErrWrongDirection {
+		t.Fatal("a receive-only session cannot encrypt", err)
+	}
+	if _, err = responder.SendRekey(); err != ErrWrongDirection {
+		t.Fatal("a receive-only session cannot rekey its sending direction", err)
+	}
+
+	// the dropped directions are serialized
+	for _, s := range []*Session{initiator, responder} {
+		serialized, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*s = Session{}
+		if err = s.UnmarshalBinary(serialized); err != nil {
+			t.Fatal("cannot restore a half-dropped session", err)
+		}
+	}
+	if _, err = initiator.Decrypt(ciphertext); err != ErrWrongDirection {
+		t.Fatal("a restored send-only session cannot decrypt", err)
+	}
+	if _, err = responder.Encrypt([]byte("reply")); err != ErrWrongDirection {
+		t.Fatal("a restored receive-only session cannot encrypt", err)
+	}
+	if ciphertext, err = initiator.Encrypt([]byte("log line")); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := responder.Decrypt(ciphertext); err != nil || string(plaintext) != "log line" {
+		t.Fatal("the kept direction should survive the serialization", err)
+	}
+
+	// a session without any direction left
+	initiator.ReceiveOnly()
+	serialized, err := initiator.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(Session)
+	if err = restored.UnmarshalBinary(serialized); err != nil {
+		t.Fatal("cannot restore a fully dropped session", err)
+	}
+	if _, err = restored.Encrypt([]byte("hello")); err != ErrWrongDirection {
+		t.Fatal("a restored fully dropped session cannot encrypt", err)
+	}
+	if _, err = restored.Decrypt(ciphertext); err != ErrWrongDirection {
+		t.Fatal("a restored fully dropped session cannot decrypt", err)
+	}
+
+	// a direction cannot be both dropped and present
+	serialized, _ = responder.MarshalBinary()
+	serialized[0] |= 1 << 3
+	if err = new(Session).UnmarshalBinary(serialized); err == nil {
+		t.Fatal("a dropped direction with a key should be rejected")
+	}
+}
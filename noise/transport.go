@@ -0,0 +1,94 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+)
+
+//
+// Transport codecs
+//
+
+// A TransportCodec encrypts and decrypts the transport records exchanged once
+// the handshake is completed. It lets the framing of the transport be chosen
+// independently of the handshake, for example by a gateway that terminates
+// handshakes and forwards the traffic to a consumer expecting another record
+// format. A Session is a TransportCodec whose records carry an implicit
+// nonce, as defined by the specification.
+type TransportCodec interface {
+	// Encrypt returns the record carrying plaintext.
+	Encrypt(plaintext []byte) ([]byte, error)
+	// Decrypt authenticates a record and returns its plaintext.
+	Decrypt(record []byte) ([]byte, error)
+}
+
+var (
+	_ TransportCodec = (*Session)(nil)
+	_ TransportCodec = (*ExplicitNonceCodec)(nil)
+)
+
+// ErrUnexpectedNonce is returned by an ExplicitNonceCodec when the nonce of a
+// record is not the next one expected.
+var ErrUnexpectedNonce = errors.New("noise: the record does not carry the expected nonce")
+
+// An ExplicitNonceCodec is a TransportCodec whose records carry their nonce
+// in clear (8 bytes, big-endian) followed by the AEAD ciphertext, encrypted
+// with empty associated data and the nonce encoding of the cipher function.
+// This is the framing used by most transports built on top of Noise, which
+// can thus decrypt the records with a standard AEAD implementation and the
+// keys of the handshake. Records must still be received in order; see
+// DatagramSession for records that can be dropped or reordered.
+//
+// An ExplicitNonceCodec is safe for concurrent use.
+type ExplicitNonceCodec struct {
+	in, out         *cipherState
+	inLock, outLock sync.Mutex
+}
+
+// NewExplicitNonceCodec converts a Session into an ExplicitNonceCodec. The
+// keys of the Session are taken over and the Session must not be used
+// afterwards.
+func NewExplicitNonceCodec(s *Session) *ExplicitNonceCodec {
+	return &ExplicitNonceCodec{in: s.in, out: s.out}
+}
+
+// Encrypt encrypts plaintext under the next nonce and prepends the nonce.
+func (e *ExplicitNonceCodec) Encrypt(plaintext []byte) ([]byte, error) {
+	if e.out == nil {
+		return nil, errNoWriteChannel
+	}
+	e.outLock.Lock()
+	defer e.outLock.Unlock()
+	// 2^64-1 is reserved by Noise
+	if e.out.n == math.MaxUint64 {
+		return nil, errors.New("noise: nonce has reached maximum size")
+	}
+	record := make([]byte, 8, 8+len(plaintext)+NoiseTagLength)
+	binary.BigEndian.PutUint64(record, e.out.n)
+	record = append(record, encrypt(e.out.cipher, e.out.k, e.out.n, []byte{}, plaintext)...)
+	e.out.n++
+	return record, nil
+}
+
+// Decrypt verifies that record carries the next nonce and decrypts it.
+func (e *ExplicitNonceCodec) Decrypt(record []byte) ([]byte, error) {
+	if e.in == nil {
+		return nil, errNoReadChannel
+	}
+	if len(record) < 8+NoiseTagLength {
+		return nil, errors.New("noise: the record received is too short")
+	}
+	e.inLock.Lock()
+	defer e.inLock.Unlock()
+	if binary.BigEndian.Uint64(record[:8]) != e.in.n {
+		return nil, ErrUnexpectedNonce
+	}
+	plaintext, err := decrypt(e.in.cipher, e.in.k, e.in.n, []byte{}, record[8:])
+	if err != nil {
+		return nil, err
+	}
+	e.in.n++
+	return plaintext, nil
+}
@@ -0,0 +1,55 @@
+package noise
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestExplicitNonceCodec(t *testing.T) {
+	initiator, responder := newTestSessions(t)
+	// the key a consumer of the records would receive from the gateway
+	key := initiator.out.k
+	sender, receiver := NewExplicitNonceCodec(initiator), NewExplicitNonceCodec(responder)
+
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, message := range []string{"first record", "second record"} {
+		record, err := sender.Encrypt([]byte(message))
+		if err != nil {
+			t.Fatal("cannot encrypt the record", err)
+		}
+		if binary.BigEndian.Uint64(record[:8]) != uint64(i) {
+			t.Fatal("the record does not carry its nonce")
+		}
+
+		// a standalone ChaChaPoly decryptor
+		nonce := make([]byte, 12)
+		binary.LittleEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(record[:8]))
+		plaintext, err := aead.Open(nil, nonce, record[8:], nil)
+		if err != nil || string(plaintext) != message {
+			t.Fatal("the record cannot be decrypted with ChaChaPoly", err)
+		}
+
+		plaintext, err = receiver.Decrypt(record)
+		if err != nil || string(plaintext) != message {
+			t.Fatal("the record cannot be decrypted by the codec", err)
+		}
+		if _, err = receiver.Decrypt(record); err != ErrUnexpectedNonce {
+			t.Fatal("a replayed record should be rejected", err)
+		}
+	}
+
+	// the other direction
+	record, err := receiver.Encrypt([]byte("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[len(record)-1] ^= 1
+	if _, err = sender.Decrypt(record); err == nil {
+		t.Fatal("a tampered record should be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package noise
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+//
+// Test vector generation
+//
+
+// A TestVector is a test vector in the JSON format of cacophony and of the
+// other implementations of Noise (a file contains {"vectors": [...]}). The
+// keys and the messages are hex-encoded.
+type TestVector struct {
+	ProtocolName     string              `json:"protocol_name"`
+	InitPrologue     string              `json:"init_prologue"`
+	InitStatic       string              `json:"init_static,omitempty"`
+	InitEphemeral    string              `json:"init_ephemeral"`
+	InitRemoteStatic string              `json:"init_remote_static,omitempty"`
+	RespPrologue     string              `json:"resp_prologue"`
+	RespStatic       string              `json:"resp_static,omitempty"`
+	RespEphemeral    string              `json:"resp_ephemeral,omitempty"`
+	RespRemoteStatic string              `json:"resp_remote_static,omitempty"`
+	HandshakeHash    string              `json:"handshake_hash"`
+	Messages         []TestVectorMessage `json:"messages"`
+}
+
+// A TestVectorMessage is a message of a TestVector: a handshake message, or
+// a transport message once the handshake is completed.
+type TestVectorMessage struct {
+	Payload    string `json:"payload"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// GenerateTestVector runs a handshake with the ChaChaPoly cipher function and
+// fixed keys, and returns it as a TestVector. The key pairs that the pattern
+// does not use must be nil; the static keys known in advance are taken from
+// the static key pair of the other peer. payloads holds the payload of each
+// message: the first ones are sent in the handshake messages, and the
+// remaining ones in transport messages, alternating between the peers (or
+// all from the initiator with one-way patterns), starting with the peer that
+// did not send the last handshake message. Patterns using pre-shared keys or
+// ephemeral keys in pre-messages are not supported.
+func GenerateTestVector(pattern string, initiatorStatic, responderStatic, initiatorEphemeral, responderEphemeral *KeyPair, prologue []byte, payloads [][]byte) (TestVector, error) {
+	handshakeType, err := LookupPattern(pattern)
+	if err != nil {
+		return TestVector{}, err
+	}
+	handshakePattern := patterns[handshakeType]
+	if handshakePattern.usesPsk() || handshakePattern.requiresLocalEphemeral(true) || handshakePattern.requiresLocalEphemeral(false) {
+		return TestVector{}, errors.New("noise: test vectors cannot be generated for pattern " + handshakePattern.name)
+	}
+	if len(payloads) < len(handshakePattern.messagePatterns) {
+		return TestVector{}, errors.New("noise: a payload is required for each handshake message")
+	}
+
+	// the remote static keys known in advance
+	var initiatorRemote, responderRemote *KeyPair
+	if handshakePattern.requiresRemoteStatic(true) && responderStatic != nil {
+		initiatorRemote = &KeyPair{PublicKey: responderStatic.PublicKey}
+	}
+	if handshakePattern.requiresRemoteStatic(false) && initiatorStatic != nil {
+		responderRemote = &KeyPair{PublicKey: initiatorStatic.PublicKey}
+	}
+	initiator, err := newHandshakeState(handshakeType, "", CipherChaChaPoly, true, prologue, initiatorStatic, nil, initiatorRemote, nil)
+	if err != nil {
+		return TestVector{}, err
+	}
+	responder, err := newHandshakeState(handshakeType, "", CipherChaChaPoly, false, prologue, responderStatic, nil, responderRemote, nil)
+	if err != nil {
+		return TestVector{}, err
+	}
+	initiator.debugEphemeral, responder.debugEphemeral = initiatorEphemeral, responderEphemeral
+
+	vector := TestVector{
+		ProtocolName: handshakePattern.protocolName(CipherChaChaPoly),
+		InitPrologue: hex.EncodeToString(prologue),
+		RespPrologue: hex.EncodeToString(prologue),
+	}
+	privateHex := func(keyPair *KeyPair) string {
+		if keyPair == nil {
+			return ""
+		}
+		return hex.EncodeToString(keyPair.PrivateKey[:])
+	}
+	publicHex := func(keyPair *KeyPair) string {
+		if keyPair == nil {
+			return ""
+		}
+		return hex.EncodeToString(keyPair.PublicKey[:])
+	}
+	vector.InitStatic, vector.InitEphemeral, vector.InitRemoteStatic = privateHex(initiatorStatic), privateHex(initiatorEphemeral), publicHex(initiatorRemote)
+	vector.RespStatic, vector.RespEphemeral, vector.RespRemoteStatic = privateHex(responderStatic), privateHex(responderEphemeral), publicHex(responderRemote)
+
+	// the handshake messages
+	writer, reader := &initiator, &responder
+	var out, in *cipherState
+	for _, payload := range payloads[:len(handshakePattern.messagePatterns)] {
+		var message, received []byte
+		c1, c2, err := writer.writeMessage(payload, &message)
+		if err != nil {
+			return TestVector{}, err
+		}
+		if _, _, err = reader.readMessage(message, &received); err != nil {
+			return TestVector{}, err
+		}
+		vector.Messages = append(vector.Messages, TestVectorMessage{hex.EncodeToString(payload), hex.EncodeToString(message)})
+		out, in = c1, c2
+		// the transport starts from the other peer, except in one-way patterns
+		if writer.initiator && len(handshakePattern.messagePatterns) > 1 {
+			out, in = c2, c1
+		}
+		writer, reader = reader, writer
+	}
+	vector.HandshakeHash = hex.EncodeToString(initiator.symmetricState.h[:])
+
+	// the transport messages
+	for _, payload := range payloads[len(handshakePattern.messagePatterns):] {
+		ciphertext, err := out.encryptWithAd([]byte{}, payload)
+		if err != nil {
+			return TestVector{}, err
+		}
+		vector.Messages = append(vector.Messages, TestVectorMessage{hex.EncodeToString(payload), hex.EncodeToString(ciphertext)})
+		if len(handshakePattern.messagePatterns) > 1 {
+			out, in = in, out
+		}
+	}
+	return vector, nil
+}
@@ -0,0 +1,86 @@
+package noise
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateTestVector(t *testing.T) {
+	fixedKey := func(b byte) *KeyPair {
+		var privateKey [32]byte
+		for i := range privateKey {
+			privateKey[i] = b
+		}
+		return GenerateKeypair(&privateKey)
+	}
+	payloads := [][]byte{[]byte("first"), []byte("second"), []byte("third"), []byte("transport 1"), []byte("transport 2")}
+
+	var vectors []TestVector
+	for _, pattern := range []struct {
+		name               string
+		initiatorStatic    *KeyPair
+		responderEphemeral *KeyPair
+	}{
+		{"XX", fixedKey(1), fixedKey(4)},
+		{"IK", fixedKey(1), fixedKey(4)},
+		{"NK", nil, fixedKey(4)},
+		{"N", nil, nil},
+	} {
+		vector, err := GenerateTestVector(pattern.name, pattern.initiatorStatic, fixedKey(2), fixedKey(3), pattern.responderEphemeral, []byte("prologue"), payloads)
+		if err != nil {
+			t.Fatal("cannot generate the test vector", pattern.name, err)
+		}
+		vectors = append(vectors, vector)
+	}
+
+	// the vectors are read by the consumer of the cacophony format
+	raw, err := json.Marshal(map[string][]TestVector{"vectors": vectors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "vectors.txt")
+	if err = os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	generated := loadTestVectors(path)
+	for _, vector := range vectors {
+		testVector, ok := generated[vector.ProtocolName]
+		if !ok || len(testVector.messages) != len(payloads) {
+			t.Fatal("the test vector was not loaded", vector.ProtocolName)
+		}
+		patternName, _ := LookupPattern(vector.ProtocolName[len("Noise_") : len(vector.ProtocolName)-len("_25519_ChaChaPoly_SHA256")])
+		initiator, responder := setupInitiatorAndResponder(patternName, CipherChaChaPoly, testVector)
+		goThroughTestVectors(t, vector.ProtocolName, &initiator, &responder, testVector.messages, len(patterns[patternName].messagePatterns) == 1)
+		if hex.EncodeToString(responder.symmetricState.h[:]) != vector.HandshakeHash {
+			t.Fatal("the handshake hash does not match", vector.ProtocolName)
+		}
+	}
+
+	// the generator reproduces the vectors of cacophony
+	reference := testVectors["Noise_XX_25519_ChaChaPoly_SHA256"]
+	key := func(privateKey []byte) *KeyPair {
+		var k [32]byte
+		copy(k[:], privateKey)
+		return GenerateKeypair(&k)
+	}
+	var referencePayloads [][]byte
+	for _, message := range reference.messages {
+		referencePayloads = append(referencePayloads, message.payload)
+	}
+	vector, err := GenerateTestVector("XX", key(reference.initStatic), key(reference.respStatic), key(reference.initEphemeral), key(reference.respEphemeral), reference.initPrologue, referencePayloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, message := range reference.messages {
+		if vector.Messages[idx].Ciphertext != hex.EncodeToString(message.ciphertext) {
+			t.Fatal("the generated message does not match cacophony", idx)
+		}
+	}
+
+	if _, err = GenerateTestVector("NNpsk0", nil, nil, fixedKey(3), fixedKey(4), nil, payloads); err == nil {
+		t.Fatal("psk patterns are not supported")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"golang.org/x/crypto/curve25519"
@@ -64,18 +65,29 @@ type vector struct {
 	initPsks []byte
 	respPsks []byte
 
+	handshakeHash []byte
+
 	messages []message
 }
 
 var testVectors map[string]vector
 
+// flynnVectors are generated with the flynn/noise reference implementation
+var flynnVectors map[string]vector
+
 //
 // Retrieve test vectors from Cacophony
 //
 
 func init() {
-	// open cacophony test vectors
-	raw, err := ioutil.ReadFile("./vectors/cacophony.txt")
+	testVectors = loadTestVectors("./vectors/cacophony.txt")
+	flynnVectors = loadTestVectors("./vectors/flynn.txt")
+}
+
+// loadTestVectors parses a file of test vectors in the cacophony format
+func loadTestVectors(path string) map[string]vector {
+	// open test vectors
+	raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -84,7 +96,7 @@ func init() {
 	var parsedTestVectors cacophony
 	json.Unmarshal(raw, &parsedTestVectors)
 	// only get what I want into the testVectors map
-	testVectors = make(map[string]vector)
+	testVectors := make(map[string]vector)
 	for _, hexVector := range parsedTestVectors.Vectors {
 		initPrologue, _ := hex.DecodeString(hexVector.InitPrologue)
 		initStatic, _ := hex.DecodeString(hexVector.InitStatic)
@@ -94,6 +106,7 @@ func init() {
 		respStatic, _ := hex.DecodeString(hexVector.RespStatic)
 		respEphemeral, _ := hex.DecodeString(hexVector.RespEphemeral)
 		respRemoteStatic, _ := hex.DecodeString(hexVector.RespRemoteStatic)
+		handshakeHash, _ := hex.DecodeString(hexVector.HandshakeHash)
 		var initPsks, respPsks []byte
 		if len(hexVector.InitPsks) > 0 {
 			initPsks, _ = hex.DecodeString(hexVector.InitPsks[0])
@@ -116,12 +129,14 @@ func init() {
 			respRemoteStatic: respRemoteStatic,
 			initPsks:         initPsks,
 			respPsks:         respPsks,
+			handshakeHash:    handshakeHash,
 			messages:         messages,
 		}
 		testVectors[hexVector.ProtocolName] = byteVector
 
 	}
 
+	return testVectors
 }
 
 //
@@ -144,12 +159,13 @@ var patternsToTest = []struct {
 	{"Noise_IK_25519_ChaChaPoly_SHA256", Noise_IK},
 	{"Noise_IX_25519_ChaChaPoly_SHA256", Noise_IX},
 	{"Noise_NNpsk2_25519_ChaChaPoly_SHA256", Noise_NNpsk2},
+	{"Noise_NNpsk0_25519_ChaChaPoly_SHA256", Noise_NNpsk0},
 }
 
 func TestPatterns(t *testing.T) {
 	for _, pattern := range patternsToTest {
 		testVector := testVectors[pattern.protocolName]
-		initiator, responder := setupInitiatorAndResponder(pattern.patternName, testVector)
+		initiator, responder := setupInitiatorAndResponder(pattern.patternName, CipherChaChaPoly, testVector)
 		oneWayPattern := false
 		if pn := pattern.patternName; pn == Noise_N || pn == Noise_K || pn == Noise_X {
 			oneWayPattern = true
@@ -158,11 +174,45 @@ func TestPatterns(t *testing.T) {
 	}
 }
 
+func TestAESGCMPatterns(t *testing.T) {
+	for _, pattern := range patternsToTest {
+		protocolName := strings.Replace(pattern.protocolName, "ChaChaPoly", "AESGCM", 1)
+		testVector, ok := testVectors[protocolName]
+		if !ok {
+			t.Fatal("no test vector found for", protocolName)
+		}
+		initiator, responder := setupInitiatorAndResponder(pattern.patternName, CipherAESGCM, testVector)
+		oneWayPattern := len(patterns[pattern.patternName].messagePatterns) == 1
+		goThroughTestVectors(t, protocolName, &initiator, &responder, testVector.messages, oneWayPattern)
+	}
+}
+
+func TestFlynnVectors(t *testing.T) {
+	if len(flynnVectors) == 0 {
+		t.Fatal("no flynn/noise test vectors found")
+	}
+	for protocolName, testVector := range flynnVectors {
+		patternName, err := LookupPattern(strings.Split(protocolName, "_")[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		initiator, responder := setupInitiatorAndResponder(patternName, CipherChaChaPoly, testVector)
+		oneWayPattern := len(patterns[patternName].messagePatterns) == 1
+		goThroughTestVectors(t, protocolName, &initiator, &responder, testVector.messages, oneWayPattern)
+
+		// the handshake hash is used for channel binding
+		if !bytes.Equal(initiator.symmetricState.h[:], testVector.handshakeHash) ||
+			!bytes.Equal(responder.symmetricState.h[:], testVector.handshakeHash) {
+			t.Fatal("handshake hash does not match for", protocolName)
+		}
+	}
+}
+
 //
 // Core functions (title says everything)
 //
 
-func setupInitiatorAndResponder(patternName noiseHandshakeType, testVector vector) (handshakeState, handshakeState) {
+func setupInitiatorAndResponder(patternName noiseHandshakeType, cipher CipherFunction, testVector vector) (handshakeState, handshakeState) {
 	var init_s, init_rs, resp_s, resp_rs *KeyPair
 	// setup initiator static
 	if len(testVector.initStatic) > 0 {
@@ -190,9 +240,15 @@ func setupInitiatorAndResponder(patternName noiseHandshakeType, testVector vecto
 		copy(static.PublicKey[:], testVector.respRemoteStatic)
 		resp_rs = &static
 	}
-	// initialize(handshakeType, initiator, prologue, s, e, rs, re)
-	initiator := initialize(patternName, true, testVector.initPrologue, init_s, nil, init_rs, nil)
-	responder := initialize(patternName, false, testVector.respPrologue, resp_s, nil, resp_rs, nil)
+	// newHandshakeState(handshakeType, protocolName, cipher, initiator, prologue, s, e, rs, re)
+	initiator, err := newHandshakeState(patternName, "", cipher, true, testVector.initPrologue, init_s, nil, init_rs, nil)
+	if err != nil {
+		panic(err)
+	}
+	responder, err := newHandshakeState(patternName, "", cipher, false, testVector.respPrologue, resp_s, nil, resp_rs, nil)
+	if err != nil {
+		panic(err)
+	}
 	// setup initiator ephemeral
 	if len(testVector.initEphemeral) > 0 {
 		var e KeyPair